@@ -286,6 +286,16 @@ func (c *Client) Chat(ctx context.Context, req *ChatRequest, fn ChatResponseFunc
 // returns an error, [Client.Pull] will stop the process and return this error.
 type PullProgressFunc func(ProgressResponse) error
 
+// Plan returns how a chat request would run, including the prompt length and
+// whether the model needs to be loaded, without generating a response.
+func (c *Client) Plan(ctx context.Context, req *ChatRequest) (*PlanResponse, error) {
+	var resp PlanResponse
+	if err := c.do(ctx, http.MethodPost, "/api/chat/plan", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Pull downloads a model from the ollama library. fn is called each time
 // progress is made on the request and can be used to display a progress bar,
 // etc.
@@ -357,6 +367,24 @@ func (c *Client) ListRunning(ctx context.Context) (*ProcessResponse, error) {
 	return &lr, nil
 }
 
+// ListLoading lists models whose runners are still loading.
+func (c *Client) ListLoading(ctx context.Context) (*ProcessResponse, error) {
+	var lr ProcessResponse
+	if err := c.do(ctx, http.MethodGet, "/api/ps/loading", nil, &lr); err != nil {
+		return nil, err
+	}
+	return &lr, nil
+}
+
+// Metrics lists how chat conversations sent to each model were truncated.
+func (c *Client) Metrics(ctx context.Context) (*MetricsResponse, error) {
+	var mr MetricsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/metrics", nil, &mr); err != nil {
+		return nil, err
+	}
+	return &mr, nil
+}
+
 // Copy copies a model - creating a model with another name from an existing
 // model.
 func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
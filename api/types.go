@@ -20,6 +20,9 @@ type StatusError struct {
 	StatusCode   int
 	Status       string
 	ErrorMessage string `json:"error"`
+
+	// Reason classifies why a model failed to load, if it did.
+	Reason LoadFailure `json:"reason,omitempty"`
 }
 
 func (e StatusError) Error() string {
@@ -63,6 +66,11 @@ type GenerateRequest struct {
 	// [Client.Generate]. It can be used to keep a short conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// Resume continues the response encoded in Context, such as one stopped
+	// by num_predict, instead of starting a new turn. Prompt, if set, is
+	// appended to the response as it is.
+	Resume bool `json:"resume,omitempty"`
+
 	// Stream specifies whether the response is streaming; it is true by default.
 	Stream *bool `json:"stream,omitempty"`
 
@@ -89,6 +97,13 @@ type GenerateRequest struct {
 	// (request that thinking _not_ be used) and unset (use the old behavior
 	// before this option was introduced)
 	Think *bool `json:"think,omitempty"`
+
+	// Priority orders this request against others waiting for a model to be
+	// scheduled. Higher priority requests are served first; the default is 0.
+	Priority int `json:"priority,omitempty"`
+
+	// Verbose includes debugging details in the final response.
+	Verbose bool `json:"verbose,omitempty"`
 }
 
 // ChatRequest describes a request sent by [Client.Chat].
@@ -118,6 +133,35 @@ type ChatRequest struct {
 	// Think controls whether thinking/reasoning models will think before
 	// responding
 	Think *bool `json:"think,omitempty"`
+
+	// Priority is the scheduling priority, as in [GenerateRequest].
+	Priority int `json:"priority,omitempty"`
+
+	// Verbose includes debugging details in the final response and in the
+	// response of [Client.Plan].
+	Verbose bool `json:"verbose,omitempty"`
+
+	// RejectInvalidTools drops tool calls whose arguments don't match the
+	// tool's declared parameters. They are still reported in
+	// [ChatResponse.ToolErrors].
+	RejectInvalidTools bool `json:"reject_invalid_tools,omitempty"`
+
+	// ReportRemaining reports the approximate number of tokens left to
+	// generate on each response as [ChatResponse.Remaining].
+	ReportRemaining bool `json:"report_remaining,omitempty"`
+
+	// TypedEvents tags each streamed response with the kind of event it
+	// carries as [ChatResponse.Type].
+	TypedEvents bool `json:"typed_events,omitempty"`
+
+	// ReportQueue streams a status response with the request's position in
+	// the scheduler's queue as [ChatResponse.Queue] whenever it changes while
+	// the request waits for the model. It has no effect unless streaming.
+	ReportQueue bool `json:"report_queue,omitempty"`
+
+	// MaxChunks stops generation with the done reason "length" after this
+	// many chunks of content, overriding OLLAMA_MAX_CHUNKS.
+	MaxChunks int `json:"max_chunks,omitempty"`
 }
 
 type Tools []Tool
@@ -143,6 +187,14 @@ type Message struct {
 	Thinking  string      `json:"thinking,omitempty"`
 	Images    []ImageData `json:"images,omitempty"`
 	ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
+	// ToolCallID is the ID of the tool call a "tool" message is the result of.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	// ID identifies the message so later messages can reference it.
+	ID string `json:"id,omitempty"`
+	// References lists the IDs of earlier messages this message depends on.
+	// When set on the latest message, the referenced messages are kept when
+	// the conversation is truncated, like system messages.
+	References []string `json:"references,omitempty"`
 }
 
 func (m *Message) UnmarshalJSON(b []byte) error {
@@ -158,6 +210,7 @@ func (m *Message) UnmarshalJSON(b []byte) error {
 }
 
 type ToolCall struct {
+	ID       string           `json:"id,omitempty"`
 	Function ToolCallFunction `json:"function"`
 }
 
@@ -254,16 +307,179 @@ type ChatResponse struct {
 
 	Done bool `json:"done"`
 
+	// NumPredict is the effective limit on the number of tokens to generate,
+	// reported on the final response when a limit applies.
+	NumPredict int `json:"num_predict,omitempty"`
+
+	// NumPredictClamped is true when the requested num_predict was reduced to
+	// fit the space remaining in the context window after the prompt.
+	NumPredictClamped bool `json:"num_predict_clamped,omitempty"`
+
+	// NumCtx is the context length the model is loaded with, reported on
+	// load responses.
+	NumCtx int `json:"num_ctx,omitempty"`
+
+	// TemplateDigest is the digest of the chat template used to render the
+	// prompt, reported on the final response of verbose requests.
+	TemplateDigest string `json:"template_digest,omitempty"`
+
+	// ImageTokens is the number of prompt tokens counted for each image in
+	// the conversation, reported on the final response of verbose requests.
+	ImageTokens []int `json:"image_tokens,omitempty"`
+
+	// Warnings describes problems with the prompt which didn't prevent the
+	// request from being served, reported on the final response.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Sizing is the model metadata used to size the context length, reported
+	// on the final response of verbose requests.
+	Sizing *ModelSizing `json:"sizing,omitempty"`
+
+	// Think is the think value the prompt was rendered with, reported on the
+	// final response. It is false when the request didn't set think.
+	Think *bool `json:"think,omitempty"`
+
+	// IsThinkSet is the IsThinkSet value the prompt was rendered with: true
+	// when the request set think, even to false. It is reported on the final
+	// response of verbose requests.
+	IsThinkSet *bool `json:"is_think_set,omitempty"`
+
+	// LoadStages is the time spent in each stage of loading the model,
+	// reported on the final response of verbose requests which loaded it.
+	LoadStages *LoadStages `json:"load_stages,omitempty"`
+
+	// PeakVRAM is the most GPU memory in bytes the runner allocated while
+	// serving the request, reported on the final response of verbose requests
+	// when the runner reports it.
+	PeakVRAM uint64 `json:"peak_vram,omitempty"`
+
+	// ToolErrors describes the tool calls in this response whose arguments
+	// don't match the tool's declared parameters.
+	ToolErrors []ToolCallError `json:"tool_errors,omitempty"`
+
+	// Truncation describes how the conversation was truncated to fit the
+	// context length, reported on the final response.
+	Truncation TruncationReason `json:"truncation,omitempty"`
+
+	// ExtremeTruncation is true when every message between the system
+	// messages and the latest message was dropped, and at least
+	// OLLAMA_EXTREME_TRUNC of them, reported on the final response.
+	ExtremeTruncation bool `json:"extreme_truncation,omitempty"`
+
+	// TruncationSummary counts the messages and tokens of a conversation
+	// which was truncated to fit the context length, reported on the final
+	// response. It is nil when the whole conversation fit.
+	TruncationSummary *TruncationSummary `json:"truncation_summary,omitempty"`
+
+	// Remaining is the approximate number of tokens that can still be
+	// generated before the context window is full, reported on each response
+	// of requests which set ReportRemaining.
+	Remaining *int `json:"remaining,omitempty"`
+
+	// Type is the kind of event this response carries, reported on each
+	// response of requests which set TypedEvents.
+	Type ChatEventType `json:"type,omitempty"`
+
+	// TruncationFastPath is true when the conversation was estimated to fit
+	// from its length with OLLAMA_CHARS_PER_TOKEN rather than counting each
+	// truncation candidate, reported on the final response of verbose
+	// requests.
+	TruncationFastPath bool `json:"truncation_fast_path,omitempty"`
+
+	// TruncationStrategy is the truncation strategy the conversation was
+	// fitted with, "sliding_window" or "head_tail", after resolving "auto"
+	// from OLLAMA_TRUNCATION. It is reported on the final response of verbose
+	// requests.
+	TruncationStrategy string `json:"truncation_strategy,omitempty"`
+
+	// TemplateDuration and TokenizeDuration are the time spent executing the
+	// template and tokenizing while building the prompt, including counting
+	// truncation candidates. They are reported on the final response of
+	// verbose requests.
+	TemplateDuration time.Duration `json:"template_duration,omitempty"`
+	TokenizeDuration time.Duration `json:"tokenize_duration,omitempty"`
+
+	// TokenizeCalls is the number of times text was tokenized while building
+	// the prompt, reported on the final response of verbose requests.
+	TokenizeCalls int `json:"tokenize_calls,omitempty"`
+
+	// AllMessagesIncluded is true when every message of the conversation was
+	// rendered in full, without being dropped or clipped to fit the context
+	// length, reported on the final response of verbose requests.
+	AllMessagesIncluded *bool `json:"all_messages_included,omitempty"`
+
+	// NumCtxDecision describes how the context length was sized to fit the
+	// conversation, reported on the final response of verbose requests when
+	// OLLAMA_CONTEXT_STEP is set.
+	NumCtxDecision *NumCtxDecision `json:"num_ctx_decision,omitempty"`
+
+	// Queue is the request's place in the scheduler's queue, reported on
+	// status responses of requests which set ReportQueue.
+	Queue *QueueStatus `json:"queue,omitempty"`
+
+	// Capabilities lists the optional model capabilities the request used,
+	// reported on the final response.
+	Capabilities []model.Capability `json:"capabilities,omitempty"`
+
+	// ThinkingTruncated is true when generation stopped before the model
+	// closed its thinking, reported on the final response.
+	ThinkingTruncated bool `json:"thinking_truncated,omitempty"`
+
 	Metrics
 }
 
+// ToolCallError describes a tool call whose arguments don't match the
+// parameters declared by the tool.
+type ToolCallError struct {
+	ToolCall ToolCall `json:"tool_call"`
+	Errors   []string `json:"errors"`
+}
+
+// LoadStages is the time spent in each stage of loading a model.
+type LoadStages struct {
+	// Queue is the time waiting for the scheduler, including for other
+	// models to unload.
+	Queue time.Duration `json:"queue"`
+
+	// Parse is the time reading the model's metadata.
+	Parse time.Duration `json:"parse"`
+
+	// Start is the time estimating memory and starting the runner.
+	Start time.Duration `json:"start"`
+
+	// Weights is the time the runner spent loading the model's weights.
+	Weights time.Duration `json:"weights"`
+
+	// Cache is the time the runner spent allocating its cache.
+	Cache time.Duration `json:"cache"`
+
+	// Ready is the rest of the time waiting for the runner to become ready,
+	// such as for its process to start.
+	Ready time.Duration `json:"ready"`
+}
+
+// ModelSizing is the model metadata used to size the context length and
+// estimate the memory of the KV cache.
+type ModelSizing struct {
+	ContextLength uint64 `json:"context_length"`
+	BlockCount    uint64 `json:"block_count"`
+	HeadCount     uint64 `json:"head_count"`
+	HeadCountKV   uint64 `json:"head_count_kv"`
+	KeyLength     uint64 `json:"key_length"`
+	ValueLength   uint64 `json:"value_length"`
+}
+
 type Metrics struct {
 	TotalDuration      time.Duration `json:"total_duration,omitempty"`
 	LoadDuration       time.Duration `json:"load_duration,omitempty"`
 	PromptEvalCount    int           `json:"prompt_eval_count,omitempty"`
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
+	PromptCacheCount   int           `json:"prompt_cache_count,omitempty"`
 	EvalCount          int           `json:"eval_count,omitempty"`
 	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+	EvictedRunners     int           `json:"evicted_runners,omitempty"`
+	ColdStart          bool          `json:"cold_start,omitempty"`
+	PromptCacheHit     bool          `json:"prompt_cache_hit,omitempty"`
 }
 
 // Options specified in [GenerateRequest].  If you add a new option here, also
@@ -285,6 +501,90 @@ type Options struct {
 	PresencePenalty  float32  `json:"presence_penalty,omitempty"`
 	FrequencyPenalty float32  `json:"frequency_penalty,omitempty"`
 	Stop             []string `json:"stop,omitempty"`
+
+	// AddBOS controls whether the beginning of sequence token is added to the
+	// prompt. When unset the model's default is used.
+	AddBOS *bool `json:"add_bos,omitempty"`
+
+	// NoCache evaluates the whole prompt instead of reusing the cached
+	// prompt of an earlier request.
+	NoCache bool `json:"no_cache,omitempty"`
+
+	// ImagePlacement is "prefix" or "suffix" to place image tags before or
+	// after the message content. Defaults to "prefix".
+	ImagePlacement string `json:"image_placement,omitempty"`
+
+	// MaxImagesTotal is the maximum number of images the model accepts in a
+	// prompt after truncation. Zero allows any number of images.
+	MaxImagesTotal int `json:"max_images_total,omitempty"`
+
+	// ImageBaseTokens is the number of prompt tokens counted for each image
+	// of a vision model. Defaults to the cost of the model's family, or 768.
+	ImageBaseTokens int `json:"image_base_tokens,omitempty"`
+
+	// ImageTileSize and ImageTileTokens count images of vision models which
+	// tile them by resolution as ImageBaseTokens plus ImageTileTokens for
+	// each tile of ImageTileSize pixels square covering the image.
+	ImageTileSize   int `json:"image_tile_size,omitempty"`
+	ImageTileTokens int `json:"image_tile_tokens,omitempty"`
+
+	// MaxMessageTokens clips the content of any message longer than this
+	// many tokens to its start and end. Zero leaves messages whole.
+	MaxMessageTokens int `json:"max_message_tokens,omitempty"`
+
+	// LatestOverflow is "error" to reject a chat conversation whose latest
+	// message doesn't fit the context length alongside the messages which
+	// are always kept, or "truncate" to clip the latest message to fit. By
+	// default the prompt is left to the runner to truncate.
+	LatestOverflow string `json:"latest_overflow,omitempty"`
+
+	// SkipMarker is the message inserted in place of truncated chat history,
+	// overriding OLLAMA_SKIP_MARKER. {turns} and {tokens} are replaced with
+	// the number of messages and approximate tokens removed.
+	SkipMarker string `json:"skip_marker,omitempty"`
+
+	// SkipMarkerRole is the role of the skip marker. Defaults to "system".
+	SkipMarkerRole string `json:"skip_marker_role,omitempty"`
+
+	// NumReserve is the number of tokens reserved for the response when
+	// sizing the context length dynamically and NumPredict is unset.
+	NumReserve int `json:"num_reserve,omitempty"`
+
+	// ToolRounds is the number of further tool call rounds of ToolRoundTokens
+	// each to reserve room for when sizing the context length dynamically for
+	// requests with tools, so agent loops don't need a larger context midway.
+	ToolRounds      int `json:"tool_rounds,omitempty"`
+	ToolRoundTokens int `json:"tool_round_tokens,omitempty"`
+
+	// NumCtxMax raises the cap on context lengths, whether set with NumCtx
+	// or sized dynamically, above the model's maximum context length, up to
+	// OLLAMA_MAX_CONTEXT. RoPE is scaled linearly to fit the longer context
+	// into the positions the model was trained on.
+	NumCtxMax int `json:"num_ctx_max,omitempty"`
+
+	// NumCtxRounding is "up", "down" or "nearest" to round dynamically sized
+	// context lengths to OLLAMA_CONTEXT_STEP. Defaults to "up".
+	NumCtxRounding string `json:"num_ctx_rounding,omitempty"`
+
+	// Chat history truncation options
+	Truncation   string `json:"truncation,omitempty"`
+	TruncateHead int    `json:"truncate_head,omitempty"`
+	TruncateTail int    `json:"truncate_tail,omitempty"`
+
+	// NumKeepMessages is the number of conversation messages at the start of
+	// the chat history which truncation always keeps, like system messages.
+	// Unlike NumKeep, which counts tokens the runner keeps when shifting the
+	// context, it counts messages. Requests can't set both.
+	NumKeepMessages int `json:"num_keep_messages,omitempty"`
+
+	// SystemOrder is "hoist" or "position" to render the system messages
+	// kept by truncation ahead of the messages it drops, or where they were
+	// in the conversation. Defaults to "hoist".
+	SystemOrder string `json:"system_order,omitempty"`
+
+	// ToolPriority is "tools" or "history" to keep full tool definitions or
+	// trim their descriptions to fit more chat history. Defaults to "tools".
+	ToolPriority string `json:"tool_priority,omitempty"`
 }
 
 // Runner options which must be set when the model is loaded into memory
@@ -295,6 +595,10 @@ type Runner struct {
 	MainGPU   int   `json:"main_gpu,omitempty"`
 	UseMMap   *bool `json:"use_mmap,omitempty"`
 	NumThread int   `json:"num_thread,omitempty"`
+
+	// KVCacheType is the quantization type of the KV cache, overriding
+	// OLLAMA_KV_CACHE_TYPE. Changing it reloads the model.
+	KVCacheType string `json:"kv_cache_type,omitempty"`
 }
 
 // EmbedRequest is the request passed to [Client.Embed].
@@ -404,6 +708,10 @@ type ShowResponse struct {
 	Tensors       []Tensor           `json:"tensors,omitempty"`
 	Capabilities  []model.Capability `json:"capabilities,omitempty"`
 	ModifiedAt    time.Time          `json:"modified_at,omitempty"`
+
+	// Options are the options requests use unless they set them, combining
+	// the server defaults with the model's parameters.
+	Options *Options `json:"options,omitempty"`
 }
 
 // CopyRequest is the request passed to [Client.Copy].
@@ -455,6 +763,32 @@ type ProcessResponse struct {
 	Models []ProcessModelResponse `json:"models"`
 }
 
+// MetricsResponse is the response from [Client.Metrics].
+type MetricsResponse struct {
+	Models []ModelMetrics `json:"models"`
+}
+
+// ModelMetrics aggregates how chat conversations sent to a model were
+// truncated since the server started.
+type ModelMetrics struct {
+	Model string `json:"model"`
+
+	// Requests is the number of chat requests sent to the model.
+	Requests int `json:"requests"`
+
+	// TruncatedRequests is the number of requests which had messages dropped
+	// to fit the context window.
+	TruncatedRequests int `json:"truncated_requests"`
+
+	// AvgTokensRemoved is the average number of tokens dropped from each
+	// truncated request.
+	AvgTokensRemoved float64 `json:"avg_tokens_removed"`
+
+	// MaxConversationTokens is the length in tokens of the longest
+	// conversation sent to the model, before truncation.
+	MaxConversationTokens int `json:"max_conversation_tokens"`
+}
+
 // ListModelResponse is a single model description in [ListResponse].
 type ListModelResponse struct {
 	Name       string       `json:"name"`
@@ -465,6 +799,177 @@ type ListModelResponse struct {
 	Details    ModelDetails `json:"details,omitempty"`
 }
 
+// PlanResponse is the response returned by [Client.Plan]. It describes how a
+// chat request would run without generating a response.
+type PlanResponse struct {
+	Model string `json:"model"`
+
+	// NumCtx is the context length the request would run with.
+	NumCtx int `json:"num_ctx"`
+
+	// PromptEvalCount is the number of tokens in the prompt.
+	PromptEvalCount int `json:"prompt_eval_count"`
+
+	// PromptEvalDuration is the estimated time to evaluate the prompt based on
+	// recent requests to the model. It is omitted when there is no history.
+	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
+
+	// Reload is true if the model would need to be loaded, or reloaded with
+	// different options, to run the request.
+	Reload bool `json:"reload"`
+
+	// Loaded is true if the model wasn't loaded and was loaded to tokenize
+	// the prompt. Reload then describes the model as it was loaded.
+	Loaded bool `json:"loaded,omitempty"`
+
+	// Trace lists each set of messages considered while truncating the
+	// conversation to fit the context length. It is only set for verbose
+	// requests.
+	Trace []TruncationStep `json:"trace,omitempty"`
+
+	// Truncation describes how the conversation would be truncated.
+	Truncation TruncationReason `json:"truncation,omitempty"`
+
+	// ExtremeTruncation is true when the conversation would be truncated to
+	// its system messages and latest message, as in [ChatResponse].
+	ExtremeTruncation bool `json:"extreme_truncation,omitempty"`
+
+	// TruncationFastPath is true when the conversation was estimated to fit
+	// from its length, as in [ChatResponse]. It is only set for verbose
+	// requests.
+	TruncationFastPath bool `json:"truncation_fast_path,omitempty"`
+
+	// TruncationStrategy is the truncation strategy the conversation would be
+	// fitted with, as in [ChatResponse]. It is only set for verbose requests.
+	TruncationStrategy string `json:"truncation_strategy,omitempty"`
+}
+
+// TruncationStep is a candidate set of messages considered while truncating
+// a conversation in [PlanResponse].
+type TruncationStep struct {
+	// Messages is the number of messages in the candidate prompt.
+	Messages int `json:"messages"`
+
+	// Tokens is the number of tokens in the candidate prompt.
+	Tokens int `json:"tokens"`
+
+	// Limit is the number of tokens the candidate prompt needed to fit.
+	Limit int `json:"limit"`
+}
+
+// LoadFailure classifies why the server couldn't load a model.
+type LoadFailure string
+
+const (
+	// LoadFailureInsufficientVRAM means the model didn't fit in the memory
+	// of the available GPUs.
+	LoadFailureInsufficientVRAM LoadFailure = "insufficient_vram"
+
+	// LoadFailureNoCompatibleGPU means no GPU the model could be offloaded
+	// to was found.
+	LoadFailureNoCompatibleGPU LoadFailure = "no_compatible_gpu"
+
+	// LoadFailureCapacityExceeded means the server was too busy to accept
+	// the request.
+	LoadFailureCapacityExceeded LoadFailure = "capacity_exceeded"
+)
+
+// TruncationSummary counts what remained of a conversation truncated to fit
+// the context length.
+type TruncationSummary struct {
+	// OriginalMessageCount is the number of messages in the request.
+	OriginalMessageCount int `json:"original_message_count"`
+
+	// FinalMessageCount is the number of messages rendered into the prompt,
+	// not counting the skip marker.
+	FinalMessageCount int `json:"final_message_count"`
+
+	// MessagesRemoved is the number of messages dropped.
+	MessagesRemoved int `json:"messages_removed"`
+
+	// FinalTokenCount is the number of tokens in the prompt.
+	FinalTokenCount int `json:"final_token_count"`
+}
+
+// TruncationReason describes how a conversation was truncated to fit the
+// context length.
+type TruncationReason string
+
+const (
+	// TruncationNone means the whole conversation fit.
+	TruncationNone TruncationReason = "none"
+
+	// TruncationIntermediateDropped means some of the messages between the
+	// system messages and the latest message were dropped.
+	TruncationIntermediateDropped TruncationReason = "intermediate_dropped"
+
+	// TruncationAllIntermediateDropped means only the system messages and the
+	// latest message were kept.
+	TruncationAllIntermediateDropped TruncationReason = "all_intermediate_dropped"
+
+	// TruncationSystemTruncated means system messages were dropped because
+	// they didn't fit the context length on their own.
+	TruncationSystemTruncated TruncationReason = "system_truncated"
+
+	// TruncationLatestTruncated means the latest message didn't fit alongside
+	// the system messages, so the prompt is truncated by the runner.
+	TruncationLatestTruncated TruncationReason = "latest_truncated"
+)
+
+// ChatEventType is the kind of event a streamed [ChatResponse] carries.
+type ChatEventType string
+
+const (
+	// ChatEventContent carries generated content in Message.Content.
+	ChatEventContent ChatEventType = "content"
+
+	// ChatEventThinking carries the model's thinking in Message.Thinking.
+	ChatEventThinking ChatEventType = "thinking"
+
+	// ChatEventToolCall carries tool calls in Message.ToolCalls, or the
+	// problems with them in ToolErrors.
+	ChatEventToolCall ChatEventType = "tool_call"
+
+	// ChatEventDone is the final response, carrying the metrics and any
+	// remaining content.
+	ChatEventDone ChatEventType = "done"
+
+	// ChatEventStatus reports the request's place in the queue in Queue
+	// before it's served.
+	ChatEventStatus ChatEventType = "status"
+)
+
+// NumCtxDecision describes how a dynamically sized context length was chosen.
+type NumCtxDecision struct {
+	// Resident is the context length the request was first scheduled with.
+	Resident int `json:"resident"`
+
+	// Required is the number of tokens the conversation and response need.
+	Required int `json:"required"`
+
+	// Reused is true when the resident context length was kept because the
+	// requirement was within OLLAMA_CTX_HYSTERESIS tokens of it.
+	Reused bool `json:"reused"`
+
+	// CappedBy is set when the requirement exceeded the longest context the
+	// model could run with: "vram" when the KV cache wouldn't fit in free
+	// VRAM, "model_max" for the model's maximum context length, or "request"
+	// for a maximum raised by the request's num_ctx_max.
+	CappedBy string `json:"capped_by,omitempty"`
+}
+
+// QueueStatus is a request's place in the scheduler's queue while it waits
+// for a model.
+type QueueStatus struct {
+	// Position is the number of requests that will be served first.
+	Position int `json:"position"`
+
+	// EstimatedWait is how long the request is expected to wait, from the
+	// recent rate requests have been served. It is omitted until the
+	// scheduler has served a backlog.
+	EstimatedWait time.Duration `json:"estimated_wait,omitempty"`
+}
+
 // ProcessModelResponse is a single model description in [ProcessResponse].
 type ProcessModelResponse struct {
 	Name      string       `json:"name"`
@@ -501,13 +1006,53 @@ type GenerateResponse struct {
 	// DoneReason is the reason the model stopped generating text.
 	DoneReason string `json:"done_reason,omitempty"`
 
+	// NumCtx is the context length the model is loaded with, reported on
+	// load responses.
+	NumCtx int `json:"num_ctx,omitempty"`
+
 	// Context is an encoding of the conversation used in this response; this
 	// can be sent in the next request to keep a conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// TemplateDigest is the digest of the template used to render the prompt,
+	// reported on the final response of verbose requests. It is empty for raw
+	// prompts.
+	TemplateDigest string `json:"template_digest,omitempty"`
+
+	// Capabilities lists the optional model capabilities the request used,
+	// reported on the final response.
+	Capabilities []model.Capability `json:"capabilities,omitempty"`
+
+	// ThinkingTruncated is true when generation stopped before the model
+	// closed its thinking, reported on the final response.
+	ThinkingTruncated bool `json:"thinking_truncated,omitempty"`
+
+	// ContextFit describes how the prompt fits the context length, reported
+	// on the final response of verbose requests.
+	ContextFit *ContextFit `json:"context_fit,omitempty"`
+
+	// PeakVRAM is the most GPU memory in bytes the runner allocated while
+	// serving the request, reported on the final response of verbose requests
+	// when the runner reports it.
+	PeakVRAM uint64 `json:"peak_vram,omitempty"`
+
 	Metrics
 }
 
+// ContextFit describes how a prompt, which isn't truncated by the server,
+// fits the context length in [GenerateResponse].
+type ContextFit struct {
+	// Tokens is the number of tokens in the prompt.
+	Tokens int `json:"tokens"`
+
+	// NumCtx is the context length the request ran with.
+	NumCtx int `json:"num_ctx"`
+
+	// Fits is false when the prompt is longer than the context length, in
+	// which case it is truncated by the runner.
+	Fits bool `json:"fits"`
+}
+
 // ModelDetails provides details about a model.
 type ModelDetails struct {
 	ParentModel       string   `json:"parent_model"`
@@ -536,6 +1081,12 @@ func (m *Metrics) Summary() {
 
 	if m.PromptEvalCount > 0 {
 		fmt.Fprintf(os.Stderr, "prompt eval count:    %d token(s)\n", m.PromptEvalCount)
+	} else if m.PromptCacheHit {
+		fmt.Fprintf(os.Stderr, "prompt eval count:    0 token(s), prompt cached\n")
+	}
+
+	if m.PromptCacheCount > 0 {
+		fmt.Fprintf(os.Stderr, "prompt cache count:   %d token(s)\n", m.PromptCacheCount)
 	}
 
 	if m.PromptEvalDuration > 0 {
@@ -551,6 +1102,10 @@ func (m *Metrics) Summary() {
 		fmt.Fprintf(os.Stderr, "eval duration:        %s\n", m.EvalDuration)
 		fmt.Fprintf(os.Stderr, "eval rate:            %.2f tokens/s\n", float64(m.EvalCount)/m.EvalDuration.Seconds())
 	}
+
+	if m.EvictedRunners > 0 {
+		fmt.Fprintf(os.Stderr, "evicted runners:      %d\n", m.EvictedRunners)
+	}
 }
 
 func (opts *Options) FromMap(m map[string]any) error {
@@ -648,9 +1203,14 @@ func (opts *Options) FromMap(m map[string]any) error {
 // DefaultOptions is the default set of options for [GenerateRequest]; these
 // values are used unless the user specifies other values explicitly.
 func DefaultOptions() Options {
+	numPredict := -1
+	if n := envconfig.NumPredict(); n > 0 {
+		numPredict = int(n)
+	}
+
 	return Options{
 		// options set on request to runner
-		NumPredict: -1,
+		NumPredict: numPredict,
 
 		// set a minimal num_keep to avoid issues on context shifts
 		NumKeep:          4,
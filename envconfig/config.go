@@ -134,6 +134,23 @@ func LoadTimeout() (loadTimeout time.Duration) {
 	return loadTimeout
 }
 
+// StallTimeout returns how long a generation may go without producing output before it is aborted.
+// It is measured between chunks, so the time to evaluate the prompt before the first chunk
+// doesn't count.
+// StallTimeout can be configured via the OLLAMA_STALL_TIMEOUT environment variable.
+// Zero or negative values disable stall detection, which is the default.
+func StallTimeout() (stallTimeout time.Duration) {
+	if s := Var("OLLAMA_STALL_TIMEOUT"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			stallTimeout = d
+		} else if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			stallTimeout = time.Duration(n) * time.Second
+		}
+	}
+
+	return max(stallTimeout, 0)
+}
+
 func Bool(k string) func() bool {
 	return func() bool {
 		if s := Var(k); s != "" {
@@ -185,6 +202,94 @@ var (
 	ContextLength = Uint("OLLAMA_CONTEXT_LENGTH", 4096)
 	// Auth enables authentication between the Ollama client and server
 	UseAuth = Bool("OLLAMA_AUTH")
+	// SkipMarker is the message inserted in place of truncated chat history. {turns} and {tokens}
+	// are replaced with the number of messages and approximate tokens removed.
+	SkipMarker = String("OLLAMA_SKIP_MARKER")
+	// SkipMarkerPosition sets where the skip marker is placed: "after_m1", the default, places it
+	// where the dropped messages were, after the first message, and "before_intermediates" places
+	// it right before the kept intermediate messages, after any system messages kept between them.
+	// It is never placed between a tool call and its results.
+	SkipMarkerPosition = String("OLLAMA_SKIP_MARKER_AT")
+	// SkipMarkerReuse sets which messages left in a chat conversation by an earlier truncation are
+	// replaced by a new skip marker: by default only system messages matching the marker, "role"
+	// also matches messages with the marker's configured role and "off" replaces none.
+	SkipMarkerReuse = String("OLLAMA_SKIP_MARKER_REUSE")
+	// TruncationClasses selects the chat truncation strategy by conversation length when requests
+	// don't set one, as comma separated min:strategy pairs (e.g. "0:sliding_window,50:head_tail").
+	// head_tail may be followed by the number of messages kept from the head and tail, as in
+	// "50:head_tail:2:8", and otherwise falls back to sliding_window unless the request sets them.
+	TruncationClasses = String("OLLAMA_TRUNCATION")
+	// SystemOverflow sets how chat requests are handled when system messages alone exceed the
+	// context length: "error" rejects the request and "truncate" drops the oldest system messages.
+	// Otherwise the request proceeds with all system messages.
+	SystemOverflow = String("OLLAMA_SYSTEM_OVERFLOW")
+	// PredictOverflow sets how chat requests are handled when num_predict is at least the largest
+	// context length the model may use while sizing the context length dynamically: "error"
+	// rejects the request. Otherwise num_predict is clamped to one less than that context length.
+	PredictOverflow = String("OLLAMA_PREDICT_OVERFLOW")
+	// ToolsInSystem renders tools into a system message for models whose template does not render
+	// tools instead of rejecting the request.
+	ToolsInSystem = Bool("OLLAMA_TOOLS_IN_SYSTEM")
+	// NormalizeContent normalizes line endings and surrounding whitespace of chat messages before
+	// they are templated and tokenized.
+	NormalizeContent = Bool("OLLAMA_NORMALIZE_CONTENT")
+	// SummarizeDropped asks the model to summarize the messages dropped when a chat conversation is
+	// truncated and inserts the summary in their place instead of the skip marker.
+	SummarizeDropped = Bool("OLLAMA_SUMMARIZE_DROPPED")
+	// ToolOrphans sets how tool results are handled when their tool call was truncated from chat
+	// history: "drop" removes the result and "keep" keeps the tool call and its results like system
+	// messages, truncating earlier messages instead. Otherwise the result is kept without its tool
+	// call.
+	ToolOrphans = String("OLLAMA_TOOL_ORPHANS")
+	// EmptyChat sets how chat prompts with no messages are rendered: "error" rejects them and
+	// "render" renders the template without messages. Otherwise the prompt is empty. Chat requests
+	// without messages only load the model and /api/chat/plan rejects them, so this only applies
+	// to prompts rendered internally.
+	EmptyChat = String("OLLAMA_EMPTY_CHAT")
+	// UnknownRoles sets how chat messages with roles the template doesn't render are handled:
+	// "error" rejects them. Otherwise they are skipped with a warning.
+	UnknownRoles = String("OLLAMA_UNKNOWN_ROLES")
+	// DuplicateImages sets how an image attached to several chat messages is handled: "dedupe"
+	// places it once, at its first [img] placeholder or else its first message. Otherwise each
+	// attachment is a separate image.
+	DuplicateImages = String("OLLAMA_DUPLICATE_IMAGES")
+	// MixedInput sets how requests setting both messages and a prompt are handled: "error"
+	// rejects them. Otherwise chat requests use the messages and generate requests use the
+	// prompt, ignoring the other with a warning.
+	MixedInput = String("OLLAMA_MIXED_INPUT")
+	// EmptyPrompt sets how a template rendering an empty prompt from non-empty messages is
+	// handled: "allow" sends the empty prompt with a warning. Otherwise the request is rejected.
+	EmptyPrompt = String("OLLAMA_EMPTY_PROMPT")
+	// CreateConflict sets how requests to run a model which is being created or pulled are
+	// handled: "error" rejects them. Otherwise they wait until the model is written.
+	CreateConflict = String("OLLAMA_CREATE_CONFLICT")
+	// NoVisionImages sets how images sent to a model without vision are handled: "error" rejects
+	// them and "drop" removes them with a warning. Otherwise they are passed to the template.
+	NoVisionImages = String("OLLAMA_NO_VISION_IMAGES")
+	// SystemOnly sets how chat prompts with only system messages are handled: "error" rejects
+	// them. Otherwise the model responds to the system messages alone.
+	SystemOnly = String("OLLAMA_SYSTEM_ONLY")
+	// InvalidTools sets how tools whose parameters can't be serialized to JSON are handled: "drop"
+	// removes them with a warning. Otherwise the request is rejected.
+	InvalidTools = String("OLLAMA_INVALID_TOOLS")
+	// ToolStreaming sets how streamed chat requests with tools are handled when the model's
+	// template doesn't mark where tool calls start: "buffer" sends the response once its tool
+	// calls are assembled and "error" rejects them. Otherwise tool calls are parsed as they stream.
+	ToolStreaming = String("OLLAMA_TOOL_STREAMING")
+	// ToolCallContent sets how tool calls of chat messages are handled for templates which don't
+	// render them: "json" writes them after the message content as JSON objects, so they are
+	// rendered and counted with it. Otherwise they are left out of the prompt.
+	ToolCallContent = String("OLLAMA_TOOL_CALL_CONTENT")
+	// CacheHitEval sets the prompt eval count reported when the whole prompt was cached: "cached"
+	// reports the number of cached tokens. Otherwise zero is reported.
+	CacheHitEval = String("OLLAMA_CACHE_HIT_EVAL")
+	// ReloadPolicy sets how a request for a loaded model with incompatible load options is handled
+	// while the model is busy: "second_runner" loads the model again alongside the busy runner.
+	// Otherwise the request waits for the runner to finish and reloads it.
+	ReloadPolicy = String("OLLAMA_RELOAD_POLICY")
+	// ContextVRAMCap caps dynamically sized context lengths to what the KV cache can grow to in
+	// free VRAM.
+	ContextVRAMCap = Bool("OLLAMA_CTX_VRAM_CAP")
 )
 
 func String(s string) func() string {
@@ -224,6 +329,33 @@ var (
 	MaxRunners = Uint("OLLAMA_MAX_LOADED_MODELS", 0)
 	// MaxQueue sets the maximum number of queued requests. MaxQueue can be configured via the OLLAMA_MAX_QUEUE environment variable.
 	MaxQueue = Uint("OLLAMA_MAX_QUEUE", 512)
+	// MaxLoads sets the maximum number of models loading at the same time. Additional loads wait in the queue. MaxLoads can be configured via the OLLAMA_MAX_LOADS environment variable.
+	MaxLoads = Uint("OLLAMA_MAX_LOADS", 0)
+	// TokenCacheSize sets the number of chat message token counts cached across requests. TokenCacheSize can be configured via the OLLAMA_TOKEN_CACHE_SIZE environment variable.
+	TokenCacheSize = Uint("OLLAMA_TOKEN_CACHE_SIZE", 0)
+	// MaxImageSize sets the maximum width and height in pixels of input images. Larger images are downscaled. MaxImageSize can be configured via the OLLAMA_MAX_IMAGE_SIZE environment variable.
+	MaxImageSize = Uint("OLLAMA_MAX_IMAGE_SIZE", 0)
+	// ContextStep sizes the context length of chat requests to fit the conversation, rounded to a multiple of ContextStep. ContextStep can be configured via the OLLAMA_CONTEXT_STEP environment variable.
+	ContextStep = Uint("OLLAMA_CONTEXT_STEP", 0)
+	// ContextHysteresis keeps the context length a chat request was scheduled with while the
+	// tokens the conversation needs are within ContextHysteresis of it, rather than reloading the
+	// model with a dynamically sized context length. ContextHysteresis can be configured via the
+	// OLLAMA_CTX_HYSTERESIS environment variable.
+	ContextHysteresis = Uint("OLLAMA_CTX_HYSTERESIS", 0)
+	// MaxContext is the largest context length requests may raise context lengths to beyond the model's maximum. MaxContext can be configured via the OLLAMA_MAX_CONTEXT environment variable.
+	MaxContext = Uint("OLLAMA_MAX_CONTEXT", 0)
+	// TokenizeWorkers sets the number of chat messages tokenized concurrently while truncating long conversations. TokenizeWorkers can be configured via the OLLAMA_TOKENIZE_WORKERS environment variable.
+	TokenizeWorkers = Uint("OLLAMA_TOKENIZE_WORKERS", 0)
+	// NumPredict sets the default maximum number of tokens to generate when neither the request nor the model sets num_predict. NumPredict can be configured via the OLLAMA_NUM_PREDICT environment variable.
+	NumPredict = Uint("OLLAMA_NUM_PREDICT", 0)
+	// CharsPerToken estimates the tokens of chat conversations from their length. Conversations estimated to fit the context length are confirmed with a single count instead of counting each truncation candidate. CharsPerToken can be configured via the OLLAMA_CHARS_PER_TOKEN environment variable.
+	CharsPerToken = Uint("OLLAMA_CHARS_PER_TOKEN", 0)
+	// MaxChunks stops chat generation with done reason "length" after that many chunks of content when the request doesn't set max_chunks. MaxChunks can be configured via the OLLAMA_MAX_CHUNKS environment variable.
+	MaxChunks = Uint("OLLAMA_MAX_CHUNKS", 0)
+	// ExtremeTruncation is the number of dropped messages from which truncating a chat conversation to its system messages and latest message is reported as extreme truncation. Zero never reports it. ExtremeTruncation can be configured via the OLLAMA_EXTREME_TRUNC environment variable.
+	ExtremeTruncation = Uint("OLLAMA_EXTREME_TRUNC", 1)
+	// ToolContextPercent rejects chat requests whose tools alone take more than that percent of the context length, leaving too little for messages. Zero never rejects them. ToolContextPercent can be configured via the OLLAMA_TOOL_CTX_PERCENT environment variable.
+	ToolContextPercent = Uint("OLLAMA_TOOL_CTX_PERCENT", 0)
 )
 
 func Uint64(key string, defaultValue uint64) func() uint64 {
@@ -259,8 +391,10 @@ func AsMap() map[string]EnvVar {
 		"OLLAMA_KEEP_ALIVE":        {"OLLAMA_KEEP_ALIVE", KeepAlive(), "The duration that models stay loaded in memory (default \"5m\")"},
 		"OLLAMA_LLM_LIBRARY":       {"OLLAMA_LLM_LIBRARY", LLMLibrary(), "Set LLM library to bypass autodetection"},
 		"OLLAMA_LOAD_TIMEOUT":      {"OLLAMA_LOAD_TIMEOUT", LoadTimeout(), "How long to allow model loads to stall before giving up (default \"5m\")"},
+		"OLLAMA_STALL_TIMEOUT":     {"OLLAMA_STALL_TIMEOUT", StallTimeout(), "How long to allow generations to go without output before giving up (default: 0)"},
 		"OLLAMA_MAX_LOADED_MODELS": {"OLLAMA_MAX_LOADED_MODELS", MaxRunners(), "Maximum number of loaded models per GPU"},
 		"OLLAMA_MAX_QUEUE":         {"OLLAMA_MAX_QUEUE", MaxQueue(), "Maximum number of queued requests"},
+		"OLLAMA_MAX_LOADS":         {"OLLAMA_MAX_LOADS", MaxLoads(), "Maximum number of models loading at the same time (default: 0, unlimited)"},
 		"OLLAMA_MODELS":            {"OLLAMA_MODELS", Models(), "The path to the models directory"},
 		"OLLAMA_NOHISTORY":         {"OLLAMA_NOHISTORY", NoHistory(), "Do not preserve readline history"},
 		"OLLAMA_NOPRUNE":           {"OLLAMA_NOPRUNE", NoPrune(), "Do not prune model blobs on startup"},
@@ -269,7 +403,42 @@ func AsMap() map[string]EnvVar {
 		"OLLAMA_SCHED_SPREAD":      {"OLLAMA_SCHED_SPREAD", SchedSpread(), "Always schedule model across all GPUs"},
 		"OLLAMA_MULTIUSER_CACHE":   {"OLLAMA_MULTIUSER_CACHE", MultiUserCache(), "Optimize prompt caching for multi-user scenarios"},
 		"OLLAMA_CONTEXT_LENGTH":    {"OLLAMA_CONTEXT_LENGTH", ContextLength(), "Context length to use unless otherwise specified (default: 4096)"},
+		"OLLAMA_NUM_PREDICT":       {"OLLAMA_NUM_PREDICT", NumPredict(), "Maximum number of tokens to generate unless otherwise specified (default: unlimited)"},
 		"OLLAMA_NEW_ENGINE":        {"OLLAMA_NEW_ENGINE", NewEngine(), "Enable the new Ollama engine"},
+		"OLLAMA_MAX_IMAGE_SIZE":    {"OLLAMA_MAX_IMAGE_SIZE", MaxImageSize(), "Maximum width and height of input images, larger images are downscaled (default: 0)"},
+		"OLLAMA_MAX_CONTEXT":       {"OLLAMA_MAX_CONTEXT", MaxContext(), "Largest context length requests may exceed the model's maximum with num_ctx_max (default: 0)"},
+		"OLLAMA_CONTEXT_STEP":      {"OLLAMA_CONTEXT_STEP", ContextStep(), "Size chat context lengths to fit the conversation in multiples of this value (default: 0)"},
+		"OLLAMA_CTX_HYSTERESIS":    {"OLLAMA_CTX_HYSTERESIS", ContextHysteresis(), "Tokens a sized chat context length may differ by before the model is reloaded (default: 0)"},
+		"OLLAMA_CHARS_PER_TOKEN":   {"OLLAMA_CHARS_PER_TOKEN", CharsPerToken(), "Characters per token to estimate whether chat conversations fit without counting each message (default: 0)"},
+		"OLLAMA_TOKENIZE_WORKERS":  {"OLLAMA_TOKENIZE_WORKERS", TokenizeWorkers(), "Number of chat messages tokenized concurrently while truncating long conversations (default: 0)"},
+		"OLLAMA_MAX_CHUNKS":        {"OLLAMA_MAX_CHUNKS", MaxChunks(), "Maximum number of chunks of content streamed per chat response (default: 0, unlimited)"},
+		"OLLAMA_EXTREME_TRUNC":     {"OLLAMA_EXTREME_TRUNC", ExtremeTruncation(), "Dropped messages from which keeping only system messages and the latest message is flagged as extreme truncation (default: 1)"},
+		"OLLAMA_TOKEN_CACHE_SIZE":  {"OLLAMA_TOKEN_CACHE_SIZE", TokenCacheSize(), "Number of chat message token counts cached across requests (default: 0)"},
+		"OLLAMA_TRUNCATION":        {"OLLAMA_TRUNCATION", TruncationClasses(), "Chat truncation strategy by minimum number of messages (e.g. \"0:sliding_window,50:head_tail:2:8\")"},
+		"OLLAMA_SKIP_MARKER_AT":    {"OLLAMA_SKIP_MARKER_AT", SkipMarkerPosition(), "Position of the skip marker in truncated chat history (after_m1, before_intermediates)"},
+		"OLLAMA_SKIP_MARKER_REUSE": {"OLLAMA_SKIP_MARKER_REUSE", SkipMarkerReuse(), "Earlier skip markers replaced by a new one (role, off; default: system messages only)"},
+		"OLLAMA_SKIP_MARKER":       {"OLLAMA_SKIP_MARKER", SkipMarker(), "Message inserted in place of truncated chat history (e.g. \"[{turns} turns, ~{tokens} tokens removed]\")"},
+		"OLLAMA_DUPLICATE_IMAGES":  {"OLLAMA_DUPLICATE_IMAGES", DuplicateImages(), "Handling of images attached to several chat messages (dedupe)"},
+		"OLLAMA_UNKNOWN_ROLES":     {"OLLAMA_UNKNOWN_ROLES", UnknownRoles(), "Handling of chat messages with roles the template does not render (error)"},
+		"OLLAMA_MIXED_INPUT":       {"OLLAMA_MIXED_INPUT", MixedInput(), "Handling of requests setting both messages and prompt (error)"},
+		"OLLAMA_EMPTY_CHAT":        {"OLLAMA_EMPTY_CHAT", EmptyChat(), "Handling of internally rendered chat prompts with no messages (error, render)"},
+		"OLLAMA_SYSTEM_ONLY":       {"OLLAMA_SYSTEM_ONLY", SystemOnly(), "Handling of chat prompts with only system messages (error)"},
+		"OLLAMA_EMPTY_PROMPT":      {"OLLAMA_EMPTY_PROMPT", EmptyPrompt(), "Handling of templates rendering an empty prompt from messages (allow)"},
+		"OLLAMA_CREATE_CONFLICT":   {"OLLAMA_CREATE_CONFLICT", CreateConflict(), "Handling of requests to run a model being created or pulled (error)"},
+		"OLLAMA_NO_VISION_IMAGES":  {"OLLAMA_NO_VISION_IMAGES", NoVisionImages(), "Handling of images sent to models without vision (error, drop)"},
+		"OLLAMA_CTX_VRAM_CAP":      {"OLLAMA_CTX_VRAM_CAP", ContextVRAMCap(), "Cap dynamically sized context lengths to fit the KV cache in free VRAM"},
+		"OLLAMA_RELOAD_POLICY":     {"OLLAMA_RELOAD_POLICY", ReloadPolicy(), "Handling of requests needing a busy model reloaded with other options (second_runner, serialize)"},
+		"OLLAMA_CACHE_HIT_EVAL":    {"OLLAMA_CACHE_HIT_EVAL", CacheHitEval(), "Prompt eval count reported when the whole prompt was cached (cached)"},
+		"OLLAMA_INVALID_TOOLS":     {"OLLAMA_INVALID_TOOLS", InvalidTools(), "Handling of tools whose parameters can't be serialized (drop)"},
+		"OLLAMA_TOOL_CTX_PERCENT":  {"OLLAMA_TOOL_CTX_PERCENT", ToolContextPercent(), "Maximum percent of the context length tools may use (default: 0, unlimited)"},
+		"OLLAMA_TOOL_CALL_CONTENT": {"OLLAMA_TOOL_CALL_CONTENT", ToolCallContent(), "Handling of tool calls for templates which don't render them (json)"},
+		"OLLAMA_TOOL_STREAMING":    {"OLLAMA_TOOL_STREAMING", ToolStreaming(), "Handling of streamed tool calls for templates without a tool call prefix (buffer, error)"},
+		"OLLAMA_TOOL_ORPHANS":      {"OLLAMA_TOOL_ORPHANS", ToolOrphans(), "Handling of tool results whose tool call was truncated (drop, keep)"},
+		"OLLAMA_NORMALIZE_CONTENT": {"OLLAMA_NORMALIZE_CONTENT", NormalizeContent(), "Normalize whitespace and line endings of chat messages"},
+		"OLLAMA_TOOLS_IN_SYSTEM":   {"OLLAMA_TOOLS_IN_SYSTEM", ToolsInSystem(), "Render tools into a system message for models without tool support"},
+		"OLLAMA_SUMMARIZE_DROPPED": {"OLLAMA_SUMMARIZE_DROPPED", SummarizeDropped(), "Summarize messages dropped from truncated chat history with the model"},
+		"OLLAMA_SYSTEM_OVERFLOW":   {"OLLAMA_SYSTEM_OVERFLOW", SystemOverflow(), "Handling of system messages exceeding the context length (error, truncate)"},
+		"OLLAMA_PREDICT_OVERFLOW":  {"OLLAMA_PREDICT_OVERFLOW", PredictOverflow(), "Handling of num_predict exceeding the model's context length (error)"},
 
 		// Informational
 		"HTTP_PROXY":  {"HTTP_PROXY", String("HTTP_PROXY")(), "HTTP proxy"},
@@ -259,6 +259,30 @@ func TestLoadTimeout(t *testing.T) {
 	}
 }
 
+func TestStallTimeout(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":    0,
+		"1s":  time.Second,
+		"1m":  time.Minute,
+		"0":   0,
+		"30":  30 * time.Second,
+		"-1":  0,
+		"-1m": 0,
+		// invalid values
+		"???": 0,
+		"1d":  0,
+	}
+
+	for tt, expect := range cases {
+		t.Run(tt, func(t *testing.T) {
+			t.Setenv("OLLAMA_STALL_TIMEOUT", tt)
+			if actual := StallTimeout(); actual != expect {
+				t.Errorf("%s: expected %s, got %s", tt, expect, actual)
+			}
+		})
+	}
+}
+
 func TestVar(t *testing.T) {
 	cases := map[string]string{
 		"value":       "value",
@@ -87,7 +87,9 @@ type ContextParams struct {
 	c C.struct_llama_context_params
 }
 
-func NewContextParams(numCtx int, batchSize int, numSeqMax int, threads int, flashAttention bool, kvCacheType string) ContextParams {
+// NewContextParams returns the parameters of a context. A ropeFreqScale of 0
+// uses the model's RoPE frequency scale
+func NewContextParams(numCtx int, batchSize int, numSeqMax int, threads int, flashAttention bool, kvCacheType string, ropeFreqScale float32) ContextParams {
 	params := C.llama_context_default_params()
 	params.n_ctx = C.uint(numCtx)
 	params.n_batch = C.uint(batchSize)
@@ -98,6 +100,7 @@ func NewContextParams(numCtx int, batchSize int, numSeqMax int, threads int, fla
 	params.flash_attn = C.bool(flashAttention)
 	params.type_k = kvCacheTypeFromStr(strings.ToLower(kvCacheType))
 	params.type_v = kvCacheTypeFromStr(strings.ToLower(kvCacheType))
+	params.rope_freq_scale = C.float(ropeFreqScale)
 
 	return ContextParams{c: params}
 }
@@ -133,7 +133,7 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 	if envconfig.FlashAttention() &&
 		discover.GetGPUInfo().FlashAttentionSupported() &&
 		f.SupportsFlashAttention() {
-		requested := strings.ToLower(envconfig.KvCacheType())
+		requested := kvCacheType(opts)
 		if requested != "" && f.SupportsKVCacheType(requested) {
 			kvct = requested
 		}
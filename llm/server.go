@@ -74,6 +74,10 @@ type LlamaServer interface {
 	EstimatedTotal() uint64
 	EstimatedVRAMByGPU(gpuID string) uint64
 	Pid() int
+
+	// LoadStages returns the time the runner spent loading the model's
+	// weights and allocating its cache, once it's running
+	LoadStages() (weights, cache time.Duration)
 }
 
 // llmServer is an instance of the llama.cpp server
@@ -100,6 +104,8 @@ type llmServer struct {
 	// gpuCount     int
 	gpus         discover.GpuInfoList // Recorded just before the model loaded, free space will be incorrect
 	loadDuration time.Duration        // Record how long it took the model to load
+	loadWeights  time.Duration        // Reported by the runner once it's ready
+	loadCache    time.Duration
 	loadProgress float32
 
 	sem *semaphore.Weighted
@@ -125,6 +131,28 @@ func LoadModel(model string, maxArraySize int) (*ggml.GGML, error) {
 	return ggml, err
 }
 
+// kvCacheType returns the KV cache type requested by opts, falling back to
+// OLLAMA_KV_CACHE_TYPE
+func kvCacheType(opts api.Options) string {
+	if opts.KVCacheType != "" {
+		return strings.ToLower(opts.KVCacheType)
+	}
+
+	return strings.ToLower(envconfig.KvCacheType())
+}
+
+// ropeFreqScale returns the RoPE frequency scale which linearly interpolates
+// the positions of a context of numCtx tokens into the model's maximum
+// context length, or 0 when numCtx doesn't exceed it
+func ropeFreqScale(kv ggml.KV, numCtx int) float32 {
+	trained := int(kv.ContextLength())
+	if trained == 0 || numCtx <= trained {
+		return 0
+	}
+
+	return kv.Float("rope.freq_scale", 1) * float32(trained) / float32(numCtx)
+}
+
 // NewLlamaServer will run a server for the given GPUs
 // The gpu list must be a single family.
 func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, adapters, projectors []string, opts api.Options, numParallel int) (LlamaServer, error) {
@@ -205,7 +233,7 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		fa = false
 	}
 
-	kvct := strings.ToLower(envconfig.KvCacheType())
+	kvct := kvCacheType(opts)
 
 	if fa {
 		slog.Info("enabling flash attention")
@@ -246,6 +274,11 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 
 	params = append(params, "--parallel", strconv.Itoa(numParallel))
 
+	if scale := ropeFreqScale(f.KV(), opts.NumCtx/max(numParallel, 1)); scale > 0 {
+		slog.Info("scaling RoPE past the model's maximum context length", "num_ctx", opts.NumCtx/max(numParallel, 1), "max", f.KV().ContextLength(), "rope_freq_scale", scale)
+		params = append(params, "--rope-freq-scale", strconv.FormatFloat(float64(scale), 'g', -1, 32))
+	}
+
 	if estimate.TensorSplit != "" {
 		params = append(params, "--tensor-split", estimate.TensorSplit)
 	}
@@ -496,6 +529,11 @@ func (s ServerStatus) String() string {
 type ServerStatusResponse struct {
 	Status   ServerStatus `json:"status"`
 	Progress float32      `json:"progress"`
+
+	// LoadWeights and LoadCache are the time spent loading the model's
+	// weights and allocating the cache, once the runner is ready
+	LoadWeights time.Duration `json:"load_weights,omitempty"`
+	LoadCache   time.Duration `json:"load_cache,omitempty"`
 }
 
 func (s *llmServer) getServerStatus(ctx context.Context) (ServerStatus, error) {
@@ -545,6 +583,7 @@ func (s *llmServer) getServerStatus(ctx context.Context) (ServerStatus, error) {
 		s.loadProgress = ssr.Progress
 		return ssr.Status, nil
 	case ServerStatusReady, ServerStatusNoSlotsAvailable:
+		s.loadWeights, s.loadCache = ssr.LoadWeights, ssr.LoadCache
 		return ssr.Status, nil
 	default:
 		return ssr.Status, fmt.Errorf("server error: %+v", ssr)
@@ -646,6 +685,10 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 	}
 }
 
+func (s *llmServer) LoadStages() (weights, cache time.Duration) {
+	return s.loadWeights, s.loadCache
+}
+
 func (s *llmServer) Pid() int {
 	if s.cmd != nil && s.cmd.Process != nil {
 		return s.cmd.Process.Pid
@@ -721,8 +764,12 @@ type CompletionResponse struct {
 	Done               bool          `json:"done"`
 	PromptEvalCount    int           `json:"prompt_eval_count"`
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration"`
+	PromptCacheCount   int           `json:"prompt_cache_count"`
 	EvalCount          int           `json:"eval_count"`
 	EvalDuration       time.Duration `json:"eval_duration"`
+	// PeakVRAM is the most GPU memory allocated by the runner while serving
+	// the request, if the runner reports it
+	PeakVRAM uint64 `json:"peak_vram,omitempty"`
 }
 
 func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
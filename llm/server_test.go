@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/fs/ggml"
 	"golang.org/x/sync/semaphore"
 )
 
@@ -70,3 +71,25 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 	}, nil)
 	checkValid(err)
 }
+
+func TestRopeFreqScale(t *testing.T) {
+	cases := []struct {
+		name   string
+		kv     ggml.KV
+		numCtx int
+		want   float32
+	}{
+		{"within max", ggml.KV{"general.architecture": "llama", "llama.context_length": uint32(4096)}, 4096, 0},
+		{"no max", ggml.KV{"general.architecture": "llama"}, 8192, 0},
+		{"past max", ggml.KV{"general.architecture": "llama", "llama.context_length": uint32(4096)}, 16384, 0.25},
+		{"past scaled max", ggml.KV{"general.architecture": "llama", "llama.context_length": uint32(4096), "llama.rope.freq_scale": float32(0.5)}, 8192, 0.25},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ropeFreqScale(tt.kv, tt.numCtx); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -71,6 +71,9 @@ type BackendParams struct {
 
 	// FlashAttention indicates that we should use a fused flash attention kernel
 	FlashAttention bool
+
+	// RopeFreqScale overrides the model's RoPE frequency scale if it's not 0
+	RopeFreqScale float32
 }
 
 // ErrNoMem is returned when panicing due to insufficient memory. It includes
@@ -138,6 +141,18 @@ type DeviceMemory struct {
 	Graph Memory
 }
 
+// Allocated is the total size of the successful allocations on the device.
+func (m DeviceMemory) Allocated() uint64 {
+	var size uint64
+	for _, mem := range slices.Concat(m.Weights, m.Cache, []Memory{m.Graph}) {
+		if mem.Status == Allocated {
+			size += mem.Size
+		}
+	}
+
+	return size
+}
+
 func memoryPresent(mem []Memory) bool {
 	return slices.ContainsFunc(mem, func(m Memory) bool { return m.Size != 0 })
 }
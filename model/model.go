@@ -110,7 +110,12 @@ func New(modelPath string, params ml.BackendParams) (Model, error) {
 		return nil, fmt.Errorf("unsupported model architecture %q", arch)
 	}
 
-	m, err := f(b.Config())
+	var c fs.Config = b.Config()
+	if params.RopeFreqScale != 0 {
+		c = ropeScaledConfig{Config: c, scale: params.RopeFreqScale}
+	}
+
+	m, err := f(c)
 	if err != nil {
 		return nil, err
 	}
@@ -122,6 +127,20 @@ func New(modelPath string, params ml.BackendParams) (Model, error) {
 	return m, nil
 }
 
+// ropeScaledConfig overrides the RoPE frequency scale of a model's config
+type ropeScaledConfig struct {
+	fs.Config
+	scale float32
+}
+
+func (c ropeScaledConfig) Float(key string, defaultValue ...float32) float32 {
+	if key == "rope.freq_scale" {
+		return c.scale
+	}
+
+	return c.Config.Float(key, defaultValue...)
+}
+
 func NewTextProcessor(s string) (TextProcessor, error) {
 	r, err := os.Open(s)
 	if err != nil {
@@ -175,3 +175,22 @@ func (notTextProcessorModel) Backend() ml.Backend {
 func (notTextProcessorModel) Config() config {
 	panic("unimplemented")
 }
+
+func TestRopeScaledConfig(t *testing.T) {
+	c := ropeScaledConfig{
+		Config: fsggml.KV{
+			"general.architecture":  "llama",
+			"llama.rope.freq_base":  float32(10000),
+			"llama.rope.freq_scale": float32(1),
+		},
+		scale: 0.25,
+	}
+
+	if got := c.Float("rope.freq_scale", 1); got != 0.25 {
+		t.Errorf("expected rope.freq_scale 0.25, got %v", got)
+	}
+
+	if got := c.Float("rope.freq_base"); got != 10000 {
+		t.Errorf("expected rope.freq_base 10000, got %v", got)
+	}
+}
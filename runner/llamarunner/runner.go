@@ -87,6 +87,7 @@ type Sequence struct {
 	startGenerationTime time.Time
 	numDecoded          int
 	numPromptInputs     int
+	numCachedInputs     int
 }
 
 type NewSequenceParams struct {
@@ -95,6 +96,7 @@ type NewSequenceParams struct {
 	numKeep        int
 	samplingParams *llama.SamplingParams
 	embedding      bool
+	skipBOS        bool
 }
 
 func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSequenceParams) (*Sequence, error) {
@@ -102,7 +104,7 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 
 	startTime := time.Now()
 
-	inputs, err := s.inputs(prompt, images)
+	inputs, err := s.inputs(prompt, images, !params.skipBOS)
 	if err != nil {
 		return nil, fmt.Errorf("failed to process inputs: %w", err)
 	} else if len(inputs) == 0 {
@@ -113,7 +115,7 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		params.numKeep = len(inputs)
 	}
 
-	if s.model.AddBOSToken() {
+	if !params.skipBOS && s.model.AddBOSToken() {
 		params.numKeep += 1
 	}
 
@@ -160,8 +162,9 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 
 // inputs processes the prompt and images into a list of inputs
 // by splitting the prompt on [img-<n>] tags, tokenizing text and
-// generating image embeddings for each image
-func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input, error) {
+// generating image embeddings for each image. Special tokens such as BOS
+// are only added when addSpecial is set
+func (s *Server) inputs(prompt string, images []llm.ImageData, addSpecial bool) ([]input, error) {
 	var inputs []input
 	var parts []string
 	var matches [][]string
@@ -176,7 +179,7 @@ func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input, error)
 
 	for i, part := range parts {
 		// text - tokenize
-		tokens, err := s.lc.Model().Tokenize(part, i == 0, true)
+		tokens, err := s.lc.Model().Tokenize(part, addSpecial && i == 0, true)
 		if err != nil {
 			return nil, err
 		}
@@ -232,6 +235,9 @@ type Server struct {
 	// current progress on loading the model
 	progress float32
 
+	// time spent loading the model's weights and allocating the cache
+	loadWeights, loadCache time.Duration
+
 	// number of simultaneous requests to handle
 	parallel int
 
@@ -578,6 +584,7 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		numKeep:        req.Options.NumKeep,
 		samplingParams: &samplingParams,
 		embedding:      false,
+		skipBOS:        req.Options.AddBOS != nil && !*req.Options.AddBOS,
 	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
@@ -598,13 +605,14 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	found := false
 	for i, sq := range s.seqs {
 		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, true)
+			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, !req.Options.NoCache)
 			if err != nil {
 				s.mu.Unlock()
 				s.seqsSem.Release(1)
 				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
 				return
 			}
+			seq.numCachedInputs = len(seq.cache.Inputs)
 
 			s.seqs[i] = seq
 			s.cond.Signal()
@@ -642,6 +650,7 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 					DoneReason:         seq.doneReason,
 					PromptEvalCount:    seq.numPromptInputs,
 					PromptEvalDuration: seq.startGenerationTime.Sub(seq.startProcessingTime),
+					PromptCacheCount:   seq.numCachedInputs,
 					EvalCount:          seq.numDecoded,
 					EvalDuration:       time.Since(seq.startGenerationTime),
 				}); err != nil {
@@ -716,8 +725,10 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(&llm.ServerStatusResponse{
-		Status:   s.status,
-		Progress: s.progress,
+		Status:      s.status,
+		Progress:    s.progress,
+		LoadWeights: s.loadWeights,
+		LoadCache:   s.loadCache,
 	}); err != nil {
 		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 	}
@@ -744,18 +755,23 @@ func (s *Server) loadModel(
 	flashAttention bool,
 	threads int,
 	multiUserCache bool,
+	ropeFreqScale float32,
 ) {
 	var err error
+	start := time.Now()
 	s.model, err = llama.LoadModelFromFile(mpath, params)
 	if err != nil {
 		panic(err)
 	}
+	s.loadWeights = time.Since(start)
 
-	ctxParams := llama.NewContextParams(kvSize, s.batchSize*s.parallel, s.parallel, threads, flashAttention, kvCacheType)
+	start = time.Now()
+	ctxParams := llama.NewContextParams(kvSize, s.batchSize*s.parallel, s.parallel, threads, flashAttention, kvCacheType, ropeFreqScale)
 	s.lc, err = llama.NewContextWithModel(s.model, ctxParams)
 	if err != nil {
 		panic(err)
 	}
+	s.loadCache = time.Since(start)
 
 	if lpath.String() != "" {
 		for _, path := range lpath {
@@ -800,6 +816,7 @@ func Execute(args []string) error {
 	noMmap := fs.Bool("no-mmap", false, "do not memory-map model (slower load but may reduce pageouts if not using mlock)")
 	tensorSplit := fs.String("tensor-split", "", "fraction of the model to offload to each GPU, comma-separated list of proportions")
 	multiUserCache := fs.Bool("multiuser-cache", false, "optimize input cache algorithm for multiple users")
+	ropeFreqScale := fs.Float64("rope-freq-scale", 0, "RoPE frequency scaling factor (default: from model)")
 
 	var lpaths multiLPath
 	fs.Var(&lpaths, "lora", "Path to lora layer file (can be specified multiple times)")
@@ -845,7 +862,7 @@ func Execute(args []string) error {
 	}
 
 	server.ready.Add(1)
-	go server.loadModel(params, *mpath, lpaths, *ppath, *kvSize, *kvCacheType, *flashAttention, *threads, *multiUserCache)
+	go server.loadModel(params, *mpath, lpaths, *ppath, *kvSize, *kvCacheType, *flashAttention, *threads, *multiUserCache, float32(*ropeFreqScale))
 
 	server.cond = sync.NewCond(&server.mu)
 
@@ -7,6 +7,7 @@ import (
 	"math"
 	"time"
 
+	"github.com/ollama/ollama/fs"
 	"github.com/ollama/ollama/kvcache"
 	"github.com/ollama/ollama/ml"
 	"github.com/ollama/ollama/model"
@@ -31,6 +32,67 @@ type InputCache struct {
 	cache kvcache.Cache
 }
 
+// KVCacheConfig describes the KV cache allocated for a model
+type KVCacheConfig struct {
+	// Type is the data type of cache entries
+	Type string
+
+	// Size is the number of tokens the cache holds across all sequences
+	Size int32
+
+	// NumCtx is the number of tokens each sequence can hold
+	NumCtx int32
+
+	// NumSeqs is the number of sequences processed in parallel
+	NumSeqs int
+
+	// Bytes is the estimated size of the cache, from the model's dimensions
+	Bytes uint64
+}
+
+func (c KVCacheConfig) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("type", c.Type),
+		slog.Int("size", int(c.Size)),
+		slog.Int("num_ctx", int(c.NumCtx)),
+		slog.Int("num_seqs", c.NumSeqs),
+		slog.Uint64("bytes", c.Bytes),
+	)
+}
+
+// newKVCacheConfig resolves the configuration of a cache of kvSize tokens
+// shared by numSlots sequences for a model with config c
+func newKVCacheConfig(c fs.Config, kvCacheType string, kvSize int32, numSlots int) KVCacheConfig {
+	dtype := kvCacheTypeFromStr(kvCacheType)
+
+	var bytesPerElement float64
+	switch dtype {
+	case ml.DTypeQ80:
+		kvCacheType, bytesPerElement = "q8_0", 1
+	case ml.DTypeQ40:
+		kvCacheType, bytesPerElement = "q4_0", 0.5
+	default:
+		kvCacheType, bytesPerElement = "f16", 2
+	}
+
+	var headDim uint32
+	if heads := c.Uint("attention.head_count"); heads > 0 {
+		headDim = c.Uint("embedding_length") / heads
+	}
+	headDimK := c.Uint("attention.key_length", headDim)
+	headDimV := c.Uint("attention.value_length", headDim)
+	headsKV := c.Uint("attention.head_count_kv", 1)
+
+	elements := uint64(c.Uint("block_count")) * uint64(kvSize) * uint64(headDimK+headDimV) * uint64(headsKV)
+	return KVCacheConfig{
+		Type:    kvCacheType,
+		Size:    kvSize,
+		NumCtx:  kvSize / int32(max(numSlots, 1)),
+		NumSeqs: numSlots,
+		Bytes:   uint64(float64(elements) * bytesPerElement),
+	}
+}
+
 func NewInputCache(model model.Model, kvCacheType string, kvSize int32, numSlots int, batchSize int, multiUserCache bool) (*InputCache, error) {
 	numCtx := kvSize / int32(numSlots)
 
@@ -44,9 +106,12 @@ func NewInputCache(model model.Model, kvCacheType string, kvSize int32, numSlots
 		slots[i] = InputCacheSlot{Id: i}
 	}
 
+	config := newKVCacheConfig(model.Backend().Config(), kvCacheType, kvSize, numSlots)
+
 	cache := model.Config().Cache
 	if cache != nil {
 		cache.Init(model.Backend(), kvCacheTypeFromStr(kvCacheType), numSlots, int(numCtx), batchSize)
+		slog.Info("kv cache", "config", config)
 	}
 
 	return &InputCache{
@@ -91,7 +156,7 @@ type InputCacheSlot struct {
 	lastUsed time.Time
 }
 
-func (c *InputCache) LoadCacheSlot(prompt []input.Input) (*InputCacheSlot, []input.Input, error) {
+func (c *InputCache) LoadCacheSlot(prompt []input.Input, cachePrompt bool) (*InputCacheSlot, []input.Input, error) {
 	var slot *InputCacheSlot
 	var numPast int32
 	var err error
@@ -109,6 +174,10 @@ func (c *InputCache) LoadCacheSlot(prompt []input.Input) (*InputCacheSlot, []inp
 		return nil, nil, err
 	}
 
+	if !cachePrompt {
+		numPast = 0
+	}
+
 	slot.InUse = true
 	slot.lastUsed = time.Now()
 
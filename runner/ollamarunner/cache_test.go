@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ollama/ollama/fs/ggml"
 	"github.com/ollama/ollama/ml"
 	"github.com/ollama/ollama/model/input"
 )
@@ -301,6 +302,7 @@ func TestLoadCacheSlot(t *testing.T) {
 		name           string
 		cache          InputCache
 		prompt         []input.Input
+		noCache        bool
 		wantErr        bool
 		expectedSlotId int
 		expectedPrompt int // expected length of remaining prompt
@@ -353,6 +355,25 @@ func TestLoadCacheSlot(t *testing.T) {
 			expectedSlotId: 0,
 			expectedPrompt: 1, // Only token 3 remains
 		},
+		{
+			name: "Cache hit with no cache",
+			cache: InputCache{
+				multiUserCache: false,
+				slots: []InputCacheSlot{
+					{
+						Id:       0,
+						Inputs:   []input.Input{{Token: 1}, {Token: 2}},
+						InUse:    false,
+						lastUsed: time.Now().Add(-time.Second),
+					},
+				},
+			},
+			prompt:         []input.Input{{Token: 1}, {Token: 2}, {Token: 3}},
+			noCache:        true,
+			wantErr:        false,
+			expectedSlotId: 0,
+			expectedPrompt: 3, // Whole prompt is evaluated
+		},
 		{
 			name: "Exact match - leave one input",
 			cache: InputCache{
@@ -393,7 +414,7 @@ func TestLoadCacheSlot(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			slot, remainingPrompt, err := tt.cache.LoadCacheSlot(tt.prompt)
+			slot, remainingPrompt, err := tt.cache.LoadCacheSlot(tt.prompt, !tt.noCache)
 
 			// Check error state
 			if (err != nil) != tt.wantErr {
@@ -420,6 +441,12 @@ func TestLoadCacheSlot(t *testing.T) {
 				t.Errorf("LoadCacheSlot() remaining prompt length = %v, expected %v",
 					len(remainingPrompt), tt.expectedPrompt)
 			}
+
+			// Verify cached inputs are reported for the reused prefix only
+			if len(slot.Inputs) != len(tt.prompt)-tt.expectedPrompt {
+				t.Errorf("LoadCacheSlot() cached inputs = %v, expected %v",
+					len(slot.Inputs), len(tt.prompt)-tt.expectedPrompt)
+			}
 		})
 	}
 }
@@ -512,3 +539,44 @@ func TestShiftCacheSlot(t *testing.T) {
 		})
 	}
 }
+
+func TestNewKVCacheConfig(t *testing.T) {
+	kv := ggml.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(32),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+	}
+
+	tests := []struct {
+		name        string
+		kvCacheType string
+		expected    KVCacheConfig
+	}{
+		{
+			name:     "default",
+			expected: KVCacheConfig{Type: "f16", Size: 8192, NumCtx: 4096, NumSeqs: 2, Bytes: 1 << 30},
+		},
+		{
+			name:        "q8_0",
+			kvCacheType: "q8_0",
+			expected:    KVCacheConfig{Type: "q8_0", Size: 8192, NumCtx: 4096, NumSeqs: 2, Bytes: 1 << 29},
+		},
+		{
+			name:        "q4_0",
+			kvCacheType: "q4_0",
+			expected:    KVCacheConfig{Type: "q4_0", Size: 8192, NumCtx: 4096, NumSeqs: 2, Bytes: 1 << 28},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 32 layers of 8 KV heads of 128 dimensions for each of K and V
+			result := newKVCacheConfig(kv, tt.kvCacheType, 8192, 2)
+			if result != tt.expected {
+				t.Errorf("newKVCacheConfig: have %+v; want %+v", result, tt.expected)
+			}
+		})
+	}
+}
@@ -92,6 +92,8 @@ type Sequence struct {
 	startGenerationTime time.Time
 	numPredicted        int
 	numPromptInputs     int
+	numCachedInputs     int
+	peakVRAM            uint64
 }
 
 type NewSequenceParams struct {
@@ -100,6 +102,7 @@ type NewSequenceParams struct {
 	numKeep    int32
 	sampler    sample.Sampler
 	embedding  bool
+	skipBOS    bool
 }
 
 func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSequenceParams) (*Sequence, error) {
@@ -107,7 +110,7 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 
 	startTime := time.Now()
 
-	inputs, ctxs, mmStore, err := s.inputs(prompt, images)
+	inputs, ctxs, mmStore, err := s.inputs(prompt, images, !params.skipBOS)
 	if err != nil {
 		return nil, fmt.Errorf("failed to process inputs: %w", err)
 	} else if len(inputs) == 0 {
@@ -180,8 +183,9 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 
 // inputs processes the prompt and images into a list of inputs
 // by splitting the prompt on [img-<n>] tags, tokenizing text and
-// decoding images
-func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input.Input, []ml.Context, multimodalStore, error) {
+// decoding images. Special tokens such as BOS are only added when
+// addSpecial is set
+func (s *Server) inputs(prompt string, images []llm.ImageData, addSpecial bool) ([]input.Input, []ml.Context, multimodalStore, error) {
 	var inputs []input.Input
 	var ctxs []ml.Context
 	var mmStore multimodalStore
@@ -203,7 +207,7 @@ func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input.Input, [
 	postTokenize := false
 	for i, part := range parts {
 		// text - tokenize
-		tokens, err := s.model.(model.TextProcessor).Encode(part, i == 0)
+		tokens, err := s.model.(model.TextProcessor).Encode(part, addSpecial && i == 0)
 		if err != nil {
 			return nil, nil, nil, err
 		}
@@ -272,6 +276,9 @@ type Server struct {
 	// current progress on loading the model
 	progress float32
 
+	// time spent loading the model's weights and allocating the cache
+	loadWeights, loadCache time.Duration
+
 	// number of simultaneous requests to handle
 	parallel int
 
@@ -484,11 +491,19 @@ func (s *Server) processBatch() error {
 
 	logits := modelOutput.Floats()
 
+	// the cache grows as it's used, so sample GPU memory after each batch
+	var vram uint64
+	for _, gpu := range s.model.Backend().BackendMemory().GPUs {
+		vram += gpu.Allocated()
+	}
+
 	for i, seq := range s.seqs {
 		if seq == nil {
 			continue
 		}
 
+		seq.peakVRAM = max(seq.peakVRAM, vram)
+
 		// After calling Forward, pending inputs are now in the cache
 		if len(seq.pendingInputs) > 0 {
 			seq.cache.Inputs = append(seq.cache.Inputs, seq.pendingInputs...)
@@ -634,6 +649,7 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		numKeep:    int32(req.Options.NumKeep),
 		sampler:    sampler,
 		embedding:  false,
+		skipBOS:    req.Options.AddBOS != nil && !*req.Options.AddBOS,
 	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
@@ -654,13 +670,14 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	found := false
 	for i, sq := range s.seqs {
 		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs)
+			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, !req.Options.NoCache)
 			if err != nil {
 				s.mu.Unlock()
 				s.seqsSem.Release(1)
 				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
 				return
 			}
+			seq.numCachedInputs = len(seq.cache.Inputs)
 
 			s.seqs[i] = seq
 			s.cond.Signal()
@@ -698,8 +715,10 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 					DoneReason:         seq.doneReason,
 					PromptEvalCount:    seq.numPromptInputs,
 					PromptEvalDuration: seq.startGenerationTime.Sub(seq.startProcessingTime),
+					PromptCacheCount:   seq.numCachedInputs,
 					EvalCount:          seq.numPredicted,
 					EvalDuration:       time.Since(seq.startGenerationTime),
+					PeakVRAM:           seq.peakVRAM,
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
 				}
@@ -713,8 +732,10 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(&llm.ServerStatusResponse{
-		Status:   s.status,
-		Progress: s.progress,
+		Status:      s.status,
+		Progress:    s.progress,
+		LoadWeights: s.loadWeights,
+		LoadCache:   s.loadCache,
 	}); err != nil {
 		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 	}
@@ -848,6 +869,9 @@ func (s *Server) initModel(
 		return errors.New("loras are not yet implemented")
 	}
 
+	start := time.Now()
+	defer func() { s.loadCache = time.Since(start) }()
+
 	s.cache, err = NewInputCache(s.model, kvCacheType, int32(kvSize), parallel, s.batchSize, multiUserCache)
 	if err != nil {
 		return err
@@ -882,6 +906,7 @@ func (s *Server) load(
 
 	slog.Debug("memory", "allocated", s.model.Backend().BackendMemory())
 
+	start := time.Now()
 	err = s.model.Backend().Load(ctx,
 		func(progress float32) {
 			s.progress = progress
@@ -889,6 +914,7 @@ func (s *Server) load(
 	if err != nil {
 		panic(err)
 	}
+	s.loadWeights = time.Since(start)
 
 	s.status = llm.ServerStatusReady
 	s.ready.Done()
@@ -910,6 +936,7 @@ func Execute(args []string) error {
 	_ = fs.Bool("no-mmap", false, "do not memory-map model (slower load but may reduce pageouts if not using mlock)")
 	tensorSplit := fs.String("tensor-split", "", "fraction of the model to offload to each GPU, comma-separated list of proportions")
 	multiUserCache := fs.Bool("multiuser-cache", false, "optimize input cache algorithm for multiple users")
+	ropeFreqScale := fs.Float64("rope-freq-scale", 0, "RoPE frequency scaling factor (default: from model)")
 
 	var lpaths multiLPath
 	fs.Var(&lpaths, "lora", "Path to lora layer file (can be specified multiple times)")
@@ -954,6 +981,7 @@ func Execute(args []string) error {
 		MainGPU:        *mainGPU,
 		TensorSplit:    tensorSplitFloats,
 		FlashAttention: *flashAttention,
+		RopeFreqScale:  float32(*ropeFreqScale),
 	}
 
 	go server.load(ctx, *mpath, params, lpaths, *parallel, *kvCacheType, *kvSize, *multiUserCache)
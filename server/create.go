@@ -15,6 +15,7 @@ import (
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 
 	"github.com/gin-gonic/gin"
@@ -36,8 +37,81 @@ var (
 	errUnknownType             = errors.New("unknown type")
 	errNeitherFromOrFiles      = errors.New("neither 'from' or 'files' was specified")
 	errFilePath                = errors.New("file path must be relative")
+	errModelWriting            = errors.New("model is being created or pulled")
 )
 
+// modelWrites tracks models being created or pulled so requests to run them
+// can wait until they're written
+type modelWrites struct {
+	mu sync.Mutex
+	// writes maps model names to the writes in progress
+	writes map[string]*modelWrite
+}
+
+type modelWrite struct {
+	n    int
+	done chan struct{}
+}
+
+func writeKey(name string) string {
+	return strings.ToLower(model.ParseName(name).String())
+}
+
+// begin records that the named model is being written. The returned function
+// must be called once the write finishes
+func (w *modelWrites) begin(name string) func() {
+	key := writeKey(name)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.writes == nil {
+		w.writes = make(map[string]*modelWrite)
+	}
+
+	write, ok := w.writes[key]
+	if !ok {
+		write = &modelWrite{done: make(chan struct{})}
+		w.writes[key] = write
+	}
+	write.n++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			write.n--
+			if write.n == 0 {
+				close(write.done)
+				delete(w.writes, key)
+			}
+		})
+	}
+}
+
+// wait blocks until no writes of the named model are in progress, or returns
+// errModelWriting if OLLAMA_CREATE_CONFLICT is "error"
+func (w *modelWrites) wait(ctx context.Context, name string) error {
+	w.mu.Lock()
+	write, ok := w.writes[writeKey(name)]
+	w.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if envconfig.CreateConflict() == "error" {
+		return fmt.Errorf("%s: %w", name, errModelWriting)
+	}
+
+	slog.Debug("waiting for model to be written", "model", name)
+	select {
+	case <-write.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (s *Server) CreateHandler(c *gin.Context) {
 	var r api.CreateRequest
 	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
@@ -67,9 +141,11 @@ func (s *Server) CreateHandler(c *gin.Context) {
 		return
 	}
 
+	written := s.writes.begin(name.String())
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
+		defer written()
 		fn := func(resp api.ProgressResponse) {
 			ch <- resp
 		}
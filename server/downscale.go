@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+// downscaleImages replaces images whose width or height exceeds
+// OLLAMA_MAX_IMAGE_SIZE with smaller copies which preserve the aspect ratio
+func downscaleImages(images []api.ImageData) error {
+	maxSize := int(envconfig.MaxImageSize())
+	if maxSize <= 0 {
+		return nil
+	}
+
+	for i := range images {
+		data, err := downscaleImage(images[i], maxSize)
+		if err != nil {
+			return err
+		}
+
+		images[i] = data
+	}
+
+	return nil
+}
+
+func downscaleImage(data []byte, maxSize int) ([]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image: %w", err)
+	}
+
+	if config.Width <= maxSize && config.Height <= maxSize {
+		return data, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image: %w", err)
+	}
+
+	scale := float64(maxSize) / float64(max(config.Width, config.Height))
+	width := max(int(float64(config.Width)*scale), 1)
+	height := max(int(float64(config.Height)*scale), 1)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Over, nil)
+
+	var b bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&b, dst, nil)
+	} else {
+		err = png.Encode(&b, dst)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
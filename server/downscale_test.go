@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestDownscaleImages(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	img := image.NewRGBA(image.Rect(0, 0, 512, 256))
+	for y := range 256 {
+		for x := range 512 {
+			img.Set(x, y, color.RGBA{uint8(r.IntN(256)), uint8(r.IntN(256)), uint8(r.IntN(256)), 255})
+		}
+	}
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	original := b.Bytes()
+
+	t.Run("disabled", func(t *testing.T) {
+		images := []api.ImageData{original}
+		if err := downscaleImages(images); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(images[0], original) {
+			t.Error("expected image to be unchanged")
+		}
+	})
+
+	t.Run("oversized", func(t *testing.T) {
+		t.Setenv("OLLAMA_MAX_IMAGE_SIZE", "64")
+
+		images := []api.ImageData{original}
+		if err := downscaleImages(images); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(images[0]) >= len(original) {
+			t.Errorf("expected image smaller than %d bytes, got %d", len(original), len(images[0]))
+		}
+
+		config, format, err := image.DecodeConfig(bytes.NewReader(images[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if format != "png" || config.Width != 64 || config.Height != 32 {
+			t.Errorf("expected 64x32 png, got %dx%d %s", config.Width, config.Height, format)
+		}
+	})
+
+	t.Run("within limit", func(t *testing.T) {
+		t.Setenv("OLLAMA_MAX_IMAGE_SIZE", "512")
+
+		images := []api.ImageData{original}
+		if err := downscaleImages(images); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(images[0], original) {
+			t.Error("expected image to be unchanged")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Setenv("OLLAMA_MAX_IMAGE_SIZE", "64")
+
+		if err := downscaleImages([]api.ImageData{[]byte("not an image")}); err == nil {
+			t.Error("expected error for invalid image")
+		}
+	})
+}
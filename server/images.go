@@ -66,6 +66,11 @@ type Model struct {
 	Messages       []api.Message
 
 	Template *template.Template
+
+	// Summarize, when set, summarizes the messages dropped when a chat
+	// conversation is truncated. The summary is inserted in their place
+	// instead of the skip marker.
+	Summarize func(context.Context, []api.Message) (string, error) `json:"-"`
 }
 
 // Capabilities returns the capabilities that the model supports
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+// truncationMetrics aggregates how chat conversations were truncated for
+// each model since the server started
+type truncationMetrics struct {
+	mu sync.Mutex
+	// models maps model names to their aggregated metrics
+	models map[string]*modelTruncation
+}
+
+type modelTruncation struct {
+	requests  int
+	truncated int
+	// removed is the total number of tokens dropped from truncated requests
+	removed int
+	// longest is the length in tokens of the longest conversation
+	longest int
+}
+
+func (t *truncationMetrics) record(name string, stats promptStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.models == nil {
+		t.models = make(map[string]*modelTruncation)
+	}
+
+	m, ok := t.models[name]
+	if !ok {
+		m = &modelTruncation{}
+		t.models[name] = m
+	}
+
+	m.requests++
+	if stats.removed > 0 {
+		m.truncated++
+		m.removed += stats.removed
+	}
+	m.longest = max(m.longest, stats.length)
+}
+
+func (t *truncationMetrics) snapshot() []api.ModelMetrics {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	metrics := make([]api.ModelMetrics, 0, len(t.models))
+	for name, m := range t.models {
+		mm := api.ModelMetrics{
+			Model:                 name,
+			Requests:              m.requests,
+			TruncatedRequests:     m.truncated,
+			MaxConversationTokens: m.longest,
+		}
+		if m.truncated > 0 {
+			mm.AvgTokensRemoved = float64(m.removed) / float64(m.truncated)
+		}
+		metrics = append(metrics, mm)
+	}
+
+	slices.SortFunc(metrics, func(a, b api.ModelMetrics) int {
+		return cmp.Compare(a.Model, b.Model)
+	})
+
+	return metrics
+}
+
+// MetricsHandler reports how chat conversations sent to each model were
+// truncated
+func (s *Server) MetricsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, api.MetricsResponse{Models: s.truncation.snapshot()})
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/llm"
+)
+
+var (
+	errNumPredictTooLong  = errors.New("num_predict exceeds the model's context length")
+	errPromptFillsContext = errors.New("prompt leaves no room in the context length for the response")
+)
+
+// numCtxLimits bounds a dynamically sized context length
+type numCtxLimits struct {
+	floor, cap int
+	step       int
+	// rounding is "up", "down" or "nearest". Defaults to "up"
+	rounding string
+}
+
+// dynamicNumCtx returns a context length for tokens rounded to a multiple of
+// step and clamped to the floor and cap. The cap is applied last so a length
+// rounded past it is exactly the cap, even when that isn't a multiple of step
+func dynamicNumCtx(tokens int, l numCtxLimits) int {
+	n := tokens
+	if l.step > 0 {
+		switch l.rounding {
+		case "down":
+			n = n / l.step * l.step
+		case "nearest":
+			n = (n + l.step/2) / l.step * l.step
+		default:
+			n = (n + l.step - 1) / l.step * l.step
+		}
+	}
+
+	n = max(n, l.floor)
+	if l.cap > 0 {
+		n = min(n, l.cap)
+	}
+
+	return n
+}
+
+// maxNumCtx returns the longest context length a request may use: the
+// model's maximum context length, or a longer one set by the request's
+// num_ctx_max as far as OLLAMA_MAX_CONTEXT allows, in which case raised is
+// true. It is 0 when the model doesn't declare a maximum
+func maxNumCtx(kv ggml.KV, opts *api.Options) (maxCtx int, raised bool) {
+	maxCtx = int(kv.ContextLength())
+	if maxCtx == 0 {
+		return 0, false
+	}
+
+	if limit := int(envconfig.MaxContext()); opts.NumCtxMax > maxCtx && limit > maxCtx {
+		return min(opts.NumCtxMax, limit), true
+	}
+
+	return maxCtx, false
+}
+
+// capNumCtx limits opts.NumCtx to the longest context length the request may
+// use. The model's metadata is cached, so this doesn't decode the weights on
+// every request. Metadata which can't be read is reported when the model is
+// loaded, so the context length is left as is
+func capNumCtx(m *Model, opts *api.Options) {
+	kv, err := modelKV(m.ModelPath)
+	if err != nil {
+		slog.Debug("couldn't read model metadata to cap the context length", "model", m.ModelPath, "error", err)
+		return
+	}
+
+	maxCtx, _ := maxNumCtx(kv, opts)
+	if maxCtx > 0 && opts.NumCtx > maxCtx {
+		slog.Warn("requested context length exceeds the model's maximum, capping it", "num_ctx", opts.NumCtx, "max", maxCtx)
+		opts.NumCtx = maxCtx
+	}
+}
+
+// fitNumCtx returns the context length needed to fit msgs and the response
+// when OLLAMA_CONTEXT_STEP is set. The current context length is returned if
+// num_ctx was set by the request or the model. A num_predict which doesn't fit
+// in the model's context length is clamped in opts. When the context length is
+// sized, the returned decision describes it
+func fitNumCtx(ctx context.Context, r llm.LlamaServer, m *Model, opts *api.Options, requestOpts map[string]any, msgs []api.Message, tools []api.Tool, think *bool, getGpus func() discover.GpuInfoList) (int, *api.NumCtxDecision, error) {
+	step := int(envconfig.ContextStep())
+	if step == 0 {
+		return opts.NumCtx, nil, nil
+	}
+
+	if _, ok := requestOpts["num_ctx"]; ok {
+		return opts.NumCtx, nil, nil
+	}
+
+	if _, ok := m.Options["num_ctx"]; ok {
+		return opts.NumCtx, nil, nil
+	}
+
+	kv, err := modelKV(m.ModelPath)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	maxCtx, raised := maxNumCtx(kv, opts)
+	if maxCtx == 0 {
+		return opts.NumCtx, nil, nil
+	}
+
+	cappedBy := "model_max"
+	if raised {
+		cappedBy = "request"
+	}
+
+	// a response as long as the whole context the model may use leaves no
+	// room for the prompt and would only ever size the context to its cap
+	if opts.NumPredict >= maxCtx {
+		if envconfig.PredictOverflow() == "error" {
+			return 0, nil, fmt.Errorf("%w: %d exceeds %d", errNumPredictTooLong, opts.NumPredict, maxCtx)
+		}
+
+		opts.NumPredict = maxCtx - 1
+	}
+
+	// render against the full context of the model to measure what the
+	// conversation needs before any truncation. Dropped messages are only
+	// summarized for the prompt the request runs with
+	full := *opts
+	full.NumCtx = maxCtx
+	sized := *m
+	sized.Summarize = nil
+	_, _, stats, err := chatPrompt(ctx, &sized, r.Tokenize, &full, msgs, tools, think)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// reserve room for the response, otherwise generation fills whatever
+	// is left after rounding
+	response := opts.NumPredict
+	if response <= 0 {
+		response = opts.NumReserve
+	}
+
+	// and for the tool calls and results of further rounds of an agent loop
+	if len(tools) > 0 {
+		response += max(opts.ToolRounds, 0) * max(opts.ToolRoundTokens, 0)
+	}
+
+	// the KV cache may not fit in memory long before the model's maximum
+	capCtx := maxCtx
+	if envconfig.ContextVRAMCap() {
+		if n := vramNumCtx(kv, opts, getGpus()); n > 0 && n < capCtx {
+			capCtx, cappedBy = n, "vram"
+		}
+	}
+
+	need := stats.tokens + response
+	numCtx := dynamicNumCtx(need, numCtxLimits{
+		floor:    step,
+		cap:      capCtx,
+		step:     step,
+		rounding: opts.NumCtxRounding,
+	})
+
+	// the context length the request was scheduled with is kept while the
+	// conversation needs about as much, rather than reloading the model for
+	// a small change in length
+	decision := &api.NumCtxDecision{Resident: opts.NumCtx, Required: need}
+	if need > capCtx {
+		decision.CappedBy = cappedBy
+	}
+
+	if margin := int(envconfig.ContextHysteresis()); margin > 0 && numCtx != opts.NumCtx &&
+		stats.tokens <= opts.NumCtx && opts.NumCtx <= capCtx && max(need-opts.NumCtx, opts.NumCtx-need) <= margin {
+		numCtx = opts.NumCtx
+		decision.Reused = true
+	}
+
+	return numCtx, decision, nil
+}
+
+// vramNumCtx returns the longest context length the KV cache could grow to in
+// the free VRAM of gpus, on top of the resident context length whose cache is
+// already allocated. Zero is returned when the model doesn't run on a GPU
+func vramNumCtx(kv ggml.KV, opts *api.Options, gpus discover.GpuInfoList) int {
+	var free uint64
+	var gpu bool
+	for _, g := range gpus {
+		if g.Library != "cpu" {
+			free += g.FreeMemory
+			gpu = true
+		}
+	}
+
+	perToken := kvBytesPerToken(kv, opts)
+	if !gpu || perToken == 0 {
+		return 0
+	}
+
+	return opts.NumCtx + int(free/perToken)
+}
+
+// kvBytesPerToken estimates the KV cache memory used by each token of context
+func kvBytesPerToken(kv ggml.KV, opts *api.Options) uint64 {
+	cacheType := opts.KVCacheType
+	if cacheType == "" {
+		cacheType = envconfig.KvCacheType()
+	}
+
+	elements := kv.BlockCount() * kv.HeadCountKV() * (kv.EmbeddingHeadCountK() + kv.EmbeddingHeadCountV())
+	switch strings.ToLower(cacheType) {
+	case "q8_0":
+		return elements
+	case "q4_0":
+		return elements / 2
+	default:
+		return elements * 2
+	}
+}
+
+// modelSizing returns the metadata of m used to size its context length
+func modelSizing(m *Model) (*api.ModelSizing, error) {
+	kv, err := modelKV(m.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.ModelSizing{
+		ContextLength: kv.ContextLength(),
+		BlockCount:    kv.BlockCount(),
+		HeadCount:     kv.HeadCount(),
+		HeadCountKV:   kv.HeadCountKV(),
+		KeyLength:     kv.EmbeddingHeadCountK(),
+		ValueLength:   kv.EmbeddingHeadCountV(),
+	}, nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import "testing"
+
+func TestDynamicNumCtx(t *testing.T) {
+	cases := []struct {
+		name   string
+		tokens int
+		limits numCtxLimits
+		expect int
+	}{
+		{
+			name:   "up",
+			tokens: 2500,
+			limits: numCtxLimits{floor: 1024, cap: 8192, step: 1024, rounding: "up"},
+			expect: 3072,
+		},
+		{
+			name:   "default",
+			tokens: 2500,
+			limits: numCtxLimits{floor: 1024, cap: 8192, step: 1024},
+			expect: 3072,
+		},
+		{
+			name:   "down",
+			tokens: 2500,
+			limits: numCtxLimits{floor: 1024, cap: 8192, step: 1024, rounding: "down"},
+			expect: 2048,
+		},
+		{
+			name:   "nearest",
+			tokens: 2500,
+			limits: numCtxLimits{floor: 1024, cap: 8192, step: 1024, rounding: "nearest"},
+			expect: 2048,
+		},
+		{
+			name:   "nearest rounds up past half",
+			tokens: 2600,
+			limits: numCtxLimits{floor: 1024, cap: 8192, step: 1024, rounding: "nearest"},
+			expect: 3072,
+		},
+		{
+			name:   "down respects floor",
+			tokens: 500,
+			limits: numCtxLimits{floor: 1024, cap: 8192, step: 1024, rounding: "down"},
+			expect: 1024,
+		},
+		{
+			name:   "up respects cap",
+			tokens: 8000,
+			limits: numCtxLimits{floor: 1024, cap: 7000, step: 1024, rounding: "up"},
+			expect: 7000,
+		},
+		{
+			name:   "nearest respects cap",
+			tokens: 6900,
+			limits: numCtxLimits{floor: 1024, cap: 6500, step: 1024, rounding: "nearest"},
+			expect: 6500,
+		},
+		{
+			name:   "cap below floor",
+			tokens: 500,
+			limits: numCtxLimits{floor: 4096, cap: 2048, step: 4096},
+			expect: 2048,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dynamicNumCtx(tt.tokens, tt.limits); got != tt.expect {
+				t.Errorf("expected %d, got %d", tt.expect, got)
+			}
+		})
+	}
+}
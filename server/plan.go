@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+)
+
+// promptEvalRates tracks the most recent prompt evaluation throughput of each
+// model so the time to evaluate a prompt can be estimated
+type promptEvalRates struct {
+	mu sync.Mutex
+	// rates maps model paths to tokens evaluated per second
+	rates map[string]float64
+}
+
+func (r *promptEvalRates) record(modelPath string, count int, d time.Duration) {
+	if count <= 0 || d <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rates == nil {
+		r.rates = make(map[string]float64)
+	}
+
+	r.rates[modelPath] = float64(count) / d.Seconds()
+}
+
+func (r *promptEvalRates) estimate(modelPath string, count int) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rate, ok := r.rates[modelPath]
+	if !ok {
+		return 0
+	}
+
+	return time.Duration(float64(count) / rate * float64(time.Second))
+}
+
+// PlanHandler reports how a chat request would run without generating a
+// response. The model is loaded if it isn't already so the prompt can be
+// tokenized, evicting other models as a chat request would, and the response
+// describes the state after that load. A loaded model is never reloaded.
+func (s *Server) PlanHandler(c *gin.Context) {
+	var req api.ChatRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := checkNumKeep(req.Options); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Tools) > 0 {
+		tools, err := validateTools(req.Tools)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		req.Tools = tools
+	}
+
+	caps := []model.Capability{model.CapabilityCompletion}
+	if len(req.Tools) > 0 && !envconfig.ToolsInSystem() {
+		caps = append(caps, model.CapabilityTools)
+	}
+	if req.Think != nil && *req.Think {
+		caps = append(caps, model.CapabilityThinking)
+	}
+
+	name := model.ParseName(req.Model)
+	if !name.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+	name, err := getExistingName(name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	if err := s.writes.wait(c.Request.Context(), name.String()); err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	m, err := GetModel(name.String())
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	// reject what the chat request would, even when the model is loaded and
+	// isn't scheduled
+	if err := m.CheckCapabilities(caps...); errors.Is(err, errCapabilityCompletion) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", req.Model)})
+		return
+	} else if err != nil {
+		handleScheduleError(c, req.Model, fmt.Errorf("%s %w", name, err))
+		return
+	}
+
+	if len(m.Messages)+len(req.Messages) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "messages are required"})
+		return
+	}
+
+	opts, err := modelOptions(m, req.Options)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	capNumCtx(m, &opts)
+
+	// match the minimum context length enforced by the scheduler
+	opts.NumCtx = max(opts.NumCtx, 4)
+
+	// the runner is referenced until the plan is done so it can't be
+	// unloaded while the prompt is tokenized
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	// the tokenizer doesn't depend on the runner options so a loaded runner
+	// can count tokens even when the request would reload it
+	var r llm.LlamaServer
+	var loaded bool
+	if runner, _ := s.sched.loadedRunner(ctx, m, opts); runner != nil {
+		r = runner.llama
+	} else {
+		r, _, _, _, err = s.scheduleRunner(ctx, name.String(), caps, req.Options, req.KeepAlive, req.Priority, nil)
+		if err != nil {
+			handleScheduleError(c, req.Model, err)
+			return
+		}
+		loaded = true
+	}
+
+	msgs := append(m.Messages, req.Messages...)
+	if (len(req.Messages) == 0 || req.Messages[0].Role != "system") && m.System != "" {
+		msgs = append([]api.Message{{Role: "system", Content: m.System}}, msgs...)
+	}
+	msgs = filterThinkTags(msgs, m)
+
+	// as in the chat request, tools the template can't render are described
+	// in a system message when the server is configured to
+	if len(req.Tools) > 0 && envconfig.ToolsInSystem() && !slices.Contains(m.Template.Vars(), "tools") {
+		msgs = append([]api.Message{toolsMessage(req.Tools)}, msgs...)
+		req.Tools = nil
+	}
+
+	// size the context length as the chat request would
+	numCtx, _, err := fitNumCtx(ctx, r, m, &opts, req.Options, msgs, req.Tools, req.Think, s.sched.getGpuFn)
+	if isPromptError(err) || errors.Is(err, errNumPredictTooLong) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		slog.Error("plan context length error", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	opts.NumCtx = numCtx
+
+	// compare the fitted options against the runner as it is now, including
+	// one loaded by the plan itself
+	_, reload := s.sched.loadedRunner(ctx, m, opts)
+
+	_, _, stats, err := chatPrompt(ctx, m, r.Tokenize, &opts, msgs, req.Tools, req.Think)
+	if isPromptError(err) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		slog.Error("chat prompt error", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to plan request: %v", err)})
+		return
+	}
+
+	resp := api.PlanResponse{
+		Model:              req.Model,
+		NumCtx:             opts.NumCtx,
+		PromptEvalCount:    stats.tokens,
+		PromptEvalDuration: s.promptRates.estimate(m.ModelPath, stats.tokens),
+		Reload:             reload,
+		Loaded:             loaded,
+		Truncation:         stats.truncation,
+		ExtremeTruncation:  stats.extreme,
+	}
+
+	if req.Verbose {
+		resp.Trace = stats.trace
+		resp.TruncationFastPath = stats.fastPath
+		resp.TruncationStrategy = stats.strategy
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
@@ -2,111 +2,1553 @@ package server
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	"io"
 	"log/slog"
+	"maps"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"golang.org/x/sync/errgroup"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/template"
+	"github.com/ollama/ollama/types/model"
 )
 
 type tokenizeFunc func(context.Context, string) ([]int, error)
 
+// parallelTokenizeMessages is the number of messages a conversation needs
+// before its messages are counted concurrently
+const parallelTokenizeMessages = 16
+
+var (
+	errSystemTooLong   = errors.New("system messages exceed the context length")
+	errEmptyChat       = errors.New("no messages to render")
+	errUnknownRole     = errors.New("template does not render role")
+	errTooManyImages   = errors.New("too many images")
+	errEmptyPrompt     = errors.New("template rendered an empty prompt from non-empty messages")
+	errNoVision        = errors.New("model does not support images")
+	errSystemOnly      = errors.New("no messages to respond to besides system messages")
+	errInvalidTool     = errors.New("tool parameters can't be serialized to JSON")
+	errContextTooSmall = errors.New("latest message exceeds the context length")
+	errToolsTooLong    = errors.New("tools exceed their share of the context length")
+)
+
+// isPromptError reports whether err is caused by the request's messages or
+// options rather than the server, so the request should be rejected as bad
+func isPromptError(err error) bool {
+	for _, target := range []error{
+		errSystemTooLong,
+		errEmptyChat,
+		errUnknownRole,
+		errTooManyImages,
+		errEmptyPrompt,
+		errNoVision,
+		errSystemOnly,
+		errContextTooSmall,
+		errToolsTooLong,
+		errPromptFillsContext,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// promptStats describes the prompt built by chatPrompt
+type promptStats struct {
+	// tokens is the number of tokens in the prompt, including images
+	tokens int
+	// imageTokens is the number of tokens counted for each image in the
+	// prompt, in the order they are returned
+	imageTokens []int
+	// warnings describes problems with the prompt which didn't prevent it
+	// from being rendered
+	warnings []string
+	// trace records each set of messages considered while truncating
+	trace []api.TruncationStep
+	// think is the think value the template was rendered with
+	think bool
+	// thinkSet is the IsThinkSet value the template was rendered with
+	thinkSet bool
+	// truncation describes how the conversation was truncated
+	truncation api.TruncationReason
+	// extreme is true when every intermediate message was dropped and at
+	// least OLLAMA_EXTREME_TRUNC of them
+	extreme bool
+	// strategy is the name of the truncation strategy used
+	strategy string
+	// fastPath is true when the conversation was estimated to fit from its
+	// length and confirmed with a single count
+	fastPath bool
+	// allIncluded is true when every message was rendered in full, without
+	// being dropped or clipped
+	allIncluded bool
+	// length is the number of tokens in the full conversation before any
+	// messages were dropped
+	length int
+	// removed is the number of tokens dropped messages would have used
+	removed int
+	// messages and kept are the number of conversation messages before and
+	// after truncation
+	messages, kept int
+	// templateDuration and tokenizeDuration are the time spent executing the
+	// template and tokenizing while building the prompt
+	templateDuration time.Duration
+	tokenizeDuration time.Duration
+	// tokenizeCalls is the number of times text was tokenized while building
+	// the prompt
+	tokenizeCalls int
+	// toolTokens is the number of tokens the tools add to the prompt, which
+	// are counted against the context length before any messages
+	toolTokens int
+}
+
+// summary reports a truncated conversation's message and token counts, or
+// nil when the whole conversation fit
+func (s promptStats) summary() *api.TruncationSummary {
+	if s.truncation == "" || s.truncation == api.TruncationNone {
+		return nil
+	}
+
+	return &api.TruncationSummary{
+		OriginalMessageCount: s.messages,
+		FinalMessageCount:    s.kept,
+		MessagesRemoved:      max(s.messages-s.kept, 0),
+		FinalTokenCount:      s.tokens,
+	}
+}
+
 // chatPrompt accepts a list of messages and returns the prompt and images that should be used for the next chat turn.
 // chatPrompt truncates any messages that exceed the context window of the model, making sure to always include 1) the
-// latest message and 2) system messages
-func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool, think *bool) (prompt string, images []llm.ImageData, _ error) {
+// latest message, 2) system messages and 3) messages the latest message references. By default the oldest messages are
+// dropped first; opts.Truncation selects "head_tail" to instead keep the first opts.TruncateHead and last
+// opts.TruncateTail messages
+func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool, think *bool) (prompt string, images []llm.ImageData, _ promptStats, _ error) {
 	var system []api.Message
 
-	// TODO: Ideally we would compute this from the projector metadata but some pieces are implementation dependent
-	// Clip images are represented as 768 tokens, each an embedding
-	imageNumTokens := 768
-
-	n := len(msgs) - 1
-	// in reverse, find all messages that fit into context window
-	for i := n; i >= 0; i-- {
-		// always include the last message
-		if i == n {
-			continue
+	thinkVal := false
+	if think != nil {
+		thinkVal = *think
+	}
+
+	// time template execution and tokenization separately, and count the
+	// calls to tokenize. Both may run concurrently while counting truncation
+	// candidates
+	var templateTime, tokenizeTime, tokenizeCalls atomic.Int64
+	execute := func(w io.Writer, v template.Values) error {
+		start := time.Now()
+		defer func() { templateTime.Add(int64(time.Since(start))) }()
+		return m.Template.Execute(w, v)
+	}
+	tokenize = func(tokenize tokenizeFunc) tokenizeFunc {
+		return func(ctx context.Context, s string) ([]int, error) {
+			start := time.Now()
+			defer func() { tokenizeTime.Add(int64(time.Since(start))) }()
+			tokenizeCalls.Add(1)
+			return tokenize(ctx, s)
+		}
+	}(tokenize)
+
+	if envconfig.NormalizeContent() {
+		msgs = slices.Clone(msgs)
+		for i := range msgs {
+			msgs[i].Content = normalizeContent(msgs[i].Content)
+		}
+	}
+
+	// a template which doesn't render tool calls leaves them out of the
+	// prompt, so when configured they're written after the content of their
+	// message to be rendered and counted along with it
+	if envconfig.ToolCallContent() == "json" && !slices.Contains(m.Template.Vars(), "toolcalls") {
+		msgs = slices.Clone(msgs)
+		for i := range msgs {
+			if len(msgs[i].ToolCalls) > 0 {
+				msgs[i].Content = toolCallContent(msgs[i])
+			}
+		}
+	}
+
+	if len(msgs) == 0 {
+		switch envconfig.EmptyChat() {
+		case "error":
+			return "", nil, promptStats{}, errEmptyChat
+		case "render":
+			// some templates add a preamble even without any messages
+			var b bytes.Buffer
+			if err := execute(&b, template.Values{Tools: tools, Think: thinkVal, IsThinkSet: think != nil}); err != nil {
+				return "", nil, promptStats{}, err
+			}
+
+			s, err := tokenize(ctx, b.String())
+			if err != nil {
+				return "", nil, promptStats{}, err
+			}
+
+			return b.String(), nil, promptStats{tokens: len(s), think: thinkVal, thinkSet: think != nil}, nil
+		default:
+			return "", nil, promptStats{think: thinkVal, thinkSet: think != nil}, nil
 		}
+	}
+
+	if envconfig.SystemOnly() == "error" && len(systemMessages(msgs, keepSet{})) == len(msgs) {
+		return "", nil, promptStats{}, errSystemOnly
+	}
+
+	// oversized messages are clipped rather than dropped whole by truncation
+	var warnings []string
+	var clipped bool
+	if opts.MaxMessageTokens > 0 {
+		msgs = slices.Clone(msgs)
+		for i := range msgs {
+			content, n, err := clipContent(ctx, tokenize, msgs[i].Content, opts.MaxMessageTokens)
+			if err != nil {
+				return "", nil, promptStats{}, err
+			}
 
-		system = make([]api.Message, 0)
-		for j := range i {
-			if msgs[j].Role == "system" {
-				system = append(system, msgs[j])
+			if content != msgs[i].Content {
+				slog.Debug("clipping message which exceeds max_message_tokens", "message", i, "tokens", n, "max_message_tokens", opts.MaxMessageTokens)
+				warnings = append(warnings, fmt.Sprintf("message %d was clipped from %d tokens to at most %d", i, n, opts.MaxMessageTokens))
+				msgs[i].Content = content
+				clipped = true
 			}
 		}
+	}
+
+	// images sent to a model without vision would only be tagged into the
+	// content, so they're rejected or dropped when configured to
+	if mode := envconfig.NoVisionImages(); (mode == "error" || mode == "drop") &&
+		slices.ContainsFunc(msgs, func(msg api.Message) bool { return len(msg.Images) > 0 }) &&
+		!slices.Contains(m.Capabilities(), model.CapabilityVision) {
+		if mode == "error" {
+			return "", nil, promptStats{}, errNoVision
+		}
 
-		thinkVal := false
-		if think != nil {
-			thinkVal = *think
+		slog.Warn("dropping images sent to a model without vision")
+		warnings = append(warnings, "model does not support images, images were dropped")
+		msgs = slices.Clone(msgs)
+		for i := range msgs {
+			if len(msgs[i].Images) > 0 {
+				msgs[i].Content = strings.ReplaceAll(msgs[i].Content, "[img]", "")
+				msgs[i].Images = nil
+			}
 		}
+	}
+
+	imgCost := imageCost(m, opts)
+	countTokensWith := func(msgs []api.Message, tools []api.Tool) (int, error) {
 		var b bytes.Buffer
-		if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[i:]...), Tools: tools, Think: thinkVal, IsThinkSet: think != nil}); err != nil {
-			return "", nil, err
+		if err := execute(&b, template.Values{Messages: msgs, Tools: tools, Think: thinkVal, IsThinkSet: think != nil}); err != nil {
+			return 0, err
 		}
 
 		s, err := tokenize(ctx, b.String())
 		if err != nil {
-			return "", nil, err
+			return 0, err
 		}
 
 		ctxLen := len(s)
 		if m.ProjectorPaths != nil {
-			for _, m := range msgs[i:] {
-				ctxLen += imageNumTokens * len(m.Images)
+			for _, msg := range msgs {
+				ctxLen += imagesTokenCount(imgCost, msg.Images)
+			}
+		}
+
+		return ctxLen, nil
+	}
+	countTokens := func(msgs []api.Message) (int, error) {
+		return countTokensWith(msgs, tools)
+	}
+
+	// system messages are always kept, so check that they fit on their own
+	// when configured to reject or truncate oversized system content
+	var systemDropped bool
+	if mode := envconfig.SystemOverflow(); mode == "error" || mode == "truncate" {
+		for {
+			system = systemMessages(msgs, keepSet{})
+			if len(system) == 0 {
+				break
+			}
+
+			ctxLen, err := countTokens(system)
+			if err != nil {
+				return "", nil, promptStats{}, err
 			}
+
+			if ctxLen <= opts.NumCtx {
+				break
+			}
+
+			if mode == "error" {
+				return "", nil, promptStats{}, fmt.Errorf("%w: %d tokens exceeds context length %d", errSystemTooLong, ctxLen, opts.NumCtx)
+			}
+
+			// the latest message is always included, even when it is a system message
+			i := slices.IndexFunc(msgs[:len(msgs)-1], func(msg api.Message) bool { return msg.Role == "system" })
+			if i < 0 {
+				break
+			}
+
+			slog.Warn("dropping system message which exceeds context length", "tokens", ctxLen, "num_ctx", opts.NumCtx)
+			msgs = slices.Delete(slices.Clone(msgs), i, i+1)
+			systemDropped = true
+		}
+	}
+
+	// prioritizing history trims tool definitions down to their names and
+	// types when the full conversation doesn't fit
+	if opts.ToolPriority == "history" && len(tools) > 0 {
+		ctxLen, err := countTokens(msgs)
+		if err != nil {
+			return "", nil, promptStats{}, err
 		}
 
 		if ctxLen > opts.NumCtx {
-			slog.Debug("truncating input messages which exceed context length", "truncated", len(msgs[i:]))
-			break
-		} else {
-			n = i
+			tools = trimTools(tools)
+		}
+	}
+
+	// tools are rendered into every candidate prompt, so their cost is
+	// measured once with the latest message, which is always kept, to tell
+	// how much of the context length they leave for messages. Prompts which
+	// tools alone would mostly fill are rejected when configured to
+	var toolTokens int
+	if len(tools) > 0 {
+		latest := msgs[len(msgs)-1:]
+		with, err := countTokensWith(latest, tools)
+		if err != nil {
+			return "", nil, promptStats{}, err
+		}
+
+		without, err := countTokensWith(latest, nil)
+		if err != nil {
+			return "", nil, promptStats{}, err
+		}
+
+		toolTokens = max(with-without, 0)
+		slog.Debug("tools reduce the context length available to messages", "tool_tokens", toolTokens, "num_ctx", opts.NumCtx, "message_budget", opts.NumCtx-toolTokens)
+
+		if percent := int(envconfig.ToolContextPercent()); percent > 0 && toolTokens*100 > percent*opts.NumCtx {
+			return "", nil, promptStats{}, fmt.Errorf("%w: %d tokens of tools exceeds %d%% of context length %d", errToolsTooLong, toolTokens, percent, opts.NumCtx)
+		}
+	}
+
+	// messages the latest message references and the first
+	// opts.NumKeepMessages conversation messages are kept like system messages
+	keep := keepSet{refs: msgs[len(msgs)-1].References, pinned: pinnedMessages(msgs, opts.NumKeepMessages)}
+
+	markerFormat, markerRole := envconfig.SkipMarker(), cmp.Or(opts.SkipMarkerRole, "system")
+	if opts.SkipMarker != "" {
+		markerFormat = opts.SkipMarker
+	}
+
+	// the template's fixed tokens, such as a preamble or the generation
+	// prompt, are measured once by rendering without messages so they can be
+	// told apart from the tokens each message adds
+	var overhead int
+	if len(msgs) > 1 {
+		var b bytes.Buffer
+		if err := execute(&b, template.Values{Think: thinkVal, IsThinkSet: think != nil}); err != nil {
+			return "", nil, promptStats{}, err
+		}
+
+		s, err := tokenize(ctx, b.String())
+		if err != nil {
+			return "", nil, promptStats{}, err
+		}
+		overhead = len(s)
+	}
+
+	// when a skip marker is configured, reserve room for it in the context
+	// window and measure the full conversation so the marker can report how
+	// much was removed. The marker is measured as the template renders it so
+	// its role markers are reserved too
+	var totalLen, markerLen int
+	if markerFormat != "" && len(msgs) > 1 {
+		var err error
+		totalLen, err = countTokens(msgs)
+		if err != nil {
+			return "", nil, promptStats{}, err
+		}
+
+		var b bytes.Buffer
+		if err := execute(&b, template.Values{Messages: []api.Message{*skipMarker(markerFormat, markerRole, len(msgs), totalLen)}, Think: thinkVal, IsThinkSet: think != nil}); err != nil {
+			return "", nil, promptStats{}, err
+		}
+
+		s, err := tokenize(ctx, b.String())
+		if err != nil {
+			return "", nil, promptStats{}, err
+		}
+		markerLen = max(len(s)-overhead, 0)
+	}
+
+	// dropMarker returns the message inserted in place of the dropped
+	// messages and the number of tokens it adds to a prompt of ctxLen tokens:
+	// the model's summary of them when it fits, or else the skip marker, if
+	// configured
+	dropMarker := func(dropped []api.Message, ctxLen int) (*api.Message, int, error) {
+		if m.Summarize != nil {
+			summary, err := m.Summarize(ctx, dropped)
+			if err != nil {
+				slog.Warn("failed to summarize dropped messages, using the skip marker", "error", err)
+			} else if summary != "" {
+				msg := api.Message{Role: markerRole, Content: summary}
+				var b bytes.Buffer
+				if err := execute(&b, template.Values{Messages: []api.Message{msg}, Think: thinkVal, IsThinkSet: think != nil}); err != nil {
+					return nil, 0, err
+				}
+
+				s, err := tokenize(ctx, b.String())
+				if err != nil {
+					return nil, 0, err
+				}
+
+				if n := max(len(s)-overhead, 0); ctxLen+n <= opts.NumCtx {
+					return &msg, n, nil
+				}
+				slog.Debug("summary of dropped messages exceeds context length, using the skip marker", "tokens", len(s))
+			}
+		}
+
+		if markerFormat == "" {
+			return nil, 0, nil
 		}
+
+		return skipMarker(markerFormat, markerRole, len(dropped), max(totalLen-ctxLen, 0)), markerLen, nil
 	}
 
-	currMsgIdx := n
+	limit := func(i int) int {
+		if markerFormat != "" && droppedTurns(msgs[:i], keep) > 0 {
+			return opts.NumCtx - markerLen
+		}
+		return opts.NumCtx
+	}
 
-	for cnt, msg := range msgs[currMsgIdx:] {
+	// final holds the messages to render. Images are tagged in messages from
+	// final[first:]
+	var final []api.Message
+	var first int
+	stats := promptStats{think: thinkVal, thinkSet: think != nil, warnings: warnings, toolTokens: toolTokens}
+	// marker is the skip marker or summary inserted into final, if any, at
+	// markerAt, and markerTokens the number of tokens it adds
+	var marker *api.Message
+	var markerAt, markerTokens int
+	// truncated is the number of conversation messages dropped
+	var truncated int
+
+	strategy := opts.Truncation
+	truncateHead, truncateTail := opts.TruncateHead, opts.TruncateTail
+	if strategy == "" || strategy == "auto" {
+		var classHead, classTail int
+		strategy, classHead, classTail = truncationClass(envconfig.TruncationClasses(), len(msgs))
+		if truncateHead == 0 && truncateTail == 0 {
+			truncateHead, truncateTail = classHead, classTail
+		}
+
+		// head_tail without either would keep only the latest message however
+		// much of the conversation fits
+		if strategy == "head_tail" && truncateHead == 0 && truncateTail == 0 {
+			slog.Debug("truncation class sets no head or tail, using sliding_window")
+			strategy = "sliding_window"
+		}
+	}
+	if strategy != "head_tail" {
+		strategy = "sliding_window"
+	}
+	stats.strategy = strategy
+
+	// with OLLAMA_TOOL_ORPHANS=keep, a tool result whose call would be
+	// truncated makes the call and its results as mandatory as system
+	// messages, and the conversation is fitted again around them
+	orphans := envconfig.ToolOrphans()
+	for {
+		final, first, truncated = nil, 0, 0
+		marker, markerAt, markerTokens = nil, 0, 0
+		stats.fastPath = false
+		switch strategy {
+		case "head_tail":
+			// keep the first and last conversation messages, dropping from the
+			// middle until the prompt fits
+			turns := droppedTurns(msgs[:len(msgs)-1], keep)
+			head := min(max(truncateHead, 0), turns)
+			tail := min(max(truncateTail, 1), turns-head+1)
+			for {
+				kept, at, dropped := headTail(msgs, keep, head, tail)
+				ctxLen, err := countTokens(kept)
+				if err != nil {
+					return "", nil, promptStats{}, err
+				}
+
+				budget := opts.NumCtx
+				if markerFormat != "" && len(dropped) > 0 {
+					budget -= markerLen
+				}
+				stats.trace = append(stats.trace, api.TruncationStep{Messages: len(kept), Tokens: ctxLen, Limit: budget})
+
+				if ctxLen <= budget || (head == 0 && tail == 1) {
+					final = kept
+					stats.tokens = ctxLen
+					truncated = len(dropped)
+					if truncated > 0 {
+						marker, markerTokens, err = dropMarker(dropped, ctxLen)
+						if err != nil {
+							return "", nil, promptStats{}, err
+						}
+
+						if marker != nil {
+							final = slices.Insert(final, at, *marker)
+							markerAt = at
+							stats.tokens += markerTokens
+						}
+					}
+					break
+				}
+
+				slog.Debug("truncating input messages which exceed context length", "head", head, "tail", tail)
+				if tail > 1 {
+					tail--
+				} else {
+					head--
+				}
+			}
+		default:
+			n := len(msgs) - 1
+			var keptLen int
+
+			// a conversation estimated to fit from its length is confirmed with a
+			// single count of the whole conversation rather than counting each
+			// candidate
+			if ratio := int(envconfig.CharsPerToken()); ratio > 0 && n > 0 {
+				estimate := 0
+				for _, msg := range msgs {
+					estimate += (len(msg.Content) + len(msg.Thinking)) / ratio
+					if m.ProjectorPaths != nil {
+						estimate += imagesTokenCount(imgCost, msg.Images)
+					}
+				}
+
+				if estimate <= opts.NumCtx {
+					ctxLen, err := countTokens(msgs)
+					if err != nil {
+						return "", nil, promptStats{}, err
+					}
+					stats.trace = append(stats.trace, api.TruncationStep{Messages: len(msgs), Tokens: ctxLen, Limit: limit(0)})
+
+					if ctxLen <= limit(0) {
+						slog.Debug("conversation fits the context length", "estimate", estimate, "tokens", ctxLen)
+						n, keptLen, stats.fastPath = 0, ctxLen, true
+					}
+				}
+			}
+
+			if n > 0 {
+				// estimate each candidate by adding the token count of the message
+				// it adds, so each message is tokenized once rather than rendering
+				// and tokenizing every candidate in full. Counts are cached across
+				// requests when enabled, and long histories count batches of
+				// messages concurrently. The selection is then confirmed with a
+				// full count of the rendered prompt
+				var err error
+				system = systemMessages(msgs[:n], keep)
+				keptLen, err = countTokens(append(system, msgs[n:]...))
+				if err != nil {
+					return "", nil, promptStats{}, err
+				}
+
+				workers := max(int(envconfig.TokenizeWorkers()), 1)
+				if n < parallelTokenizeMessages {
+					workers = 1
+				}
+
+				ctxLen := keptLen
+				estimated := keptLen
+			fill:
+				for i := n - 1; i >= 0; i -= workers {
+					batch := make([]int, 0, workers)
+					for j := i; j >= 0 && len(batch) < workers; j-- {
+						batch = append(batch, j)
+					}
+
+					counts, err := countCandidates(batch, workers, func(i int) (int, error) {
+						// system messages are always included so they are already counted
+						if keptMessage(i, msgs[i], keep) {
+							return 0, nil
+						}
+
+						l, err := messageTokens(ctx, m, execute, tokenize, msgs[i], thinkVal, think != nil)
+						if err != nil {
+							return 0, err
+						}
+
+						l = max(l-overhead, 0)
+						if m.ProjectorPaths != nil {
+							l += imagesTokenCount(imgCost, msgs[i].Images)
+						}
+						return l, nil
+					})
+					if err != nil {
+						return "", nil, promptStats{}, err
+					}
+
+					for k, j := range batch {
+						ctxLen += counts[k]
+						stats.trace = append(stats.trace, api.TruncationStep{Messages: len(systemMessages(msgs[:j], keep)) + len(msgs[j:]), Tokens: ctxLen, Limit: limit(j)})
+
+						if ctxLen > limit(j) {
+							slog.Debug("truncating input messages which exceed context length", "truncated", len(msgs[j:]))
+							break fill
+						}
+						n = j
+						estimated = ctxLen
+					}
+				}
+
+				confirm := n
+				for ; n < len(msgs)-1; n++ {
+					system = systemMessages(msgs[:n], keep)
+					ctxLen, err := countTokens(append(system, msgs[n:]...))
+					if err != nil {
+						return "", nil, promptStats{}, err
+					}
+
+					// the count confirming the estimate is only traced when it differs
+					if n != confirm || ctxLen != estimated {
+						stats.trace = append(stats.trace, api.TruncationStep{Messages: len(system) + len(msgs[n:]), Tokens: ctxLen, Limit: limit(n)})
+					}
+
+					if ctxLen <= limit(n) {
+						keptLen = ctxLen
+						break
+					}
+				}
+
+				// templates which merge messages, such as consecutive messages
+				// with the same role, render fewer tokens than the sum of the
+				// messages so earlier messages may fit after all
+				if n == confirm && keptLen < estimated {
+					slog.Debug("prompt is shorter than estimated, template may merge messages", "estimated", estimated, "tokens", keptLen)
+					for ; n > 0; n-- {
+						system = systemMessages(msgs[:n-1], keep)
+						ctxLen, err := countTokens(append(system, msgs[n-1:]...))
+						if err != nil {
+							return "", nil, promptStats{}, err
+						}
+						stats.trace = append(stats.trace, api.TruncationStep{Messages: len(system) + len(msgs[n-1:]), Tokens: ctxLen, Limit: limit(n - 1)})
+
+						if ctxLen > limit(n-1) {
+							break
+						}
+						keptLen = ctxLen
+					}
+				}
+			}
+
+			currMsgIdx := n
+			system = systemMessages(msgs[:currMsgIdx], keep)
+
+			// the latest message is always included so it may not have been counted
+			if keptLen == 0 {
+				var err error
+				keptLen, err = countTokens(append(system, msgs[currMsgIdx:]...))
+				if err != nil {
+					return "", nil, promptStats{}, err
+				}
+			}
+
+			stats.tokens = keptLen
+
+			// replace any dropped messages with a marker so the model knows the
+			// conversation has been truncated
+			truncated = droppedTurns(msgs[:currMsgIdx], keep)
+			if truncated > 0 {
+				var err error
+				marker, markerTokens, err = dropMarker(droppedMessages(msgs[:currMsgIdx], keep), keptLen)
+				if err != nil {
+					return "", nil, promptStats{}, err
+				}
+
+				if marker != nil {
+					markerAt = len(system)
+					if opts.SystemOrder == "position" {
+						// the marker takes the place of the first dropped
+						// message so messages kept after it, such as system
+						// messages sent mid-conversation, stay after it
+						markerAt = 0
+						for keptMessage(markerAt, msgs[markerAt], keep) {
+							markerAt++
+						}
+					}
+					system = slices.Insert(system, markerAt, *marker)
+					stats.tokens += markerTokens
+				}
+			}
+
+			first = len(system)
+			final = append(system, msgs[currMsgIdx:]...)
+		}
+
+		if orphans == "keep" {
+			if ids := orphanedCalls(msgs, final[first:]); len(ids) > 0 {
+				slog.Debug("keeping truncated tool calls for their results", "tool_call_ids", ids)
+				keep.toolCalls = append(keep.toolCalls, ids...)
+				continue
+			}
+		}
+		break
+	}
+
+	// tool results whose tool call was truncated are dangling, so they are
+	// dropped when configured to and count as truncated messages
+	if orphans == "drop" {
+		if resolved, n := dropToolResults(final[first:]); n > 0 {
+			final = append(final[:first:first], resolved...)
+			ctxLen, err := countTokens(final)
+			if err != nil {
+				return "", nil, promptStats{}, err
+			}
+			stats.tokens = ctxLen
+			truncated += n
+		}
+	}
+
+	// the latest message is always kept, so when it doesn't fit it is
+	// rejected or clipped to fit if configured, rather than leaving the
+	// prompt to the runner to truncate
+	if over := stats.tokens - opts.NumCtx; over > 0 {
+		switch opts.LatestOverflow {
+		case "error":
+			return "", nil, promptStats{}, fmt.Errorf("%w: %d tokens exceeds context length %d", errContextTooSmall, stats.tokens, opts.NumCtx)
+		case "truncate":
+			latest := &final[len(final)-1]
+			s, err := tokenize(ctx, latest.Content)
+			if err != nil {
+				return "", nil, promptStats{}, err
+			}
+
+			content, n, err := clipContent(ctx, tokenize, latest.Content, max(len(s)-over, 0))
+			if err != nil {
+				return "", nil, promptStats{}, err
+			}
+
+			slog.Debug("clipping latest message which exceeds context length", "tokens", n, "num_ctx", opts.NumCtx)
+			stats.warnings = append(stats.warnings, fmt.Sprintf("latest message was clipped from %d tokens to fit the context length", n))
+			latest.Content = content
+			clipped = true
+
+			stats.tokens, err = countTokens(final)
+			if err != nil {
+				return "", nil, promptStats{}, err
+			}
+		}
+	}
+
+	// the most severe truncation is reported
+	switch turns := droppedTurns(msgs[:len(msgs)-1], keep); {
+	case stats.tokens > opts.NumCtx:
+		stats.truncation = api.TruncationLatestTruncated
+	case systemDropped:
+		stats.truncation = api.TruncationSystemTruncated
+	case truncated > 0 && truncated == turns:
+		stats.truncation = api.TruncationAllIntermediateDropped
+	case truncated > 0:
+		stats.truncation = api.TruncationIntermediateDropped
+	default:
+		stats.truncation = api.TruncationNone
+	}
+	stats.allIncluded = stats.truncation == api.TruncationNone && !clipped
+
+	if n := envconfig.ExtremeTruncation(); stats.truncation == api.TruncationAllIntermediateDropped && n > 0 && uint(truncated) >= n {
+		stats.extreme = true
+		stats.warnings = append(stats.warnings, fmt.Sprintf("extreme truncation: all %d earlier messages were dropped to fit the context window", truncated))
+	}
+
+	stats.length = stats.tokens
+	if truncated > 0 {
+		if totalLen == 0 {
+			var err error
+			totalLen, err = countTokens(msgs)
+			if err != nil {
+				return "", nil, promptStats{}, err
+			}
+		}
+
+		kept := stats.tokens - markerTokens
+		stats.length = totalLen
+		stats.removed = max(totalLen-kept, 0)
+	}
+
+	// when deduplicating, an image referenced by several messages is placed
+	// once, at its first [img] placeholder or else its first reference
+	var owners map[[32]byte]imageRef
+	if envconfig.DuplicateImages() == "dedupe" {
+		owners = imageOwners(final[first:])
+	}
+
+	for i := first; i < len(final); i++ {
+		msg := final[i]
 		if slices.Contains(m.Config.ModelFamilies, "mllama") && len(msg.Images) > 1 {
-			return "", nil, errors.New("this model only supports one image while more than one image requested")
+			return "", nil, promptStats{}, fmt.Errorf("%w: this model only supports one image while more than one image requested", errTooManyImages)
 		}
 
-		var prefix string
+		var tags string
 		prompt := msg.Content
 
-		for _, i := range msg.Images {
+		for j, img := range msg.Images {
+			if owners != nil && owners[sha256.Sum256(img)] != (imageRef{msg: i - first, image: j}) {
+				prompt = strings.Replace(prompt, "[img]", "", 1)
+				if m.ProjectorPaths != nil {
+					stats.tokens -= imageTokenCount(imgCost, img)
+				}
+				continue
+			}
+
 			imgData := llm.ImageData{
 				ID:   len(images),
-				Data: i,
+				Data: img,
 			}
 
 			imgTag := fmt.Sprintf("[img-%d]", imgData.ID)
 			if !strings.Contains(prompt, "[img]") {
-				prefix += imgTag
+				tags += imgTag
 			} else {
 				prompt = strings.Replace(prompt, "[img]", imgTag, 1)
 			}
 
 			images = append(images, imgData)
+			if m.ProjectorPaths != nil {
+				stats.imageTokens = append(stats.imageTokens, imageTokenCount(imgCost, img))
+			} else {
+				stats.imageTokens = append(stats.imageTokens, 0)
+			}
 		}
-		msgs[currMsgIdx+cnt].Content = prefix + prompt
+
+		if opts.ImagePlacement == "suffix" {
+			final[i].Content = prompt + tags
+		} else {
+			final[i].Content = tags + prompt
+		}
+	}
+
+	// only images which survived truncation count against the model's limit
+	if maxImages := opts.MaxImagesTotal; maxImages > 0 && len(images) > maxImages {
+		return "", nil, promptStats{}, fmt.Errorf("%w: %d images exceeds the model limit of %d", errTooManyImages, len(images), maxImages)
+	}
+
+	// the marker is inserted where messages were dropped, after the first
+	// message and any other messages always kept, unless configured to
+	// precede the kept intermediate messages, but never between a tool call
+	// and its results. A marker left in the conversation by an earlier
+	// truncation is replaced rather than repeated
+	if marker != nil {
+		// i is the index of the inserted marker once it and any markers from
+		// the conversation are removed. The latest message is never removed,
+		// even if it reads like a marker
+		isSkipMarker := skipMarkerMatcher(markerFormat, markerRole)
+		i := markerAt
+		rest := make([]api.Message, 0, len(final))
+		for j, msg := range final {
+			if j == markerAt {
+				continue
+			}
+
+			if j < len(final)-1 && isSkipMarker(msg) {
+				if j < markerAt {
+					i--
+				}
+				continue
+			}
+
+			rest = append(rest, msg)
+		}
+		final = rest
+
+		// before_intermediates moves the marker past system messages kept
+		// after the dropped messages to precede the first kept conversation
+		// message, or the latest message when none were kept
+		if envconfig.SkipMarkerPosition() == "before_intermediates" {
+			for i < len(final)-1 && final[i].Role == "system" {
+				i++
+			}
+		}
+
+		final = slices.Insert(final, toolExchangeBoundary(final, i), *marker)
+	}
+
+	stats.messages, stats.kept = len(msgs), len(final)
+	if marker != nil {
+		stats.kept--
 	}
 
 	// truncate any messages that do not fit into the context window
 	var b bytes.Buffer
-	thinkVal := false
-	if think != nil {
-		thinkVal = *think
+	if err := execute(&b, template.Values{Messages: final, Tools: tools, Think: thinkVal, IsThinkSet: think != nil}); err != nil {
+		return "", nil, promptStats{}, err
 	}
-	if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[currMsgIdx:]...), Tools: tools, Think: thinkVal, IsThinkSet: think != nil}); err != nil {
-		return "", nil, err
+
+	// a template which renders nothing from messages is almost certainly
+	// broken, so don't run inference on an empty prompt
+	if strings.TrimSpace(b.String()) == "" && slices.ContainsFunc(final, func(msg api.Message) bool { return strings.TrimSpace(msg.Content) != "" }) {
+		if envconfig.EmptyPrompt() != "allow" {
+			return "", nil, promptStats{}, errEmptyPrompt
+		}
+
+		slog.Warn("template rendered an empty prompt", "messages", len(final))
+		stats.warnings = append(stats.warnings, "template rendered an empty prompt from non-empty messages")
+	}
+
+	// messages with roles the template doesn't handle are silently skipped
+	roles, err := unrenderedRoles(m.Template, final)
+	if err != nil {
+		return "", nil, promptStats{}, err
+	}
+
+	for _, role := range roles {
+		if envconfig.UnknownRoles() == "error" {
+			return "", nil, promptStats{}, fmt.Errorf("%w %q", errUnknownRole, role)
+		}
+
+		slog.Warn("template does not render role, messages will be skipped", "role", role)
+		stats.warnings = append(stats.warnings, fmt.Sprintf("template does not render role %q, messages with this role were skipped", role))
+	}
+
+	stats.templateDuration = time.Duration(templateTime.Load())
+	stats.tokenizeDuration = time.Duration(tokenizeTime.Load())
+	stats.tokenizeCalls = int(tokenizeCalls.Load())
+
+	return b.String(), images, stats, nil
+}
+
+// imageRef identifies an image by the index of its message and its index
+// within the message
+type imageRef struct {
+	msg, image int
+}
+
+// imageOwners returns the reference which places each distinct image in
+// msgs: the first reference with an [img] placeholder, or else the first
+// reference
+func imageOwners(msgs []api.Message) map[[32]byte]imageRef {
+	owners := make(map[[32]byte]imageRef)
+	explicit := make(map[[32]byte]bool)
+	for i, msg := range msgs {
+		placeholders := strings.Count(msg.Content, "[img]")
+		for j, img := range msg.Images {
+			key := sha256.Sum256(img)
+			if _, ok := owners[key]; !ok || (j < placeholders && !explicit[key]) {
+				owners[key] = imageRef{msg: i, image: j}
+				explicit[key] = j < placeholders
+			}
+		}
 	}
 
-	return b.String(), images, nil
+	return owners
+}
+
+// countCandidates returns count(i) for each i in candidates, counting up to
+// workers candidates concurrently
+func countCandidates(candidates []int, workers int, count func(i int) (int, error)) ([]int, error) {
+	counts := make([]int, len(candidates))
+	if workers <= 1 {
+		for k, i := range candidates {
+			n, err := count(i)
+			if err != nil {
+				return nil, err
+			}
+			counts[k] = n
+		}
+
+		return counts, nil
+	}
+
+	var g errgroup.Group
+	g.SetLimit(workers)
+	for k, i := range candidates {
+		g.Go(func() error {
+			n, err := count(i)
+			counts[k] = n
+			return err
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// trimTools returns a copy of tools without function and parameter
+// descriptions
+func trimTools(tools []api.Tool) []api.Tool {
+	trimmed := make([]api.Tool, len(tools))
+	for i, tool := range tools {
+		tool.Function.Description = ""
+
+		properties := tool.Function.Parameters.Properties
+		tool.Function.Parameters.Properties = maps.Clone(properties)
+		for name, property := range properties {
+			property.Description = ""
+			tool.Function.Parameters.Properties[name] = property
+		}
+
+		trimmed[i] = tool
+	}
+
+	return trimmed
+}
+
+// unrenderedRoles returns the roles of msgs which tmpl doesn't render, found
+// by rendering a probe message for each role
+func unrenderedRoles(tmpl *template.Template, msgs []api.Message) ([]string, error) {
+	const probe = "<|role-probe|>"
+
+	var roles []string
+	for _, msg := range msgs {
+		if slices.Contains(roles, msg.Role) {
+			continue
+		}
+		roles = append(roles, msg.Role)
+	}
+
+	var unrendered []string
+	for _, role := range roles {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, template.Values{Messages: []api.Message{{Role: role, Content: probe}}}); err != nil {
+			return nil, err
+		}
+
+		if !strings.Contains(b.String(), probe) {
+			unrendered = append(unrendered, role)
+		}
+	}
+
+	return unrendered, nil
+}
+
+// truncationClass returns the truncation strategy for a conversation of n
+// messages. classes is a comma separated list of min:strategy pairs and the
+// pair with the largest min not exceeding n is selected. A head_tail strategy
+// may be followed by the number of messages to keep from the head and tail,
+// as in min:head_tail:head:tail
+func truncationClass(classes string, n int) (strategy string, head, tail int) {
+	best := -1
+	for class := range strings.SplitSeq(classes, ",") {
+		fields := strings.Split(strings.TrimSpace(class), ":")
+		if len(fields) < 2 {
+			continue
+		}
+
+		m, err := strconv.Atoi(fields[0])
+		if err != nil {
+			slog.Warn("invalid truncation class", "class", class, "error", err)
+			continue
+		}
+
+		var h, t int
+		if len(fields) == 4 {
+			h, err = strconv.Atoi(fields[2])
+			if err == nil {
+				t, err = strconv.Atoi(fields[3])
+			}
+		} else if len(fields) != 2 {
+			err = errors.New("expected min:strategy or min:head_tail:head:tail")
+		}
+		if err != nil {
+			slog.Warn("invalid truncation class", "class", class, "error", err)
+			continue
+		}
+
+		if m <= n && m > best {
+			best, strategy, head, tail = m, fields[1], h, t
+		}
+	}
+
+	return strategy, head, tail
+}
+
+// keepSet identifies the messages truncation always keeps besides system
+// messages
+type keepSet struct {
+	// refs are the IDs of messages the latest message references
+	refs []string
+	// pinned is the index of the message after the pinned messages at the
+	// start of the conversation
+	pinned int
+	// toolCalls are the IDs of tool calls kept along with their results
+	toolCalls []string
+}
+
+// pinnedMessages returns the index of the message after the first n
+// conversation messages of msgs, or len(msgs) when there are fewer
+func pinnedMessages(msgs []api.Message, n int) int {
+	for i, msg := range msgs {
+		if n <= 0 {
+			return i
+		}
+
+		if msg.Role != "system" {
+			n--
+		}
+	}
+
+	return len(msgs)
+}
+
+// keptMessage reports whether msg, at index i of the conversation, is always
+// kept by truncation, as system messages, pinned messages, messages whose ID
+// is referenced and kept tool calls and their results are
+func keptMessage(i int, msg api.Message, keep keepSet) bool {
+	if msg.Role == "system" || i < keep.pinned || (msg.ID != "" && slices.Contains(keep.refs, msg.ID)) {
+		return true
+	}
+
+	if msg.Role == "tool" && msg.ToolCallID != "" && slices.Contains(keep.toolCalls, msg.ToolCallID) {
+		return true
+	}
+
+	return slices.ContainsFunc(keep.toolCalls, func(id string) bool { return hasToolCall(msg, id) })
+}
+
+// systemMessages returns the messages of msgs which are always kept
+func systemMessages(msgs []api.Message, keep keepSet) []api.Message {
+	system := make([]api.Message, 0)
+	for i, msg := range msgs {
+		if keptMessage(i, msg, keep) {
+			system = append(system, msg)
+		}
+	}
+
+	return system
+}
+
+// messageTokens returns the number of tokens in msg rendered on its own by
+// execute with the model's template. Counts are cached across requests when
+// enabled.
+func messageTokens(ctx context.Context, m *Model, execute func(io.Writer, template.Values) error, tokenize tokenizeFunc, msg api.Message, think, isThinkSet bool) (int, error) {
+	var b bytes.Buffer
+	if err := execute(&b, template.Values{Messages: []api.Message{msg}, Think: think, IsThinkSet: isThinkSet}); err != nil {
+		return 0, err
+	}
+
+	if n, ok := messageTokenCache.get(m.ModelPath, b.String()); ok {
+		return n, nil
+	}
+
+	s, err := tokenize(ctx, b.String())
+	if err != nil {
+		return 0, err
+	}
+
+	messageTokenCache.put(m.ModelPath, b.String(), len(s))
+	return len(s), nil
+}
+
+// summaryTokens limits the length of a summary of dropped messages
+const summaryTokens = 256
+
+// summarizer returns a [Model.Summarize] hook which asks the model running on
+// r to summarize the dropped messages
+func summarizer(r llm.LlamaServer, m *Model, opts *api.Options) func(context.Context, []api.Message) (string, error) {
+	return func(ctx context.Context, msgs []api.Message) (string, error) {
+		var sb strings.Builder
+		sb.WriteString("Summarize the following conversation in a few sentences, keeping any facts, decisions and open questions.\n\n")
+		for _, msg := range msgs {
+			fmt.Fprintf(&sb, "%s: %s\n", msg.Role, msg.Content)
+		}
+
+		var b bytes.Buffer
+		if err := m.Template.Execute(&b, template.Values{Messages: []api.Message{{Role: "user", Content: sb.String()}}}); err != nil {
+			return "", err
+		}
+
+		summaryOpts := *opts
+		summaryOpts.NumPredict = summaryTokens
+
+		var summary strings.Builder
+		if err := r.Completion(ctx, llm.CompletionRequest{Prompt: b.String(), Options: &summaryOpts}, func(cr llm.CompletionResponse) {
+			summary.WriteString(cr.Content)
+		}); err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(summary.String()), nil
+	}
+}
+
+// defaultImageTokens is the number of prompt tokens counted for each image of
+// a vision model whose family isn't in imageTokenCosts. Clip images are
+// represented as 768 tokens, each an embedding
+const defaultImageTokens = 768
+
+// imageTokenCost describes the number of prompt tokens an image costs: base,
+// plus tileTokens for each tile of tileSize pixels square covering the image,
+// up to maxTiles tiles when it is set
+type imageTokenCost struct {
+	base       int
+	tileSize   int
+	tileTokens int
+	maxTiles   int
+}
+
+// imageTokenCosts are the image token costs of vision model families which
+// don't represent images as defaultImageTokens embeddings
+var imageTokenCosts = map[string]imageTokenCost{
+	// images are resized to fit up to 4 tiles of 560 pixels, each encoded as
+	// 1601 embeddings
+	"mllama": {tileSize: 560, tileTokens: 1601, maxTiles: 4},
+	// each 28 pixel square of the image is merged into a single embedding
+	"qwen2vl":  {tileSize: 28, tileTokens: 1},
+	"qwen25vl": {tileSize: 28, tileTokens: 1},
+}
+
+// imageCost returns the image token cost of m's model family, overridden by
+// the image options of opts
+func imageCost(m *Model, opts *api.Options) imageTokenCost {
+	// TODO: Ideally we would compute this from the projector metadata but some pieces are implementation dependent
+	cost := imageTokenCost{base: defaultImageTokens}
+	for _, family := range m.Config.ModelFamilies {
+		if c, ok := imageTokenCosts[family]; ok {
+			cost = c
+			break
+		}
+	}
+
+	if opts.ImageBaseTokens > 0 {
+		cost.base = opts.ImageBaseTokens
+	}
+
+	if opts.ImageTileSize > 0 && opts.ImageTileTokens > 0 {
+		cost.tileSize = opts.ImageTileSize
+		cost.tileTokens = opts.ImageTileTokens
+		cost.maxTiles = 0
+	}
+
+	return cost
+}
+
+// imageTokenCount returns the number of prompt tokens counted for an image
+// of a vision model with the given cost
+func imageTokenCount(cost imageTokenCost, img api.ImageData) int {
+	n := cost.base
+	if size := cost.tileSize; size > 0 && cost.tileTokens > 0 {
+		config, _, err := image.DecodeConfig(bytes.NewReader(img))
+		if err != nil {
+			// the runner rejects images which can't be decoded
+			return n
+		}
+
+		tilesX := (config.Width + size - 1) / size
+		tilesY := (config.Height + size - 1) / size
+		tiles := tilesX * tilesY
+		if cost.maxTiles > 0 {
+			tiles = min(tiles, cost.maxTiles)
+		}
+		n += tiles * cost.tileTokens
+	}
+
+	return n
+}
+
+// imagesTokenCount returns the number of prompt tokens counted for images
+func imagesTokenCount(cost imageTokenCost, images []api.ImageData) int {
+	var n int
+	for _, img := range images {
+		n += imageTokenCount(cost, img)
+	}
+	return n
+}
+
+// headTail returns the system, pinned and referenced messages of msgs along
+// with the first head and last tail conversation messages, counting the
+// latest message as part of the tail. at is the position in kept where the
+// dropped messages were removed.
+func headTail(msgs []api.Message, keep keepSet, head, tail int) (kept []api.Message, at int, dropped []api.Message) {
+	turns := droppedTurns(msgs[:len(msgs)-1], keep)
+
+	var turn int
+	for i, msg := range msgs {
+		if keptMessage(i, msg, keep) || i == len(msgs)-1 {
+			kept = append(kept, msg)
+			continue
+		}
+
+		if turn < head || turn >= turns-tail+1 {
+			kept = append(kept, msg)
+		} else {
+			if len(dropped) == 0 {
+				at = len(kept)
+			}
+			dropped = append(dropped, msg)
+		}
+		turn++
+	}
+
+	return kept, at, dropped
+}
+
+// validateTools checks that each tool serializes to JSON so it can be rendered
+// into the prompt. Tools which don't are rejected, or dropped when
+// OLLAMA_INVALID_TOOLS is "drop"
+func validateTools(tools []api.Tool) ([]api.Tool, error) {
+	var valid []api.Tool
+	for _, tool := range tools {
+		if _, err := json.Marshal(tool); err != nil {
+			if envconfig.InvalidTools() != "drop" {
+				return nil, fmt.Errorf("%w: %q: %v", errInvalidTool, tool.Function.Name, err)
+			}
+
+			slog.Warn("dropping tool with parameters that can't be serialized", "tool", tool.Function.Name, "error", err)
+			continue
+		}
+		valid = append(valid, tool)
+	}
+
+	return valid, nil
+}
+
+// toolsMessage returns a system message describing tools for models whose
+// template does not render them
+func toolsMessage(tools api.Tools) api.Message {
+	return api.Message{
+		Role:    "system",
+		Content: "You have access to the following tools:\n" + tools.String() + "\nTo call a tool, respond with a JSON object with the tool's \"name\" and \"arguments\".",
+	}
+}
+
+// toolCallContent returns the content of msg followed by each of its tool
+// calls as a JSON object with the tool's name and arguments, one per line
+func toolCallContent(msg api.Message) string {
+	lines := make([]string, 0, len(msg.ToolCalls)+1)
+	if msg.Content != "" {
+		lines = append(lines, msg.Content)
+	}
+
+	for _, call := range msg.ToolCalls {
+		b, err := json.Marshal(struct {
+			Name      string                        `json:"name"`
+			Arguments api.ToolCallFunctionArguments `json:"arguments"`
+		}{call.Function.Name, call.Function.Arguments})
+		if err != nil {
+			// arguments decoded from JSON always serialize
+			continue
+		}
+		lines = append(lines, string(b))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// normalizeContent converts line endings to \n, removes trailing whitespace
+// from each line, collapses consecutive blank lines and trims leading and
+// trailing blank lines. Indentation is preserved.
+func normalizeContent(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+
+	lines := strings.Split(s, "\n")
+	normalized := lines[:0]
+	for _, line := range lines {
+		line = strings.TrimRightFunc(line, unicode.IsSpace)
+		if line == "" && len(normalized) > 0 && normalized[len(normalized)-1] == "" {
+			continue
+		}
+		normalized = append(normalized, line)
+	}
+
+	return strings.Trim(strings.Join(normalized, "\n"), "\n")
+}
+
+// dropToolResults removes the tool results in kept which reference a tool
+// call that is not in kept. The latest message is never removed. It returns
+// the remaining messages and the number removed.
+func dropToolResults(kept []api.Message) ([]api.Message, int) {
+	calls := make(map[string]bool)
+	for _, msg := range kept {
+		for _, call := range msg.ToolCalls {
+			if call.ID != "" {
+				calls[call.ID] = true
+			}
+		}
+	}
+
+	resolved := make([]api.Message, 0, len(kept))
+	for i, msg := range kept {
+		if msg.Role == "tool" && msg.ToolCallID != "" && !calls[msg.ToolCallID] && i < len(kept)-1 {
+			slog.Debug("dropping tool result for truncated tool call", "tool_call_id", msg.ToolCallID)
+			continue
+		}
+		resolved = append(resolved, msg)
+	}
+
+	return resolved, len(kept) - len(resolved)
+}
+
+// orphanedCalls returns the IDs of tool calls in msgs which are not in kept
+// while one of their results is
+func orphanedCalls(msgs, kept []api.Message) []string {
+	calls := make(map[string]bool)
+	for _, msg := range kept {
+		for _, call := range msg.ToolCalls {
+			calls[call.ID] = true
+		}
+	}
+
+	var ids []string
+	for _, msg := range kept {
+		id := msg.ToolCallID
+		if msg.Role != "tool" || id == "" || calls[id] {
+			continue
+		}
+
+		if slices.ContainsFunc(msgs, func(m api.Message) bool { return hasToolCall(m, id) }) {
+			ids = append(ids, id)
+			calls[id] = true
+		}
+	}
+
+	return ids
+}
+
+// hasToolCall reports whether msg makes the tool call with the given ID
+func hasToolCall(msg api.Message, id string) bool {
+	return slices.ContainsFunc(msg.ToolCalls, func(call api.ToolCall) bool { return call.ID == id })
+}
+
+// droppedMessages returns the messages of msgs which truncation may drop
+func droppedMessages(msgs []api.Message, keep keepSet) []api.Message {
+	var dropped []api.Message
+	for i, msg := range msgs {
+		if !keptMessage(i, msg, keep) {
+			dropped = append(dropped, msg)
+		}
+	}
+
+	return dropped
+}
+
+// droppedTurns returns the number of messages in msgs which truncation may
+// drop. System, pinned and referenced messages are always kept so they do not
+// count.
+func droppedTurns(msgs []api.Message, keep keepSet) int {
+	var turns int
+	for i, msg := range msgs {
+		if !keptMessage(i, msg, keep) {
+			turns++
+		}
+	}
+
+	return turns
+}
+
+// clipEllipsis replaces the middle of clipped message content
+const clipEllipsis = "\n...\n"
+
+// clipContent shortens content to at most limit tokens, keeping its start and
+// end around an ellipsis. It returns the number of tokens in the original
+// content.
+func clipContent(ctx context.Context, tokenize tokenizeFunc, content string, limit int) (string, int, error) {
+	s, err := tokenize(ctx, content)
+	if err != nil {
+		return "", 0, err
+	}
+
+	n := len(s)
+	if n <= limit {
+		return content, n, nil
+	}
+
+	// estimate how much of the content fits from its average token length,
+	// then shorten it until it does
+	runes := []rune(content)
+	keep := len(runes) * limit / n
+	for keep > 0 {
+		head := keep / 2
+		clipped := string(runes[:head]) + clipEllipsis + string(runes[len(runes)-(keep-head):])
+
+		s, err := tokenize(ctx, clipped)
+		if err != nil {
+			return "", 0, err
+		}
+
+		if len(s) <= limit {
+			return clipped, n, nil
+		}
+
+		keep = min(keep-1, keep*9/10)
+	}
+
+	return clipEllipsis, n, nil
+}
+
+// toolExchangeBoundary returns the position nearest to at where a message can
+// be inserted into msgs without separating a tool call from its results. The
+// position moves before the tool call, or after the results if the call isn't
+// in msgs, unless the results end the conversation.
+func toolExchangeBoundary(msgs []api.Message, at int) int {
+	if at >= len(msgs) || msgs[at].Role != "tool" {
+		return at
+	}
+
+	i := at
+	for i > 0 && msgs[i-1].Role == "tool" {
+		i--
+	}
+
+	if i > 0 && msgs[i-1].Role == "assistant" && len(msgs[i-1].ToolCalls) > 0 {
+		return i - 1
+	}
+
+	j := at
+	for j < len(msgs) && msgs[j].Role == "tool" {
+		j++
+	}
+
+	if j < len(msgs) {
+		return j
+	}
+
+	return at
+}
+
+// skipMarker renders the message inserted in place of truncated messages. The
+// {turns} and {tokens} placeholders in format are replaced with the number of
+// messages and the approximate number of tokens that were removed.
+func skipMarker(format, role string, turns, tokens int) *api.Message {
+	r := strings.NewReplacer("{turns}", strconv.Itoa(turns), "{tokens}", strconv.Itoa(tokens))
+	return &api.Message{Role: role, Content: r.Replace(format)}
+}
+
+// skipMarkerMatcher reports whether a message is a skip marker rendered from
+// format with role by an earlier truncation, whatever the number of turns and
+// tokens it reports. Only system messages are matched unless
+// OLLAMA_SKIP_MARKER_REUSE is "role", so user content which happens to read
+// like the marker isn't mistaken for it, and none when it is "off".
+func skipMarkerMatcher(format, role string) func(api.Message) bool {
+	switch mode := envconfig.SkipMarkerReuse(); {
+	case format == "", mode == "off", role != "system" && mode != "role":
+		return func(api.Message) bool { return false }
+	}
+
+	r := strings.NewReplacer(regexp.QuoteMeta("{turns}"), `\d+`, regexp.QuoteMeta("{tokens}"), `\d+`)
+	re := regexp.MustCompile("^" + r.Replace(regexp.QuoteMeta(format)) + "$")
+	return func(msg api.Message) bool {
+		return msg.Role == role && re.MatchString(msg.Content)
+	}
 }
@@ -2,7 +2,16 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 
@@ -209,7 +218,7 @@ func TestChatPrompt(t *testing.T) {
 			model := tt.model
 			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}}
 			think := false
-			prompt, images, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, tt.msgs, nil, &think)
+			prompt, images, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, tt.msgs, nil, &think)
 			if tt.error == nil && err != nil {
 				t.Fatal(err)
 			} else if tt.error != nil && err != tt.error {
@@ -238,3 +247,2638 @@ func TestChatPrompt(t *testing.T) {
 		})
 	}
 }
+
+func TestChatPromptSkipMarker(t *testing.T) {
+	t.Setenv("OLLAMA_SKIP_MARKER", "[{turns} turns, ~{tokens} tokens removed]")
+
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "You are the Test Who Lived."},
+		{Role: "user", Content: "You're a test, Harry!"},
+		{Role: "assistant", Content: "I-I'm a what?"},
+		{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+	}
+
+	cases := []struct {
+		name   string
+		limit  int
+		expect string
+	}{
+		{
+			name:   "truncated",
+			limit:  25,
+			expect: "system: You are the Test Who Lived.\n\n[2 turns, ~9 tokens removed]\nuser: A test. And a thumping good one at that, I'd wager.\n",
+		},
+		{
+			name:   "not truncated",
+			limit:  30,
+			expect: "system: You are the Test Who Lived.\nuser: You're a test, Harry!\nassistant: I-I'm a what?\nuser: A test. And a thumping good one at that, I'd wager.\n",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}}
+			prompt, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatPromptSkipMarkerOptions(t *testing.T) {
+	t.Setenv("OLLAMA_SKIP_MARKER", "[removed]")
+
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "One one one"},
+		{Role: "assistant", Content: "Two two two"},
+		{Role: "user", Content: "Three"},
+		{Role: "assistant", Content: "Four"},
+		{Role: "user", Content: "Five"},
+	}
+
+	cases := []struct {
+		name   string
+		opts   api.Options
+		msgs   []api.Message
+		expect string
+	}{
+		{
+			name:   "environment",
+			msgs:   msgs,
+			expect: "system: Be brief.\n\n[removed]\nuser: Three\nassistant: Four\nuser: Five\n",
+		},
+		{
+			name:   "text and role",
+			opts:   api.Options{SkipMarker: "({turns} skipped)", SkipMarkerRole: "user"},
+			msgs:   msgs,
+			expect: "system: Be brief.\nuser: (2 skipped)\n\nThree\nassistant: Four\nuser: Five\n",
+		},
+		{
+			name: "earlier marker",
+			opts: api.Options{SkipMarker: "({turns} skipped)"},
+			msgs: slices.Insert(slices.Clone(msgs), 1, api.Message{Role: "system", Content: "(4 skipped)"}),
+			// the earlier marker is counted until it is replaced
+			expect: "system: Be brief.\n\n(3 skipped)\nassistant: Four\nuser: Five\n",
+		},
+		{
+			name:   "earlier marker kept",
+			opts:   api.Options{SkipMarker: "({turns} skipped)"},
+			msgs:   []api.Message{msgs[0], {Role: "system", Content: "(4 skipped)"}, msgs[4], msgs[5]},
+			expect: "system: Be brief.\n\n(4 skipped)\nassistant: Four\nuser: Five\n",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := tt.opts
+			opts.NumCtx = 12
+			prompt, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, tt.msgs, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatPromptSkipMarkerReuse(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the user's "..." reads like the marker but isn't one
+	msgs := []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "One one one"},
+		{Role: "assistant", Content: "Two two two"},
+		{Role: "user", Content: "..."},
+		{Role: "assistant", Content: "Four"},
+		{Role: "user", Content: "Five"},
+	}
+
+	cases := []struct {
+		name   string
+		reuse  string
+		role   string
+		expect string
+	}{
+		{
+			name:   "system marker",
+			expect: "system: Be brief.\n\n...\nuser: ...\nassistant: Four\nuser: Five\n",
+		},
+		{
+			name:   "user marker",
+			role:   "user",
+			expect: "system: Be brief.\nuser: ...\n\n...\nassistant: Four\nuser: Five\n",
+		},
+		{
+			name:   "user marker matching role",
+			reuse:  "role",
+			role:   "user",
+			expect: "system: Be brief.\nuser: ...\nassistant: Four\nuser: Five\n",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_SKIP_MARKER_REUSE", tt.reuse)
+
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 12}, SkipMarker: "...", SkipMarkerRole: tt.role}
+			prompt, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expect, prompt); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatPromptSummarize(t *testing.T) {
+	t.Setenv("OLLAMA_SKIP_MARKER", "[removed]")
+
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "One one one"},
+		{Role: "assistant", Content: "Two two two"},
+		{Role: "user", Content: "Three"},
+		{Role: "assistant", Content: "Four"},
+		{Role: "user", Content: "Five"},
+	}
+
+	cases := []struct {
+		name       string
+		truncation string
+		summary    string
+		err        error
+		expect     string
+	}{
+		{
+			name:    "summary",
+			summary: "Counted",
+			expect:  "system: Be brief.\n\nCounted\nuser: Three\nassistant: Four\nuser: Five\n",
+		},
+		{
+			name:       "head tail",
+			truncation: "head_tail",
+			summary:    "Counted",
+			expect:     "system: Be brief.\n\nCounted\nuser: Five\n",
+		},
+		{
+			name:   "error",
+			err:    errors.New("summarizer unavailable"),
+			expect: "system: Be brief.\n\n[removed]\nuser: Three\nassistant: Four\nuser: Five\n",
+		},
+		{
+			name:    "too long",
+			summary: strings.Repeat("Counted ", 10),
+			expect:  "system: Be brief.\n\n[removed]\nuser: Three\nassistant: Four\nuser: Five\n",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var dropped []api.Message
+			model := Model{Template: tmpl, Summarize: func(ctx context.Context, msgs []api.Message) (string, error) {
+				dropped = msgs
+				return tt.summary, tt.err
+			}}
+
+			opts := api.Options{Runner: api.Runner{NumCtx: 12}, Truncation: tt.truncation}
+			prompt, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expect, prompt); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			if len(dropped) == 0 || dropped[0].Content != msgs[1].Content {
+				t.Errorf("expected the summarizer to receive the dropped messages, got %v", dropped)
+			}
+		})
+	}
+}
+
+func TestChatPromptLatestOverflow(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: strings.Repeat("word ", 100)},
+	}
+
+	t.Run("runner", func(t *testing.T) {
+		model := Model{Template: tmpl}
+		opts := api.Options{Runner: api.Runner{NumCtx: 10}}
+		_, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stats.truncation != api.TruncationLatestTruncated {
+			t.Errorf("expected truncation %q, got %q", api.TruncationLatestTruncated, stats.truncation)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		model := Model{Template: tmpl}
+		opts := api.Options{Runner: api.Runner{NumCtx: 10}, LatestOverflow: "error"}
+		_, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+		if !errors.Is(err, errContextTooSmall) {
+			t.Fatalf("expected %v, got %v", errContextTooSmall, err)
+		}
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		model := Model{Template: tmpl}
+		opts := api.Options{Runner: api.Runner{NumCtx: 10}, LatestOverflow: "truncate"}
+		prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect := "system: Be brief.\nuser: word word \n...\n word word \n"
+		if diff := cmp.Diff(expect, prompt); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if stats.tokens > opts.NumCtx {
+			t.Errorf("expected at most %d tokens, got %d", opts.NumCtx, stats.tokens)
+		}
+
+		if len(stats.warnings) != 1 {
+			t.Errorf("expected a warning, got %v", stats.warnings)
+		}
+	})
+}
+
+func TestChatPromptSystemOverflow(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: strings.Repeat("You are the Test Who Lived. ", 4)},
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "Hello!"},
+	}
+
+	t.Run("error", func(t *testing.T) {
+		t.Setenv("OLLAMA_SYSTEM_OVERFLOW", "error")
+
+		model := Model{Template: tmpl}
+		opts := api.Options{Runner: api.Runner{NumCtx: 10}}
+		_, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+		if !errors.Is(err, errSystemTooLong) {
+			t.Fatalf("expected %v, got %v", errSystemTooLong, err)
+		}
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		t.Setenv("OLLAMA_SYSTEM_OVERFLOW", "truncate")
+
+		model := Model{Template: tmpl}
+		opts := api.Options{Runner: api.Runner{NumCtx: 10}}
+		prompt, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(prompt, "system: Be brief.\nuser: Hello!\n"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+}
+
+func TestChatPromptHeadTail(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "Hello."},
+		{Role: "user", Content: "One"},
+		{Role: "assistant", Content: "Two"},
+		{Role: "user", Content: "Three"},
+		{Role: "assistant", Content: "Four"},
+		{Role: "user", Content: "Five"},
+		{Role: "assistant", Content: "Six"},
+		{Role: "user", Content: "Seven"},
+	}
+
+	cases := []struct {
+		name       string
+		limit      int
+		head, tail int
+		expect     string
+	}{
+		{
+			name:   "head and tail",
+			limit:  64,
+			head:   1,
+			tail:   2,
+			expect: "system: Hello.\nuser: One\nassistant: Six\nuser: Seven\n",
+		},
+		{
+			name:   "head and tail exceed messages",
+			limit:  64,
+			head:   5,
+			tail:   5,
+			expect: "system: Hello.\nuser: One\nassistant: Two\nuser: Three\nassistant: Four\nuser: Five\nassistant: Six\nuser: Seven\n",
+		},
+		{
+			name:   "tail truncated to fit",
+			limit:  7,
+			head:   1,
+			tail:   2,
+			expect: "system: Hello.\nuser: One\n\nSeven\n",
+		},
+		{
+			name:   "head truncated to fit",
+			limit:  4,
+			head:   2,
+			tail:   2,
+			expect: "system: Hello.\nuser: Seven\n",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}, Truncation: "head_tail", TruncateHead: tt.head, TruncateTail: tt.tail}
+			prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			if stats.tokens > tt.limit {
+				t.Errorf("prompt has %d tokens, exceeding limit %d", stats.tokens, tt.limit)
+			}
+		})
+	}
+}
+
+func TestChatPromptNormalizeContent(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	normalized := []api.Message{
+		{Role: "user", Content: "Hello!\n\n  How are you?"},
+	}
+
+	unnormalized := []api.Message{
+		{Role: "user", Content: "\r\nHello!  \r\n\r\n\r\n  How are you?\t\r\n"},
+	}
+
+	render := func(t *testing.T, msgs []api.Message) (string, int) {
+		t.Helper()
+
+		model := Model{Template: tmpl}
+		opts := api.Options{Runner: api.Runner{NumCtx: 64}}
+		prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return prompt, stats.tokens
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		t.Setenv("OLLAMA_NORMALIZE_CONTENT", "1")
+
+		prompt, tokens := render(t, slices.Clone(unnormalized))
+		expectPrompt, expectTokens := render(t, slices.Clone(normalized))
+		if diff := cmp.Diff(prompt, expectPrompt); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if tokens != expectTokens {
+			t.Errorf("expected %d tokens, got %d", expectTokens, tokens)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		prompt, _ := render(t, slices.Clone(unnormalized))
+		if diff := cmp.Diff(prompt, "user: "+unnormalized[0].Content+"\n"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+}
+
+func TestChatPromptToolOrphans(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}{{ range .ToolCalls }}{{ .Function.Name }}{{ end }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "You are helpful."},
+		{Role: "user", Content: "What's the weather?"},
+		{Role: "assistant", ToolCalls: []api.ToolCall{{ID: "call_1", Function: api.ToolCallFunction{Name: "get_weather"}}}},
+		{Role: "tool", Content: "Sunny.", ToolCallID: "call_1"},
+		{Role: "user", Content: "Thanks!"},
+	}
+
+	cases := []struct {
+		name   string
+		mode   string
+		expect string
+	}{
+		{
+			name:   "default",
+			expect: "system: You are helpful.\ntool: Sunny.\nuser: Thanks!\n",
+		},
+		{
+			name:   "drop",
+			mode:   "drop",
+			expect: "system: You are helpful.\nuser: Thanks!\n",
+		},
+		{
+			name:   "keep",
+			mode:   "keep",
+			expect: "system: You are helpful.\nassistant: get_weather\ntool: Sunny.\nuser: Thanks!\n",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_TOOL_ORPHANS", tt.mode)
+
+			// the tool call doesn't fit so it is truncated while its result is kept
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 8}}
+			prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			if tokens := len(strings.Fields(prompt)); stats.tokens != tokens {
+				t.Errorf("expected %d tokens, got %d", tokens, stats.tokens)
+			}
+		})
+	}
+}
+
+func TestChatPromptToolOrphansOverBudget(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}{{ range .ToolCalls }}{{ .Function.Name }}{{ end }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("OLLAMA_TOOL_ORPHANS", "keep")
+
+	call := api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{ID: "call_1", Function: api.ToolCallFunction{Name: "get_weather"}}}}
+	result := api.Message{Role: "tool", Content: "Sunny.", ToolCallID: "call_1"}
+
+	t.Run("earlier message dropped", func(t *testing.T) {
+		msgs := []api.Message{
+			{Role: "user", Content: "Hi"},
+			{Role: "assistant", Content: "Hello"},
+			{Role: "user", Content: "Weather?"},
+			call,
+			result,
+			{Role: "user", Content: "Thanks!"},
+		}
+
+		// the kept tool call takes the place of the tail messages before it
+		model := Model{Template: tmpl}
+		opts := api.Options{Runner: api.Runner{NumCtx: 8}, Truncation: "head_tail", TruncateHead: 1, TruncateTail: 2}
+		prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(prompt, "user: Hi\nassistant: get_weather\ntool: Sunny.\nuser: Thanks!\n"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if stats.tokens != 8 {
+			t.Errorf("expected 8 tokens, got %d", stats.tokens)
+		}
+
+		if stats.truncation != api.TruncationIntermediateDropped {
+			t.Errorf("expected truncation %q, got %q", api.TruncationIntermediateDropped, stats.truncation)
+		}
+
+		if stats.removed != 4 {
+			t.Errorf("expected 4 tokens removed, got %d", stats.removed)
+		}
+	})
+
+	msgs := []api.Message{
+		{Role: "system", Content: "You are helpful."},
+		{Role: "user", Content: "What's the weather?"},
+		call,
+		result,
+		{Role: "user", Content: "Thanks!"},
+	}
+
+	t.Run("exceeds context length", func(t *testing.T) {
+		// the tool call alone didn't fit, so keeping it with its result
+		// overflows the context length like system messages would
+		model := Model{Template: tmpl}
+		opts := api.Options{Runner: api.Runner{NumCtx: 8}}
+		prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(prompt, "system: You are helpful.\nassistant: get_weather\ntool: Sunny.\nuser: Thanks!\n"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if stats.truncation != api.TruncationLatestTruncated {
+			t.Errorf("expected truncation %q, got %q", api.TruncationLatestTruncated, stats.truncation)
+		}
+
+		if stats.removed != 4 {
+			t.Errorf("expected 4 tokens removed, got %d", stats.removed)
+		}
+	})
+
+	t.Run("exceeds context length with error", func(t *testing.T) {
+		model := Model{Template: tmpl}
+		opts := api.Options{Runner: api.Runner{NumCtx: 8}, LatestOverflow: "error"}
+		_, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+		if !errors.Is(err, errContextTooSmall) {
+			t.Fatalf("expected %v, got %v", errContextTooSmall, err)
+		}
+	})
+}
+
+func TestChatPromptImagePlacement(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		placement string
+		expect    string
+	}{
+		{
+			placement: "prefix",
+			expect:    "user: [img-0][img-1]Describe these.\n",
+		},
+		{
+			placement: "suffix",
+			expect:    "user: Describe these.[img-0][img-1]\n",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.placement, func(t *testing.T) {
+			msgs := []api.Message{
+				{Role: "user", Content: "Describe these.", Images: []api.ImageData{[]byte("one"), []byte("two")}},
+			}
+
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 64}, ImagePlacement: tt.placement}
+			prompt, images, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			if len(images) != 2 {
+				t.Errorf("expected 2 images, got %d", len(images))
+			}
+		})
+	}
+}
+
+func TestChatPromptEmpty(t *testing.T) {
+	tmpl, err := template.Parse(`<preamble>
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		mode   string
+		expect string
+		err    error
+	}{
+		{
+			name: "default",
+		},
+		{
+			name: "error",
+			mode: "error",
+			err:  errEmptyChat,
+		},
+		{
+			name:   "render",
+			mode:   "render",
+			expect: "<preamble>",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_EMPTY_CHAT", tt.mode)
+
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 64}}
+			prompt, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, nil, nil, nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatPromptSystemOnly(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "system", Content: "Greet the user."},
+	}
+
+	cases := []struct {
+		name   string
+		mode   string
+		expect string
+		err    error
+	}{
+		{
+			name:   "default",
+			expect: "system: You are a helpful assistant.\n\nGreet the user.\n",
+		},
+		{
+			name: "error",
+			mode: "error",
+			err:  errSystemOnly,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_SYSTEM_ONLY", tt.mode)
+
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 64}}
+			prompt, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidateTools(t *testing.T) {
+	var weather api.Tool
+	weather.Type = "function"
+	weather.Function.Name = "get_weather"
+
+	var broken api.Tool
+	broken.Type = "function"
+	broken.Function.Name = "broken"
+	broken.Function.Parameters.Items = func() {}
+
+	cases := []struct {
+		name   string
+		mode   string
+		expect []string
+		err    string
+	}{
+		{
+			name: "default",
+			err:  `tool parameters can't be serialized to JSON: "broken": json: unsupported type: func()`,
+		},
+		{
+			name:   "drop",
+			mode:   "drop",
+			expect: []string{"get_weather"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_INVALID_TOOLS", tt.mode)
+
+			tools, err := validateTools([]api.Tool{weather, broken})
+			if tt.err != "" {
+				if !errors.Is(err, errInvalidTool) || err.Error() != tt.err {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, tool := range tools {
+				names = append(names, tool.Function.Name)
+			}
+
+			if diff := cmp.Diff(names, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatPromptImageTokens(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "What is this?", Images: []api.ImageData{[]byte("small")}},
+		{Role: "assistant", Content: "A cat."},
+		{Role: "user", Content: "And this?", Images: []api.ImageData{bytes.Repeat([]byte("large"), 1024)}},
+	}
+
+	cases := []struct {
+		name       string
+		projectors []string
+		expect     []int
+	}{
+		{
+			name:       "vision",
+			projectors: []string{"vision"},
+			expect:     []int{768, 768},
+		},
+		{
+			name:   "no projector",
+			expect: []int{0, 0},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl, ProjectorPaths: tt.projectors}
+			opts := api.Options{Runner: api.Runner{NumCtx: 2048}}
+			prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(stats.imageTokens, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			var imageTokens int
+			for _, n := range stats.imageTokens {
+				imageTokens += n
+			}
+
+			if textTokens := len(strings.Fields(prompt)); stats.tokens != textTokens+imageTokens {
+				t.Errorf("expected %d tokens, got %d", textTokens+imageTokens, stats.tokens)
+			}
+		})
+	}
+}
+
+func TestChatPromptNoVision(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "What is [img] this?", Images: []api.ImageData{[]byte("cat")}},
+	}
+
+	cases := []struct {
+		name   string
+		mode   string
+		expect string
+		images int
+		err    error
+	}{
+		{name: "default", expect: "user: What is [img-0] this?\n", images: 1},
+		{name: "drop", mode: "drop", expect: "user: What is  this?\n"},
+		{name: "error", mode: "error", err: errNoVision},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_NO_VISION_IMAGES", tt.mode)
+
+			// the model has neither a projector nor a vision encoder
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 64}}
+			prompt, images, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if prompt != tt.expect {
+				t.Errorf("expected %q, got %q", tt.expect, prompt)
+			}
+
+			if len(images) != tt.images {
+				t.Errorf("expected %d images, got %d", tt.images, len(images))
+			}
+
+			if dropped := slices.Contains(stats.warnings, "model does not support images, images were dropped"); dropped != (tt.mode == "drop") {
+				t.Errorf("expected dropped images warning %t, got %v", tt.mode == "drop", stats.warnings)
+			}
+		})
+	}
+}
+
+func TestChatPromptImageTiles(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 1024, 512))); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "What is this?", Images: []api.ImageData{b.Bytes()}},
+	}
+
+	// a 1024x512 image is covered by 2 tiles of 512 pixels or 8 of 256
+	cases := []struct {
+		name   string
+		opts   api.Options
+		expect int
+	}{
+		{name: "flat", expect: 768},
+		{name: "base", opts: api.Options{ImageBaseTokens: 64}, expect: 64},
+		{name: "512 tiles", opts: api.Options{ImageBaseTokens: 64, ImageTileSize: 512, ImageTileTokens: 100}, expect: 64 + 2*100},
+		{name: "256 tiles", opts: api.Options{ImageBaseTokens: 64, ImageTileSize: 256, ImageTileTokens: 100}, expect: 64 + 8*100},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl, ProjectorPaths: []string{"vision"}}
+			opts := tt.opts
+			opts.NumCtx = 2048
+			prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff([]int{tt.expect}, stats.imageTokens); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			if expect := len(strings.Fields(prompt)) + tt.expect; stats.tokens != expect {
+				t.Errorf("expected %d tokens, got %d", expect, stats.tokens)
+			}
+		})
+	}
+}
+
+func TestImageTokenCount(t *testing.T) {
+	encode := func(width, height int) api.ImageData {
+		var b bytes.Buffer
+		if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+
+	small := encode(1024, 512)
+	large := encode(2048, 2048)
+
+	cases := []struct {
+		name     string
+		families []string
+		opts     api.Options
+		expect   []int
+	}{
+		{name: "llava", families: []string{"llama", "clip"}, expect: []int{768, 768}},
+		// 2 tiles of 560 pixels cover the small image, and the large image
+		// is resized to fit 4
+		{name: "mllama", families: []string{"mllama"}, expect: []int{2 * 1601, 4 * 1601}},
+		{name: "qwen25vl", families: []string{"qwen25vl"}, expect: []int{37 * 19, 74 * 74}},
+		{name: "unknown", expect: []int{768, 768}},
+		{name: "options override family", families: []string{"mllama"}, opts: api.Options{ImageBaseTokens: 64, ImageTileSize: 512, ImageTileTokens: 100}, expect: []int{64 + 2*100, 64 + 16*100}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Model
+			m.Config.ModelFamilies = tt.families
+
+			cost := imageCost(&m, &tt.opts)
+			got := []int{imageTokenCount(cost, small), imageTokenCount(cost, large)}
+			if diff := cmp.Diff(tt.expect, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatPromptTokenCache(t *testing.T) {
+	t.Setenv("OLLAMA_TOKEN_CACHE_SIZE", "64")
+
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "You are the Test Who Lived."},
+		{Role: "user", Content: "You're a test, Harry!"},
+		{Role: "assistant", Content: "I-I'm a what?"},
+		{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+		{Role: "assistant", Content: "How do you know?"},
+		{Role: "user", Content: "I've been watching you."},
+	}
+
+	var calls int
+	tokenize := func(ctx context.Context, s string) ([]int, error) {
+		calls++
+		return mockRunner{}.Tokenize(ctx, s)
+	}
+
+	chat := func(model Model) (string, int) {
+		t.Helper()
+		calls = 0
+		opts := api.Options{Runner: api.Runner{NumCtx: 30}}
+		prompt, _, _, err := chatPrompt(t.Context(), &model, tokenize, &opts, slices.Clone(msgs), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return prompt, calls
+	}
+
+	expect := "system: You are the Test Who Lived.\nuser: A test. And a thumping good one at that, I'd wager.\nassistant: How do you know?\nuser: I've been watching you.\n"
+
+	model := Model{Template: tmpl, ModelPath: t.Name()}
+	prompt, first := chat(model)
+	if diff := cmp.Diff(prompt, expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	prompt, second := chat(model)
+	if diff := cmp.Diff(prompt, expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	if second >= first {
+		t.Errorf("expected fewer tokenize calls with cached counts, got %d then %d", first, second)
+	}
+
+	model.ModelPath = t.Name() + "-other"
+	if _, calls := chat(model); calls != first {
+		t.Errorf("expected %d tokenize calls for a different model, got %d", first, calls)
+	}
+}
+
+func TestChatPromptUnknownRole(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}
+{{- if eq .Role "user" }}user: {{ .Content }}
+{{ else if eq .Role "assistant" }}assistant: {{ .Content }}
+{{ end }}
+{{- end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "What's the weather?"},
+		{Role: "function", Content: "sunny"},
+		{Role: "user", Content: "Thanks"},
+	}
+
+	cases := []struct {
+		name     string
+		mode     string
+		warnings []string
+		err      error
+	}{
+		{
+			name:     "warn",
+			warnings: []string{`template does not render role "function", messages with this role were skipped`},
+		},
+		{
+			name: "error",
+			mode: "error",
+			err:  errUnknownRole,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_UNKNOWN_ROLES", tt.mode)
+
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 64}}
+			prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if diff := cmp.Diff(prompt, "user: What's the weather?\nuser: Thanks\n"); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(stats.warnings, tt.warnings); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatPromptEmptyRender(t *testing.T) {
+	// a template with a typo in its field names renders nothing
+	tmpl, err := template.Parse(`
+{{- range .Message }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "Hello!"},
+	}
+
+	cases := []struct {
+		name string
+		mode string
+		err  error
+	}{
+		{
+			name: "error",
+			err:  errEmptyPrompt,
+		},
+		{
+			name: "allow",
+			mode: "allow",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_EMPTY_PROMPT", tt.mode)
+
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 64}}
+			prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if prompt != "" {
+				t.Errorf("expected empty prompt, got %q", prompt)
+			}
+
+			if !slices.Contains(stats.warnings, "template rendered an empty prompt from non-empty messages") {
+				t.Errorf("expected empty prompt warning, got %v", stats.warnings)
+			}
+		})
+	}
+}
+
+func TestChatPromptToolPriority(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Tools }}{{ .Function.Name }}: {{ .Function.Description }}
+{{ end }}
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tools := []api.Tool{
+		{
+			Type: "function",
+			Function: api.ToolFunction{
+				Name:        "get_weather",
+				Description: strings.TrimSpace(strings.Repeat("weather ", 20)),
+			},
+		},
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "One one"},
+		{Role: "assistant", Content: "Two two"},
+		{Role: "user", Content: "Three three"},
+		{Role: "assistant", Content: "Four four"},
+		{Role: "user", Content: "Five five"},
+	}
+
+	cases := []struct {
+		name     string
+		priority string
+		expect   string
+	}{
+		{
+			name:     "tools",
+			priority: "tools",
+			expect:   "get_weather: " + tools[0].Function.Description + "\nuser: Five five\n",
+		},
+		{
+			name:   "default",
+			expect: "get_weather: " + tools[0].Function.Description + "\nuser: Five five\n",
+		},
+		{
+			name:     "history",
+			priority: "history",
+			expect:   "get_weather: \nuser: One one\nassistant: Two two\nuser: Three three\nassistant: Four four\nuser: Five five\n",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 26}, ToolPriority: tt.priority}
+			prompt, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, tools, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+
+	if tools[0].Function.Description == "" {
+		t.Error("expected tools to not be modified")
+	}
+}
+
+func TestChatPromptToolTokens(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Tools }}{{ .Function.Name }}: {{ .Function.Description }}
+{{ end }}
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tool renders as its name and 40 words of description
+	tools := []api.Tool{
+		{
+			Type: "function",
+			Function: api.ToolFunction{
+				Name:        "get_weather",
+				Description: strings.TrimSpace(strings.Repeat("weather ", 40)),
+			},
+		},
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "One one"},
+		{Role: "assistant", Content: "Two two"},
+		{Role: "user", Content: "Three three"},
+		{Role: "assistant", Content: "Four four"},
+		{Role: "user", Content: "Five five"},
+	}
+
+	t.Run("budget", func(t *testing.T) {
+		model := Model{Template: tmpl}
+		opts := api.Options{Runner: api.Runner{NumCtx: 50}}
+		prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, tools, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stats.toolTokens != 41 {
+			t.Errorf("expected 41 tool tokens, got %d", stats.toolTokens)
+		}
+
+		// the 9 tokens left after the tools fit the last three messages
+		expect := "get_weather: " + tools[0].Function.Description + "\nuser: Three three\nassistant: Four four\nuser: Five five\n"
+		if diff := cmp.Diff(expect, prompt); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if stats.tokens != stats.toolTokens+9 {
+			t.Errorf("expected %d tokens, got %d", stats.toolTokens+9, stats.tokens)
+		}
+	})
+
+	t.Run("percent", func(t *testing.T) {
+		for _, tt := range []struct {
+			percent string
+			err     error
+		}{
+			{"50", errToolsTooLong},
+			{"90", nil},
+		} {
+			t.Run(tt.percent, func(t *testing.T) {
+				t.Setenv("OLLAMA_TOOL_CTX_PERCENT", tt.percent)
+
+				model := Model{Template: tmpl}
+				opts := api.Options{Runner: api.Runner{NumCtx: 50}}
+				_, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, tools, nil)
+				if !errors.Is(err, tt.err) {
+					t.Errorf("expected %v, got %v", tt.err, err)
+				}
+			})
+		}
+	})
+}
+
+func TestChatPromptContentAndToolCalls(t *testing.T) {
+	msgs := []api.Message{
+		{Role: "user", Content: "What's the weather in Paris?"},
+		{Role: "assistant", Content: "Let me check.", ToolCalls: []api.ToolCall{
+			{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris", "unit": "celsius"}}},
+		}},
+		{Role: "tool", Content: "Sunny"},
+		{Role: "user", Content: "Thanks!"},
+	}
+
+	t.Run("template", func(t *testing.T) {
+		tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{- range .ToolCalls }} {"name": "{{ .Function.Name }}", "arguments": {{ .Function.Arguments }}}{{ end }}
+{{ end }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		model := Model{Template: tmpl}
+		expect := "user: What's the weather in Paris?\nassistant: Let me check. {\"name\": \"get_weather\", \"arguments\": {\"city\":\"Paris\",\"unit\":\"celsius\"}}\ntool: Sunny\nuser: Thanks!\n"
+		total := len(strings.Fields(expect))
+
+		cases := []struct {
+			name   string
+			numCtx int
+			expect string
+		}{
+			{name: "fits", numCtx: total, expect: expect},
+			// dropping the first message makes just enough room
+			{name: "first dropped", numCtx: total - 6, expect: expect[strings.Index(expect, "assistant"):]},
+			// the assistant message's content and tool call are dropped together
+			{name: "assistant dropped", numCtx: total - 7, expect: "tool: Sunny\nuser: Thanks!\n"},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				opts := api.Options{Runner: api.Runner{NumCtx: tt.numCtx}}
+				prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(tt.expect, prompt); diff != "" {
+					t.Errorf("mismatch (-want +got):\n%s", diff)
+				}
+
+				if n := len(strings.Fields(prompt)); stats.tokens != n {
+					t.Errorf("expected %d tokens, got %d", n, stats.tokens)
+				}
+			})
+		}
+	})
+
+	t.Run("content", func(t *testing.T) {
+		tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cases := []struct {
+			name   string
+			mode   string
+			expect string
+		}{
+			{"default", "", "user: What's the weather in Paris?\nassistant: Let me check.\ntool: Sunny\nuser: Thanks!\n"},
+			{"json", "json", "user: What's the weather in Paris?\nassistant: Let me check.\n{\"name\":\"get_weather\",\"arguments\":{\"city\":\"Paris\",\"unit\":\"celsius\"}}\ntool: Sunny\nuser: Thanks!\n"},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				t.Setenv("OLLAMA_TOOL_CALL_CONTENT", tt.mode)
+
+				model := Model{Template: tmpl}
+				opts := api.Options{Runner: api.Runner{NumCtx: 4096}}
+				prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(tt.expect, prompt); diff != "" {
+					t.Errorf("mismatch (-want +got):\n%s", diff)
+				}
+
+				if n := len(strings.Fields(prompt)); stats.tokens != n {
+					t.Errorf("expected %d tokens, got %d", n, stats.tokens)
+				}
+			})
+		}
+	})
+}
+
+func TestChatPromptTrace(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "One one"},
+		{Role: "assistant", Content: "Two two"},
+		{Role: "user", Content: "Three three"},
+		{Role: "assistant", Content: "Four four"},
+		{Role: "user", Content: "Five five"},
+	}
+
+	model := Model{Template: tmpl}
+	opts := api.Options{Runner: api.Runner{NumCtx: 9}}
+	_, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the latest message is always kept so candidates start with the two
+	// latest messages and stop at the first which doesn't fit
+	expect := []api.TruncationStep{
+		{Messages: 2, Tokens: 6, Limit: 9},
+		{Messages: 3, Tokens: 9, Limit: 9},
+		{Messages: 4, Tokens: 12, Limit: 9},
+	}
+
+	if diff := cmp.Diff(stats.trace, expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+}
+
+func TestChatPromptMaxImages(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "One", Images: []api.ImageData{[]byte("one")}},
+		{Role: "assistant", Content: "Two"},
+		{Role: "user", Content: "Three", Images: []api.ImageData{[]byte("three")}},
+		{Role: "assistant", Content: "Four"},
+		{Role: "user", Content: "Five", Images: []api.ImageData{[]byte("five")}},
+	}
+
+	cases := []struct {
+		name      string
+		maxImages int
+		images    int
+		err       error
+	}{
+		{
+			name:   "unlimited",
+			images: 2,
+		},
+		{
+			name:      "within limit after truncation",
+			maxImages: 2,
+			images:    2,
+		},
+		{
+			name:      "exceeds limit after truncation",
+			maxImages: 1,
+			err:       errTooManyImages,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl, ProjectorPaths: []string{"vision"}}
+			// fits the two latest images but not all three
+			opts := api.Options{Runner: api.Runner{NumCtx: 1550}, MaxImagesTotal: tt.maxImages}
+			_, images, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+
+			if len(images) != tt.images {
+				t.Errorf("expected %d images, got %d", tt.images, len(images))
+			}
+		})
+	}
+}
+
+func TestChatPromptMllamaImages(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model := Model{Template: tmpl, ProjectorPaths: []string{"vision"}}
+	model.Config.ModelFamilies = []string{"mllama"}
+
+	// one image per message is allowed however many turns send one
+	msgs := []api.Message{
+		{Role: "user", Content: "One", Images: []api.ImageData{[]byte("one")}},
+		{Role: "assistant", Content: "Two"},
+		{Role: "user", Content: "Three", Images: []api.ImageData{[]byte("three")}},
+		{Role: "assistant", Content: "Four"},
+		{Role: "user", Content: "Five", Images: []api.ImageData{[]byte("five")}},
+	}
+
+	opts := api.Options{Runner: api.Runner{NumCtx: 100000}}
+	_, images, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(images) != 3 {
+		t.Errorf("expected 3 images, got %d", len(images))
+	}
+
+	msgs = []api.Message{
+		{Role: "user", Content: "One", Images: []api.ImageData{[]byte("one"), []byte("two")}},
+	}
+
+	if _, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil); !errors.Is(err, errTooManyImages) {
+		t.Errorf("expected error %v, got %v", errTooManyImages, err)
+	}
+}
+
+func longConversation(n int) []api.Message {
+	msgs := []api.Message{{Role: "system", Content: "You are a helpful assistant."}}
+	for i := range n {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		msgs = append(msgs, api.Message{Role: role, Content: strings.Repeat(fmt.Sprintf("message %d ", i), i%5+1)})
+	}
+
+	return msgs
+}
+
+func TestChatPromptTokenizeWorkers(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := longConversation(40)
+	for _, numCtx := range []int{16, 64, 100, 256, 1024} {
+		t.Run(strconv.Itoa(numCtx), func(t *testing.T) {
+			render := func(workers string) (string, promptStats) {
+				t.Setenv("OLLAMA_TOKENIZE_WORKERS", workers)
+
+				model := Model{Template: tmpl}
+				opts := api.Options{Runner: api.Runner{NumCtx: numCtx}}
+				prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return prompt, stats
+			}
+
+			serialPrompt, serial := render("")
+			for _, workers := range []string{"2", "3", "8"} {
+				prompt, stats := render(workers)
+				if diff := cmp.Diff(prompt, serialPrompt); diff != "" {
+					t.Errorf("%s workers: mismatch (-got +want):\n%s", workers, diff)
+				}
+
+				if stats.tokens != serial.tokens {
+					t.Errorf("%s workers: expected %d tokens, got %d", workers, serial.tokens, stats.tokens)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkChatPromptTokenizeWorkers(b *testing.B) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// simulate the latency of tokenizing with a runner
+	tokenize := func(ctx context.Context, s string) ([]int, error) {
+		time.Sleep(100 * time.Microsecond)
+		return mockRunner{}.Tokenize(ctx, s)
+	}
+
+	msgs := longConversation(200)
+	for _, workers := range []string{"1", "4", "16"} {
+		b.Run(workers, func(b *testing.B) {
+			b.Setenv("OLLAMA_TOKENIZE_WORKERS", workers)
+
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 2048}}
+			b.ReportAllocs()
+			for range b.N {
+				if _, _, _, err := chatPrompt(b.Context(), &model, tokenize, &opts, msgs, nil, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestChatPromptIncrementalCount(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls, length int
+	tokenize := func(ctx context.Context, s string) ([]int, error) {
+		calls++
+		length += len(s)
+		return mockRunner{}.Tokenize(ctx, s)
+	}
+
+	msgs := longConversation(200)
+	model := Model{Template: tmpl}
+	opts := api.Options{Runner: api.Runner{NumCtx: 1 << 20}}
+	prompt, _, _, err := chatPrompt(t.Context(), &model, tokenize, &opts, msgs, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each message is tokenized on its own, and the whole prompt only a few
+	// times, rather than tokenizing every candidate in full
+	if calls > len(msgs)+4 {
+		t.Errorf("expected at most %d tokenize calls, got %d", len(msgs)+4, calls)
+	}
+
+	if length > 4*len(prompt) {
+		t.Errorf("expected at most %d characters tokenized, got %d", 4*len(prompt), length)
+	}
+}
+
+func TestChatPromptTokenizeCalls(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := longConversation(200)
+	chat := func(model Model) promptStats {
+		t.Helper()
+		opts := api.Options{Runner: api.Runner{NumCtx: 512}}
+		_, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stats.truncation == api.TruncationNone {
+			t.Fatal("expected the conversation to be truncated")
+		}
+		return stats
+	}
+
+	// without the cache each candidate message is tokenized
+	uncached := chat(Model{Template: tmpl, ModelPath: t.Name()})
+	if uncached.tokenizeCalls < uncached.kept {
+		t.Errorf("expected at least %d tokenize calls, got %d", uncached.kept, uncached.tokenizeCalls)
+	}
+
+	// with the cache a repeated conversation only tokenizes the prompts
+	// confirming the selection
+	t.Setenv("OLLAMA_TOKEN_CACHE_SIZE", "1024")
+	model := Model{Template: tmpl, ModelPath: t.Name() + "/cached"}
+	chat(model)
+	cached := chat(model)
+	if cached.tokenizeCalls > 4 {
+		t.Errorf("expected at most 4 tokenize calls with the cache, got %d", cached.tokenizeCalls)
+	}
+
+	if cached.tokenizeCalls >= uncached.tokenizeCalls {
+		t.Errorf("expected fewer tokenize calls with the cache, got %d and %d without", cached.tokenizeCalls, uncached.tokenizeCalls)
+	}
+}
+
+func BenchmarkChatPromptLongConversation(b *testing.B) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var length int
+	tokenize := func(ctx context.Context, s string) ([]int, error) {
+		length += len(s)
+		return mockRunner{}.Tokenize(ctx, s)
+	}
+
+	msgs := longConversation(200)
+	for _, numCtx := range []int{256, 2048, 1 << 20} {
+		b.Run(strconv.Itoa(numCtx), func(b *testing.B) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: numCtx}}
+			length = 0
+			b.ReportAllocs()
+			for range b.N {
+				if _, _, _, err := chatPrompt(b.Context(), &model, tokenize, &opts, msgs, nil, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(length)/float64(b.N), "chars-tokenized/op")
+		})
+	}
+}
+
+func TestChatPromptDuplicateImages(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cat, dog := []byte("cat"), []byte("dog")
+	msgs := []api.Message{
+		{Role: "user", Content: "Look at this", Images: []api.ImageData{cat}},
+		{Role: "assistant", Content: "A cat."},
+		{Role: "user", Content: "Compare [img] with this", Images: []api.ImageData{cat, dog}},
+	}
+
+	cases := []struct {
+		name   string
+		mode   string
+		prompt string
+		images [][]byte
+	}{
+		{
+			name:   "default",
+			prompt: "user: [img-0]Look at this\nassistant: A cat.\nuser: [img-2]Compare [img-1] with this\n",
+			images: [][]byte{cat, cat, dog},
+		},
+		{
+			name:   "dedupe",
+			mode:   "dedupe",
+			prompt: "user: Look at this\nassistant: A cat.\nuser: [img-1]Compare [img-0] with this\n",
+			images: [][]byte{cat, dog},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_DUPLICATE_IMAGES", tt.mode)
+
+			model := Model{Template: tmpl, ProjectorPaths: []string{"vision"}}
+			opts := api.Options{Runner: api.Runner{NumCtx: 4096}}
+			prompt, images, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.prompt); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			var got [][]byte
+			for _, image := range images {
+				got = append(got, image.Data)
+			}
+
+			if diff := cmp.Diff(got, tt.images); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			if expect := len(strings.Fields(prompt)) + 768*len(tt.images); stats.tokens != expect {
+				t.Errorf("expected %d tokens, got %d", expect, stats.tokens)
+			}
+		})
+	}
+}
+
+func TestChatPromptSkipMarkerPosition(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "One one one"},
+		{Role: "assistant", Content: "Two two two"},
+		{Role: "system", Content: "Be kind."},
+		{Role: "user", Content: "Three"},
+		{Role: "assistant", Content: "Four"},
+		{Role: "user", Content: "Five"},
+	}
+
+	cases := []struct {
+		name     string
+		position string
+		expect   string
+	}{
+		{
+			name:   "default",
+			expect: "system: Be brief.\n\n[removed]\n\nBe kind.\nuser: Three\nassistant: Four\nuser: Five\n",
+		},
+		{
+			name:     "after m1",
+			position: "after_m1",
+			expect:   "system: Be brief.\n\n[removed]\n\nBe kind.\nuser: Three\nassistant: Four\nuser: Five\n",
+		},
+		{
+			name:     "before intermediates",
+			position: "before_intermediates",
+			expect:   "system: Be brief.\n\nBe kind.\n\n[removed]\nuser: Three\nassistant: Four\nuser: Five\n",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_SKIP_MARKER", "[removed]")
+			t.Setenv("OLLAMA_SKIP_MARKER_AT", tt.position)
+
+			// the system message sent mid-conversation is kept between the
+			// dropped messages and the kept intermediate messages
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 14}}
+			prompt, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatPromptSkipMarkerToolExchange(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}{{ range .ToolCalls }}call {{ .Function.Name }}{{ end }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := api.ToolCall{Function: api.ToolCallFunction{Name: "get_weather"}}
+
+	cases := []struct {
+		name     string
+		position string
+		limit    int
+		msgs     []api.Message
+		expect   string
+	}{
+		{
+			name:     "before intermediates tool result",
+			position: "before_intermediates",
+			limit:    15,
+			msgs: []api.Message{
+				{Role: "system", Content: "Be brief."},
+				{Role: "user", Content: "Weather in Paris, London and Berlin?"},
+				{Role: "assistant", ToolCalls: []api.ToolCall{call, call, call}},
+				{Role: "system", Content: "Use Celsius."},
+				{Role: "tool", Content: "Sunny"},
+				{Role: "assistant", Content: "It is sunny"},
+				{Role: "user", Content: "Thanks"},
+			},
+			expect: "system: Be brief.\n\nUse Celsius.\ntool: Sunny\nsystem: [removed]\nassistant: It is sunny\nuser: Thanks\n",
+		},
+		{
+			name:  "tool call dropped",
+			limit: 14,
+			msgs: []api.Message{
+				{Role: "system", Content: "Be brief."},
+				{Role: "user", Content: "Weather in Paris, London and Berlin?"},
+				{Role: "assistant", ToolCalls: []api.ToolCall{call, call, call}},
+				{Role: "tool", Content: "Sunny"},
+				{Role: "assistant", Content: "It is sunny"},
+				{Role: "user", Content: "Thanks"},
+			},
+			expect: "system: Be brief.\ntool: Sunny\nsystem: [removed]\nassistant: It is sunny\nuser: Thanks\n",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_SKIP_MARKER", "[removed]")
+			t.Setenv("OLLAMA_SKIP_MARKER_AT", tt.position)
+
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}}
+			prompt, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, tt.msgs, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChatPromptDurations(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	tokenize := func(ctx context.Context, s string) ([]int, error) {
+		calls++
+		time.Sleep(time.Millisecond)
+		return mockRunner{}.Tokenize(ctx, s)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "You're a test, Harry!"},
+		{Role: "assistant", Content: "I-I'm a what?"},
+		{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+	}
+
+	model := Model{Template: tmpl}
+	opts := api.Options{Runner: api.Runner{NumCtx: 16}}
+	_, _, stats, err := chatPrompt(t.Context(), &model, tokenize, &opts, msgs, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.truncation == api.TruncationNone {
+		t.Fatal("expected the conversation to be truncated")
+	}
+
+	// the candidates are counted incrementally, rendering each message on
+	// its own
+	if stats.fastPath {
+		t.Fatal("expected the candidates to be counted incrementally")
+	}
+
+	if stats.templateDuration <= 0 {
+		t.Errorf("expected a template duration, got %s", stats.templateDuration)
+	}
+
+	if want := time.Duration(calls) * time.Millisecond; stats.tokenizeDuration < want {
+		t.Errorf("expected a tokenize duration of at least %s, got %s", want, stats.tokenizeDuration)
+	}
+}
+
+func TestChatPromptTruncationClasses(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conversation := []api.Message{
+		{Role: "user", Content: "One"},
+		{Role: "assistant", Content: "Two"},
+		{Role: "user", Content: "Three"},
+		{Role: "assistant", Content: "Four"},
+		{Role: "user", Content: "Five"},
+		{Role: "assistant", Content: "Six"},
+		{Role: "user", Content: "Seven"},
+	}
+
+	cases := []struct {
+		name     string
+		msgs     []api.Message
+		truncate string
+		expect   string
+		strategy string
+	}{
+		{
+			name:     "short conversation slides",
+			msgs:     conversation[2:],
+			expect:   "user: Five\nassistant: Six\nuser: Seven\n",
+			strategy: "sliding_window",
+		},
+		{
+			name:     "long conversation keeps head and tail",
+			msgs:     conversation,
+			expect:   "user: One\n\nSeven\n",
+			strategy: "head_tail",
+		},
+		{
+			name:     "request overrides class",
+			msgs:     conversation,
+			truncate: "sliding_window",
+			expect:   "user: Five\nassistant: Six\nuser: Seven\n",
+			strategy: "sliding_window",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_TRUNCATION", "0:sliding_window, 6:head_tail")
+
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 6}, Truncation: tt.truncate, TruncateHead: 1, TruncateTail: 1}
+			prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, tt.msgs, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			if stats.strategy != tt.strategy {
+				t.Errorf("expected strategy %q, got %q", tt.strategy, stats.strategy)
+			}
+		})
+	}
+}
+
+func TestChatPromptTruncationClassFits(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "One"},
+		{Role: "assistant", Content: "Two"},
+		{Role: "user", Content: "Three"},
+		{Role: "assistant", Content: "Four"},
+		{Role: "user", Content: "Five"},
+		{Role: "assistant", Content: "Six"},
+		{Role: "user", Content: "Seven"},
+	}
+
+	cases := []struct {
+		name     string
+		classes  string
+		strategy string
+	}{
+		{
+			// keeping only the latest message would silently drop history
+			// which fits, so the conversation slides instead
+			name:     "no head or tail",
+			classes:  "0:sliding_window,6:head_tail",
+			strategy: "sliding_window",
+		},
+		{
+			name:     "class head and tail",
+			classes:  "0:sliding_window,6:head_tail:2:8",
+			strategy: "head_tail",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_TRUNCATION", tt.classes)
+
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 100}}
+			prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expect := "user: One\nassistant: Two\nuser: Three\nassistant: Four\nuser: Five\nassistant: Six\nuser: Seven\n"
+			if diff := cmp.Diff(prompt, expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			if stats.strategy != tt.strategy {
+				t.Errorf("expected strategy %q, got %q", tt.strategy, stats.strategy)
+			}
+		})
+	}
+}
+
+func TestTruncationClass(t *testing.T) {
+	cases := []struct {
+		classes    string
+		n          int
+		expect     string
+		head, tail int
+	}{
+		{"", 10, "", 0, 0},
+		{"0:sliding_window,50:head_tail", 0, "sliding_window", 0, 0},
+		{"0:sliding_window,50:head_tail", 49, "sliding_window", 0, 0},
+		{"0:sliding_window,50:head_tail", 50, "head_tail", 0, 0},
+		{"50:head_tail,0:sliding_window", 100, "head_tail", 0, 0},
+		{"10:head_tail", 5, "", 0, 0},
+		{"x:head_tail,0:sliding_window", 5, "sliding_window", 0, 0},
+		{"0:sliding_window,50:head_tail:2:8", 50, "head_tail", 2, 8},
+		{"0:sliding_window,50:head_tail:2", 50, "sliding_window", 0, 0},
+	}
+
+	for _, tt := range cases {
+		strategy, head, tail := truncationClass(tt.classes, tt.n)
+		if strategy != tt.expect || head != tt.head || tail != tt.tail {
+			t.Errorf("truncationClass(%q, %d) = %q, %d, %d, want %q, %d, %d", tt.classes, tt.n, strategy, head, tail, tt.expect, tt.head, tt.tail)
+		}
+	}
+}
+
+func TestChatPromptThink(t *testing.T) {
+	honored, err := template.Parse(`
+{{- if .Think }}<think>{{ end }}
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// templates which don't reference think ignore the request's value
+	ignored, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yes, no := true, false
+	cases := []struct {
+		name   string
+		tmpl   *template.Template
+		think  *bool
+		expect bool
+	}{
+		{name: "honored true", tmpl: honored, think: &yes, expect: true},
+		{name: "honored false", tmpl: honored, think: &no, expect: false},
+		{name: "honored unset", tmpl: honored, expect: false},
+		{name: "ignored true", tmpl: ignored, think: &yes, expect: true},
+		{name: "ignored false", tmpl: ignored, think: &no, expect: false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tt.tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 64}}
+			msgs := []api.Message{{Role: "user", Content: "Hello"}}
+			prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, tt.think)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if stats.think != tt.expect {
+				t.Errorf("expected think %t, got %t", tt.expect, stats.think)
+			}
+
+			if tt.tmpl == honored && strings.HasPrefix(prompt, "<think>") != tt.expect {
+				t.Errorf("expected prompt to match think %t, got %q", tt.expect, prompt)
+			}
+		})
+	}
+}
+
+func TestChatPromptTemplateOverhead(t *testing.T) {
+	t.Setenv("OLLAMA_SKIP_MARKER", "[{turns} turns removed]")
+
+	// the preamble and generation prompt are rendered regardless of the
+	// messages, and each message adds a role marker
+	tmpl, err := template.Parse(`You are a careful assistant, answer every question concisely.
+{{ range .Messages }}<|{{ .Role }}|> {{ .Content }}
+{{ end }}<|assistant|>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "one two three"},
+		{Role: "assistant", Content: "four five six"},
+		{Role: "user", Content: "seven eight nine"},
+		{Role: "assistant", Content: "ten eleven twelve"},
+		{Role: "user", Content: "thirteen fourteen fifteen"},
+	}
+
+	for _, limit := range []int{22, 23, 26, 40} {
+		t.Run(strconv.Itoa(limit), func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: limit}}
+			prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := mockRunner{}.Tokenize(t.Context(), prompt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if stats.tokens != len(s) {
+				t.Errorf("expected %d tokens, got %d", len(s), stats.tokens)
+			}
+
+			if stats.tokens > limit {
+				t.Errorf("prompt of %d tokens exceeds the context length %d:\n%s", stats.tokens, limit, prompt)
+			}
+		})
+	}
+}
+
+func TestChatPromptTruncationReason(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conversation := []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "one two three"},
+		{Role: "assistant", Content: "four five six"},
+		{Role: "user", Content: "seven eight nine"},
+	}
+
+	cases := []struct {
+		name     string
+		msgs     []api.Message
+		limit    int
+		overflow string
+		expect   api.TruncationReason
+	}{
+		{name: "none", msgs: conversation, limit: 20, expect: api.TruncationNone},
+		{name: "intermediate dropped", msgs: conversation, limit: 11, expect: api.TruncationIntermediateDropped},
+		{name: "all intermediate dropped", msgs: conversation, limit: 8, expect: api.TruncationAllIntermediateDropped},
+		{name: "latest truncated", msgs: conversation, limit: 5, expect: api.TruncationLatestTruncated},
+		{
+			name: "system truncated",
+			msgs: []api.Message{
+				{Role: "system", Content: strings.Repeat("You are the Test Who Lived. ", 4)},
+				{Role: "system", Content: "Be brief."},
+				{Role: "user", Content: "Hello!"},
+			},
+			limit:    10,
+			overflow: "truncate",
+			expect:   api.TruncationSystemTruncated,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_SYSTEM_OVERFLOW", tt.overflow)
+
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}}
+			_, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(tt.msgs), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if stats.truncation != tt.expect {
+				t.Errorf("expected %q, got %q", tt.expect, stats.truncation)
+			}
+		})
+	}
+
+	t.Run("head tail", func(t *testing.T) {
+		model := Model{Template: tmpl}
+		for limit, expect := range map[int]api.TruncationReason{
+			20: api.TruncationNone,
+			11: api.TruncationIntermediateDropped,
+			8:  api.TruncationAllIntermediateDropped,
+		} {
+			opts := api.Options{Runner: api.Runner{NumCtx: limit}, Truncation: "head_tail", TruncateHead: 1, TruncateTail: 2}
+			_, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(conversation), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if stats.truncation != expect {
+				t.Errorf("limit %d: expected %q, got %q", limit, expect, stats.truncation)
+			}
+		}
+	})
+}
+
+func TestChatPromptMaxMessageTokens(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var log []string
+	for i := range 100 {
+		log = append(log, fmt.Sprintf("line%d", i))
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "Why does this fail? " + strings.Join(log, " ")},
+		{Role: "assistant", Content: "Which part?"},
+		{Role: "user", Content: "The end"},
+	}
+
+	cases := []struct {
+		name   string
+		limit  int
+		expect string
+	}{
+		{
+			name:   "dropped",
+			expect: "assistant: Which part?\nuser: The end\n",
+		},
+		{
+			name:   "clipped",
+			limit:  12,
+			expect: "user: Why does this fail? line0 line1 \n...\nne95 line96 line97 line98 line99\nassistant: Which part?\nuser: The end\n",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 24}, MaxMessageTokens: tt.limit}
+			prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			if tt.limit > 0 && len(stats.warnings) != 1 {
+				t.Errorf("expected a warning for the clipped message, got %v", stats.warnings)
+			}
+		})
+	}
+}
+
+func TestChatPromptIdenticalMessages(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// messages are kept by position, so the first and latest messages are
+	// both rendered even when their content is identical
+	msgs := []api.Message{
+		{Role: "user", Content: "Are you there?"},
+		{Role: "assistant", Content: "Yes."},
+		{Role: "user", Content: "Are you there?"},
+	}
+
+	for name, strategy := range map[string]string{"default": "", "head tail": "head_tail"} {
+		t.Run(name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: 100}, Truncation: strategy, TruncateHead: 1, TruncateTail: 2}
+			prompt, _, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expect := "user: Are you there?\nassistant: Yes.\nuser: Are you there?\n"
+			if prompt != expect {
+				t.Errorf("expected %q, got %q", expect, prompt)
+			}
+		})
+	}
+}
+
+func TestChatPromptMergedMessages(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// consecutive user messages are merged into one, so the prompt is
+	// shorter than the sum of the messages rendered on their own
+	var msgs []api.Message
+	for range 6 {
+		msgs = append(msgs, api.Message{Role: "user", Content: "one two"})
+	}
+
+	expect := "user: " + strings.Repeat("one two\n\n", 5) + "one two\n"
+
+	for name, size := range map[string]string{"full count": "", "token cache": "64"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("OLLAMA_TOKEN_CACHE_SIZE", size)
+
+			model := Model{Template: tmpl, ModelPath: t.Name()}
+			opts := api.Options{Runner: api.Runner{NumCtx: 13}}
+			prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(expect, prompt); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			if stats.tokens != 13 {
+				t.Errorf("expected 13 tokens, got %d", stats.tokens)
+			}
+		})
+	}
+}
+
+func TestChatPromptFastPath(t *testing.T) {
+	t.Setenv("OLLAMA_CHARS_PER_TOKEN", "4")
+
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "one two three"},
+		{Role: "assistant", Content: "four five six"},
+		{Role: "user", Content: "seven eight nine"},
+	}
+
+	cases := []struct {
+		name     string
+		limit    int
+		fastPath bool
+		expect   string
+	}{
+		{
+			name:     "short",
+			limit:    64,
+			fastPath: true,
+			expect:   "user: one two three\nassistant: four five six\nuser: seven eight nine\n",
+		},
+		{
+			// the estimate of 10 tokens fits, but the conversation doesn't
+			name:   "underestimated",
+			limit:  11,
+			expect: "assistant: four five six\nuser: seven eight nine\n",
+		},
+		{
+			name:   "long",
+			limit:  5,
+			expect: "user: seven eight nine\n",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}}
+			prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expect, prompt); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			if stats.fastPath != tt.fastPath {
+				t.Errorf("expected fast path %t, got %t", tt.fastPath, stats.fastPath)
+			}
+		})
+	}
+}
+
+func TestChatPromptNumKeepMessages(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "One"},
+		{Role: "assistant", Content: "Two"},
+		{Role: "user", Content: "Three"},
+		{Role: "assistant", Content: "Four"},
+		{Role: "user", Content: "Five"},
+		{Role: "assistant", Content: "Six"},
+		{Role: "user", Content: "Seven"},
+	}
+
+	cases := []struct {
+		name    string
+		numKeep int
+		expect  string
+		dropped api.TruncationReason
+		numCtx  int
+	}{
+		{
+			name:    "none",
+			numCtx:  10,
+			expect:  "system: Be brief.\nuser: Five\nassistant: Six\nuser: Seven\n",
+			dropped: api.TruncationIntermediateDropped,
+		},
+		{
+			name:    "three",
+			numKeep: 3,
+			numCtx:  13,
+			expect:  "system: Be brief.\nuser: One\nassistant: Two\nuser: Three\nassistant: Six\nuser: Seven\n",
+			dropped: api.TruncationIntermediateDropped,
+		},
+		{
+			// every message is kept although they don't fit
+			name:    "more than messages",
+			numKeep: 10,
+			numCtx:  10,
+			expect:  "system: Be brief.\nuser: One\nassistant: Two\nuser: Three\nassistant: Four\nuser: Five\nassistant: Six\nuser: Seven\n",
+			dropped: api.TruncationLatestTruncated,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.numCtx}, NumKeepMessages: tt.numKeep}
+			prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, msgs, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expect, prompt); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			if stats.truncation != tt.dropped {
+				t.Errorf("expected truncation %q, got %q", tt.dropped, stats.truncation)
+			}
+		})
+	}
+}
+
+func TestChatPromptReferences(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "Remember the code word is pineapple", ID: "m1"},
+		{Role: "assistant", Content: "Noted."},
+		{Role: "user", Content: "Tell me a story about dragons"},
+		{Role: "assistant", Content: "Once upon a time there was a dragon"},
+		{Role: "user", Content: "What was the code word?", References: []string{"m1"}},
+	}
+
+	cases := []struct {
+		name       string
+		truncation string
+		cacheSize  string
+	}{
+		{name: "default"},
+		{name: "token cache", cacheSize: "64"},
+		{name: "head tail", truncation: "head_tail"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_TOKEN_CACHE_SIZE", tt.cacheSize)
+
+			model := Model{Template: tmpl, ModelPath: t.Name()}
+			opts := api.Options{Runner: api.Runner{NumCtx: 16}, Truncation: tt.truncation}
+			prompt, _, stats, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the referenced message is kept although older messages that
+			// aren't referenced are dropped
+			expect := "user: Remember the code word is pineapple\n\nWhat was the code word?\n"
+			if prompt != expect {
+				t.Errorf("expected %q, got %q", expect, prompt)
+			}
+
+			if stats.truncation != api.TruncationAllIntermediateDropped {
+				t.Errorf("expected truncation %q, got %q", api.TruncationAllIntermediateDropped, stats.truncation)
+			}
+		})
+	}
+}
+
+func TestIsPromptError(t *testing.T) {
+	if !isPromptError(fmt.Errorf("%w: 3 images exceeds the model limit of 2", errTooManyImages)) {
+		t.Error("expected a wrapped prompt error to be a prompt error")
+	}
+
+	if isPromptError(errors.New("connection refused")) {
+		t.Error("expected other errors not to be prompt errors")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"math"
 	"net"
 	"net/http"
@@ -18,7 +19,9 @@ import (
 	"os"
 	"os/signal"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -55,6 +58,10 @@ var mode string = gin.DebugMode
 type Server struct {
 	addr  net.Addr
 	sched *Scheduler
+
+	promptRates promptEvalRates
+	writes      modelWrites
+	truncation  truncationMetrics
 }
 
 func init() {
@@ -72,8 +79,24 @@ func init() {
 var (
 	errRequired    = errors.New("is required")
 	errBadTemplate = errors.New("template error")
+	errMixedInput  = errors.New("request cannot set both messages and prompt")
+	errNumKeepBoth = errors.New("request cannot set both num_keep and num_keep_messages")
 )
 
+// checkNumKeep rejects request options which set both num_keep, which counts
+// tokens the runner keeps, and num_keep_messages, which counts messages kept
+// when the prompt is truncated, since a client setting both likely mistook
+// one for the other
+func checkNumKeep(requestOpts map[string]any) error {
+	_, tokens := requestOpts["num_keep"]
+	_, messages := requestOpts["num_keep_messages"]
+	if tokens && messages {
+		return errNumKeepBoth
+	}
+
+	return nil
+}
+
 func modelOptions(model *Model, requestOpts map[string]any) (api.Options, error) {
 	opts := api.DefaultOptions()
 	if err := opts.FromMap(model.Options); err != nil {
@@ -87,46 +110,80 @@ func modelOptions(model *Model, requestOpts map[string]any) (api.Options, error)
 	return opts, nil
 }
 
+// queueStatusInterval is how often a request waiting for a runner checks its
+// position in the queue
+var queueStatusInterval = 500 * time.Millisecond
+
 // scheduleRunner schedules a runner after validating inputs such as capabilities and model options.
-// It returns the allocated runner, model instance, and consolidated options if successful and error otherwise.
-func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.Capability, requestOpts map[string]any, keepAlive *api.Duration) (llm.LlamaServer, *Model, *api.Options, error) {
+// It returns the allocated runner, model instance, consolidated options, and how the runner was scheduled if successful
+// and error otherwise. If queued is not nil, it's called with the request's position in the queue and estimated wait
+// whenever the position changes while the request waits.
+func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.Capability, requestOpts map[string]any, keepAlive *api.Duration, priority int, queued func(position int, wait time.Duration)) (llm.LlamaServer, *Model, *api.Options, scheduled, error) {
 	if name == "" {
-		return nil, nil, nil, fmt.Errorf("model %w", errRequired)
+		return nil, nil, nil, scheduled{}, fmt.Errorf("model %w", errRequired)
+	}
+
+	if err := s.writes.wait(ctx, name); err != nil {
+		return nil, nil, nil, scheduled{}, err
 	}
 
 	model, err := GetModel(name)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, scheduled{}, err
 	}
 
 	if slices.Contains(model.Config.ModelFamilies, "mllama") && len(model.ProjectorPaths) > 0 {
-		return nil, nil, nil, fmt.Errorf("'llama3.2-vision' is no longer compatible with your version of Ollama and has been replaced by a newer version. To re-download, run 'ollama pull llama3.2-vision'")
+		return nil, nil, nil, scheduled{}, fmt.Errorf("'llama3.2-vision' is no longer compatible with your version of Ollama and has been replaced by a newer version. To re-download, run 'ollama pull llama3.2-vision'")
 	}
 
 	if err := model.CheckCapabilities(caps...); err != nil {
-		return nil, nil, nil, fmt.Errorf("%s %w", name, err)
+		return nil, nil, nil, scheduled{}, fmt.Errorf("%s %w", name, err)
 	}
 
 	opts, err := modelOptions(model, requestOpts)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, scheduled{}, err
+	}
+
+	capNumCtx(model, &opts)
+
+	req := s.sched.request(ctx, model, opts, keepAlive, priority)
+
+	var status <-chan time.Time
+	if queued != nil {
+		ticker := time.NewTicker(queueStatusInterval)
+		defer ticker.Stop()
+		status = ticker.C
 	}
 
-	runnerCh, errCh := s.sched.GetRunner(ctx, model, opts, keepAlive)
 	var runner *runnerRef
-	select {
-	case runner = <-runnerCh:
-	case err = <-errCh:
-		return nil, nil, nil, err
+	lastPosition := -1
+schedule:
+	for {
+		select {
+		case runner = <-req.successCh:
+			break schedule
+		case err = <-req.errCh:
+			return nil, nil, nil, scheduled{}, err
+		case <-status:
+			if position, wait, ok := s.sched.queueStatus(req); ok && position != lastPosition {
+				lastPosition = position
+				queued(position, wait)
+			}
+		}
 	}
 
-	return runner.llama, model, &opts, nil
+	return runner.llama, model, &opts, scheduled{evicted: req.evicted, coldStart: req.coldStart, stages: req.stages}, nil
 }
 
 func (s *Server) GenerateHandler(c *gin.Context) {
 	checkpointStart := time.Now()
-	var req api.GenerateRequest
-	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+	var body struct {
+		api.GenerateRequest
+		// Messages belong to chat requests but are sometimes sent here by mistake
+		Messages []api.Message `json:"messages"`
+	}
+	if err := c.ShouldBindJSON(&body); errors.Is(err, io.EOF) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
 		return
 	} else if err != nil {
@@ -134,6 +191,15 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	req := body.GenerateRequest
+	if len(body.Messages) > 0 && req.Prompt != "" {
+		if envconfig.MixedInput() == "error" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errMixedInput.Error()})
+			return
+		}
+		slog.Warn("generate request sets both messages and prompt, ignoring messages")
+	}
+
 	name := model.ParseName(req.Model)
 	if !name.IsValid() {
 		// Ideally this is "invalid model name" but we're keeping with
@@ -150,6 +216,11 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	if err := s.writes.wait(c.Request.Context(), name.String()); err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
 	m, err := GetModel(name.String())
 	if err != nil {
 		switch {
@@ -164,7 +235,7 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	}
 
 	// expire the runner
-	if req.Prompt == "" && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
+	if req.Prompt == "" && !req.Resume && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
 		s.sched.expireRunner(m)
 
 		c.JSON(http.StatusOK, api.GenerateResponse{
@@ -182,6 +253,11 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	if req.Resume && (len(req.Context) == 0 || req.Suffix != "" || len(req.Images) > 0) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "resume requires context and does not support suffix or images"})
+		return
+	}
+
 	caps := []model.Capability{model.CapabilityCompletion}
 	if req.Suffix != "" {
 		caps = append(caps, model.CapabilityInsert)
@@ -194,7 +270,7 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		// updated template supporting thinking
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive)
+	r, m, opts, sched, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive, req.Priority, nil)
 	if errors.Is(err, errCapabilityCompletion) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
 		return
@@ -206,12 +282,13 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	checkpointLoaded := time.Now()
 
 	// load the model
-	if req.Prompt == "" {
+	if req.Prompt == "" && !req.Resume {
 		c.JSON(http.StatusOK, api.GenerateResponse{
 			Model:      req.Model,
 			CreatedAt:  time.Now().UTC(),
 			Done:       true,
 			DoneReason: "load",
+			NumCtx:     opts.NumCtx,
 		})
 		return
 	}
@@ -221,12 +298,18 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	if err := downscaleImages(req.Images); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	images := make([]llm.ImageData, len(req.Images))
 	for i := range req.Images {
 		images[i] = llm.ImageData{ID: i, Data: req.Images[i]}
 	}
 
 	prompt := req.Prompt
+	var templateDigest string
 	if !req.Raw {
 		tmpl := m.Template
 		if req.Template != "" {
@@ -236,6 +319,9 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 				return
 			}
 		}
+		if req.Verbose {
+			templateDigest = tmpl.Digest()
+		}
 
 		var values template.Values
 		if req.Suffix != "" {
@@ -275,7 +361,11 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			b.WriteString(s)
 		}
 
-		if err := tmpl.Execute(&b, values); err != nil {
+		// a resumed response continues from the context as it is, without
+		// starting a new turn
+		if req.Resume {
+			b.WriteString(req.Prompt)
+		} else if err := tmpl.Execute(&b, values); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
@@ -283,6 +373,18 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		prompt = b.String()
 	}
 
+	// generate prompts aren't truncated, so verbose requests report whether
+	// the prompt fits as it is
+	var fit *api.ContextFit
+	if req.Verbose {
+		tokens, err := r.Tokenize(c.Request.Context(), prompt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		fit = &api.ContextFit{Tokens: len(tokens), NumCtx: opts.NumCtx, Fits: len(tokens) <= opts.NumCtx}
+	}
+
 	var thinkingState *thinking.Parser
 	openingTag, closingTag := thinking.InferTags(m.Template.Template)
 	if req.Think != nil && *req.Think && openingTag != "" && closingTag != "" {
@@ -297,12 +399,17 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		// TODO (jmorganca): avoid building the response twice both here and below
 		var sb strings.Builder
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
+
+		ctx, reset, stop := withStallTimeout(c.Request.Context(), envconfig.StallTimeout())
+		defer stop()
+
+		if err := r.Completion(ctx, llm.CompletionRequest{
 			Prompt:  prompt,
 			Images:  images,
 			Format:  req.Format,
 			Options: opts,
 		}, func(cr llm.CompletionResponse) {
+			reset()
 			res := api.GenerateResponse{
 				Model:     req.Model,
 				CreatedAt: time.Now().UTC(),
@@ -311,6 +418,7 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 				Metrics: api.Metrics{
 					PromptEvalCount:    cr.PromptEvalCount,
 					PromptEvalDuration: cr.PromptEvalDuration,
+					PromptCacheCount:   cr.PromptCacheCount,
 					EvalCount:          cr.EvalCount,
 					EvalDuration:       cr.EvalDuration,
 				},
@@ -327,7 +435,18 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			}
 
 			if cr.Done {
+				s.promptRates.record(m.ModelPath, cr.PromptEvalCount, cr.PromptEvalDuration)
+				promptCacheHit(&res.Metrics)
 				res.DoneReason = cr.DoneReason.String()
+				res.ColdStart = sched.coldStart
+				res.Capabilities = usedCapabilities(caps, len(images))
+				res.ThinkingTruncated = thinkingState != nil && thinkingState.InThinking()
+				res.ContextFit = fit
+				if req.Verbose {
+					res.EvictedRunners = sched.evicted
+					res.TemplateDigest = templateDigest
+					res.PeakVRAM = cr.PeakVRAM
+				}
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
 
@@ -343,7 +462,7 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 
 			ch <- res
 		}); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			ch <- gin.H{"error": stallError(ctx, err).Error()}
 		}
 	}()
 
@@ -428,7 +547,7 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		return
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), []model.Capability{}, req.Options, req.KeepAlive)
+	r, m, opts, _, err := s.scheduleRunner(c.Request.Context(), name.String(), []model.Capability{}, req.Options, req.KeepAlive, 0, nil)
 	if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
@@ -536,7 +655,7 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 		return
 	}
 
-	r, _, _, err := s.scheduleRunner(c.Request.Context(), name.String(), []model.Capability{}, req.Options, req.KeepAlive)
+	r, _, _, _, err := s.scheduleRunner(c.Request.Context(), name.String(), []model.Capability{}, req.Options, req.KeepAlive, 0, nil)
 	if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
@@ -589,9 +708,11 @@ func (s *Server) PullHandler(c *gin.Context) {
 		return
 	}
 
+	written := s.writes.begin(name.String())
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
+		defer written()
 		fn := func(r api.ProgressResponse) {
 			ch <- r
 		}
@@ -842,6 +963,12 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 	}
 	resp.Parameters = strings.Join(params, "\n")
 
+	opts, err := modelOptions(m, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Options = &opts
+
 	for k, v := range req.Options {
 		if _, ok := req.Options[k]; ok {
 			m.Options[k] = v
@@ -904,6 +1031,26 @@ func getModelData(digest string, verbose bool) (ggml.KV, ggml.Tensors, error) {
 	return kv, data.Tensors(), nil
 }
 
+// modelKVs caches the metadata returned by modelKV by the path of the model
+// weights. Weights are stored by digest, so their metadata never changes
+var modelKVs sync.Map
+
+// modelKV returns the metadata of the model weights at path, only decoding
+// them the first time
+func modelKV(path string) (ggml.KV, error) {
+	if kv, ok := modelKVs.Load(path); ok {
+		return kv.(ggml.KV), nil
+	}
+
+	kv, _, err := getModelData(path, false)
+	if err != nil {
+		return nil, err
+	}
+
+	modelKVs.Store(path, kv)
+	return kv, nil
+}
+
 func (s *Server) ListHandler(c *gin.Context) {
 	ms, err := Manifests(true)
 	if err != nil {
@@ -1203,8 +1350,11 @@ func (s *Server) GenerateRoutes(rc *ollama.Registry) (http.Handler, error) {
 
 	// Inference
 	r.GET("/api/ps", s.PsHandler)
+	r.GET("/api/ps/loading", s.PsLoadingHandler)
+	r.GET("/api/metrics", s.MetricsHandler)
 	r.POST("/api/generate", s.GenerateHandler)
 	r.POST("/api/chat", s.ChatHandler)
+	r.POST("/api/chat/plan", s.PlanHandler)
 	r.POST("/api/embed", s.EmbedHandler)
 	r.POST("/api/embeddings", s.EmbeddingsHandler)
 
@@ -1382,33 +1532,54 @@ func streamResponse(c *gin.Context, ch chan any) {
 	})
 }
 
+// writeStreamEvent writes a streamed response ahead of the rest of the stream.
+// The response status can't change afterwards, so later errors are written to
+// the stream
+func writeStreamEvent(c *gin.Context, val any) {
+	bts, err := json.Marshal(val)
+	if err != nil {
+		slog.Info(fmt.Sprintf("writeStreamEvent: json.Marshal failed with %s", err))
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	if _, err := c.Writer.Write(append(bts, '\n')); err != nil {
+		slog.Info(fmt.Sprintf("writeStreamEvent: w.Write failed with %s", err))
+		return
+	}
+	c.Writer.Flush()
+}
+
+// respond writes val with status, or as a stream event once a stream event
+// has already committed the response
+func respond(c *gin.Context, status int, val any) {
+	if c.Writer.Written() {
+		writeStreamEvent(c, val)
+		return
+	}
+
+	c.JSON(status, val)
+}
+
 func (s *Server) PsHandler(c *gin.Context) {
 	models := []api.ProcessModelResponse{}
 
 	for _, v := range s.sched.loaded {
-		model := v.model
-		modelDetails := api.ModelDetails{
-			Format:            model.Config.ModelFormat,
-			Family:            model.Config.ModelFamily,
-			Families:          model.Config.ModelFamilies,
-			ParameterSize:     model.Config.ModelType,
-			QuantizationLevel: model.Config.FileType,
-		}
-
-		mr := api.ProcessModelResponse{
-			Model:     model.ShortName,
-			Name:      model.ShortName,
-			Size:      int64(v.estimatedTotal),
-			SizeVRAM:  int64(v.estimatedVRAM),
-			Digest:    model.Digest,
-			Details:   modelDetails,
-			ExpiresAt: v.expiresAt,
-		}
+		mr := processModel(v)
+		mr.ExpiresAt = v.expiresAt
 		// The scheduler waits to set expiresAt, so if a model is loading it's
 		// possible that it will be set to the unix epoch. For those cases, just
 		// calculate the time w/ the sessionDuration instead.
+		//
+		// The scheduler only starts the keep alive timer once a runner goes
+		// idle, so a runner which is serving requests can't expire yet and
+		// reports the expiry it would have if it went idle now.
+		v.refMu.Lock()
+		active := v.refCount > 0
+		v.refMu.Unlock()
+
 		var epoch time.Time
-		if v.expiresAt == epoch {
+		if v.expiresAt == epoch || active {
 			mr.ExpiresAt = time.Now().Add(v.sessionDuration)
 		}
 
@@ -1423,11 +1594,58 @@ func (s *Server) PsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, api.ProcessResponse{Models: models})
 }
 
+// PsLoadingHandler lists the models whose runners are still loading
+func (s *Server) PsLoadingHandler(c *gin.Context) {
+	models := []api.ProcessModelResponse{}
+	for _, v := range s.sched.loadingRunners() {
+		models = append(models, processModel(v))
+	}
+
+	c.JSON(http.StatusOK, api.ProcessResponse{Models: models})
+}
+
+// processModel describes the model a runner serves
+func processModel(v *runnerRef) api.ProcessModelResponse {
+	model := v.model
+	return api.ProcessModelResponse{
+		Model:    model.ShortName,
+		Name:     model.ShortName,
+		Size:     int64(v.estimatedTotal),
+		SizeVRAM: int64(v.estimatedVRAM),
+		Digest:   model.Digest,
+		Details: api.ModelDetails{
+			Format:            model.Config.ModelFormat,
+			Family:            model.Config.ModelFamily,
+			Families:          model.Config.ModelFamilies,
+			ParameterSize:     model.Config.ModelType,
+			QuantizationLevel: model.Config.FileType,
+		},
+	}
+}
+
+// promptCacheHit marks metrics of a prompt which was served entirely from the
+// cache. No prompt tokens were evaluated so zero is reported, unless
+// OLLAMA_CACHE_HIT_EVAL is "cached" for clients which expect a count
+func promptCacheHit(m *api.Metrics) {
+	if m.PromptEvalCount > 0 || m.PromptCacheCount == 0 {
+		return
+	}
+
+	m.PromptCacheHit = true
+	if envconfig.CacheHitEval() == "cached" {
+		m.PromptEvalCount = m.PromptCacheCount
+	}
+}
+
 func (s *Server) ChatHandler(c *gin.Context) {
 	checkpointStart := time.Now()
 
-	var req api.ChatRequest
-	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+	var body struct {
+		api.ChatRequest
+		// Prompt belongs to generate requests but is sometimes sent here by mistake
+		Prompt string `json:"prompt"`
+	}
+	if err := c.ShouldBindJSON(&body); errors.Is(err, io.EOF) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
 		return
 	} else if err != nil {
@@ -1435,6 +1653,20 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	req := body.ChatRequest
+	if body.Prompt != "" && len(req.Messages) > 0 {
+		if envconfig.MixedInput() == "error" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errMixedInput.Error()})
+			return
+		}
+		slog.Warn("chat request sets both messages and prompt, ignoring prompt")
+	}
+
+	if err := checkNumKeep(req.Options); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// expire the runner
 	if len(req.Messages) == 0 && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
 		model, err := GetModel(req.Model)
@@ -1461,8 +1693,17 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
-	caps := []model.Capability{model.CapabilityCompletion}
 	if len(req.Tools) > 0 {
+		tools, err := validateTools(req.Tools)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		req.Tools = tools
+	}
+
+	caps := []model.Capability{model.CapabilityCompletion}
+	if len(req.Tools) > 0 && !envconfig.ToolsInSystem() {
 		caps = append(caps, model.CapabilityTools)
 	}
 	if req.Think != nil && *req.Think {
@@ -1480,9 +1721,30 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive)
+	var queued func(int, time.Duration)
+	if req.ReportQueue && (req.Stream == nil || *req.Stream) {
+		queued = func(position int, wait time.Duration) {
+			res := api.ChatResponse{
+				Model:     req.Model,
+				CreatedAt: time.Now().UTC(),
+				Message:   api.Message{Role: "assistant"},
+				Queue:     &api.QueueStatus{Position: position, EstimatedWait: wait},
+			}
+			if req.TypedEvents {
+				res.Type = api.ChatEventStatus
+			}
+			writeStreamEvent(c, res)
+		}
+	}
+
+	// the runner is held until schedCtx is done, so it can be released if the
+	// request is scheduled again with a dynamically sized context length
+	schedCtx, release := context.WithCancel(c.Request.Context())
+	defer release()
+
+	r, m, opts, sched, err := s.scheduleRunner(schedCtx, name.String(), caps, req.Options, req.KeepAlive, req.Priority, queued)
 	if errors.Is(err, errCapabilityCompletion) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", req.Model)})
+		respond(c, http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", req.Model)})
 		return
 	} else if err != nil {
 		handleScheduleError(c, req.Model, err)
@@ -1492,12 +1754,13 @@ func (s *Server) ChatHandler(c *gin.Context) {
 	checkpointLoaded := time.Now()
 
 	if len(req.Messages) == 0 {
-		c.JSON(http.StatusOK, api.ChatResponse{
+		respond(c, http.StatusOK, api.ChatResponse{
 			Model:      req.Model,
 			CreatedAt:  time.Now().UTC(),
 			Message:    api.Message{Role: "assistant"},
 			Done:       true,
 			DoneReason: "load",
+			NumCtx:     opts.NumCtx,
 		})
 		return
 	}
@@ -1508,13 +1771,102 @@ func (s *Server) ChatHandler(c *gin.Context) {
 	}
 	msgs = filterThinkTags(msgs, m)
 
-	prompt, images, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, req.Tools, req.Think)
-	if err != nil {
+	for _, msg := range msgs {
+		if err := downscaleImages(msg.Images); err != nil {
+			respond(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// the template can't render tools so describe them in a system message
+	// instead. Tool calls are returned as content since they can't be parsed
+	if len(req.Tools) > 0 && !slices.Contains(m.Template.Vars(), "tools") {
+		msgs = append([]api.Message{toolsMessage(req.Tools)}, msgs...)
+		req.Tools = nil
+	}
+
+	numPredict := opts.NumPredict
+	numCtx, numCtxDecision, err := fitNumCtx(c.Request.Context(), r, m, opts, req.Options, msgs, req.Tools, req.Think, s.sched.getGpuFn)
+	if isPromptError(err) || errors.Is(err, errNumPredictTooLong) {
+		respond(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		slog.Error("chat context length error", "error", err)
+		respond(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	numPredictClamped := opts.NumPredict != numPredict
+
+	if numCtx != opts.NumCtx {
+		requestOpts := maps.Clone(req.Options)
+		if requestOpts == nil {
+			requestOpts = make(map[string]any)
+		}
+		// options are decoded as they would be from JSON
+		requestOpts["num_ctx"] = float64(numCtx)
+		if numPredictClamped {
+			requestOpts["num_predict"] = float64(opts.NumPredict)
+		}
+
+		// release the runner sized for the old context length first,
+		// otherwise the scheduler waits for it to be idle before reloading
+		// it and the request never gets a runner
+		release()
+
+		var resched scheduled
+		r, m, opts, resched, err = s.scheduleRunner(c.Request.Context(), name.String(), caps, requestOpts, req.KeepAlive, req.Priority, queued)
+		if err != nil {
+			handleScheduleError(c, req.Model, err)
+			return
+		}
+		sched = sched.add(resched)
+	}
+
+	// summarize dropped messages with the runner the request was finally
+	// scheduled on
+	if envconfig.SummarizeDropped() {
+		m.Summarize = summarizer(r, m, opts)
+	}
+
+	prompt, images, stats, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, req.Tools, req.Think)
+	if isPromptError(err) {
+		respond(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
 		slog.Error("chat prompt error", "error", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respond(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	s.truncation.record(m.ShortName, stats)
+
+	// limit generation to the space left in the context window after the prompt.
+	// Without a limit the runner truncates a prompt which overflows the context
+	if remaining := opts.NumCtx - stats.tokens; opts.NumPredict > 0 && opts.NumPredict > remaining {
+		// rather than quietly generating a single token
+		if remaining <= 0 {
+			respond(c, http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%v: the prompt is %d tokens and num_ctx is %d", errPromptFillsContext, stats.tokens, opts.NumCtx)})
+			return
+		}
+
+		slog.Debug("clamping num_predict to remaining context", "num_predict", opts.NumPredict, "remaining", remaining)
+		opts.NumPredict = remaining
+		numPredictClamped = true
+	}
+
+	// expose context utilization to proxies which only see headers
+	c.Header("X-Context-Used", strconv.Itoa(stats.tokens))
+	c.Header("X-Context-Limit", strconv.Itoa(opts.NumCtx))
+
+	var sizing *api.ModelSizing
+	if req.Verbose {
+		sizing, err = modelSizing(m)
+		if err != nil {
+			respond(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	var thinkingState *thinking.Parser
 	openingTag, closingTag := thinking.InferTags(m.Template.Template)
 	if req.Think != nil && *req.Think && openingTag != "" && closingTag != "" {
@@ -1529,7 +1881,21 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		toolParser, err = tools.NewParser(m.Template.Template)
 		if err != nil {
 			slog.Error("failed to create tool parser", "error", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			respond(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// tool calls can't be told apart from content as they stream when the
+	// template doesn't mark where they start
+	var bufferTools bool
+	if toolParser != nil && (req.Stream == nil || *req.Stream) && !toolParser.Incremental() {
+		switch envconfig.ToolStreaming() {
+		case "buffer":
+			bufferTools = true
+			stats.warnings = append(stats.warnings, "tool calls were buffered because the template does not support streaming them")
+		case "error":
+			respond(c, http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support streaming tool calls", req.Model)})
 			return
 		}
 	}
@@ -1538,12 +1904,56 @@ func (s *Server) ChatHandler(c *gin.Context) {
 	go func() {
 		defer close(ch)
 
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
+		ctx, reset, stop := withStallTimeout(c.Request.Context(), envconfig.StallTimeout())
+		defer stop()
+
+		// generation is stopped after the maximum number of chunks as a
+		// safety valve against runaway generation
+		ctx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+		maxChunks := req.MaxChunks
+		if maxChunks <= 0 {
+			maxChunks = int(envconfig.MaxChunks())
+		}
+		var chunks int
+
+		// each response from the runner carries about one generated token
+		var generated int
+
+		// buffered tool call responses are assembled and sent when done
+		var sbThinking, sbContent strings.Builder
+		var toolCalls []api.ToolCall
+		var toolErrors []api.ToolCallError
+
+		if err := r.Completion(ctx, llm.CompletionRequest{
 			Prompt:  prompt,
 			Images:  images,
 			Format:  req.Format,
 			Options: opts,
 		}, func(r llm.CompletionResponse) {
+			if errors.Is(context.Cause(ctx), errMaxChunks) {
+				return
+			}
+
+			reset()
+			if r.Content != "" {
+				generated++
+			}
+			if r.Done && r.EvalCount > 0 {
+				generated = r.EvalCount
+			}
+
+			if r.Content != "" && !r.Done {
+				chunks++
+				if maxChunks > 0 && chunks >= maxChunks {
+					slog.Debug("stopping generation at the maximum number of chunks", "max_chunks", maxChunks)
+					cancel(errMaxChunks)
+					r.Done = true
+					r.DoneReason = llm.DoneReasonLength
+					r.EvalCount = generated
+				}
+			}
+
 			res := api.ChatResponse{
 				Model:     req.Model,
 				CreatedAt: time.Now().UTC(),
@@ -1552,11 +1962,17 @@ func (s *Server) ChatHandler(c *gin.Context) {
 				Metrics: api.Metrics{
 					PromptEvalCount:    r.PromptEvalCount,
 					PromptEvalDuration: r.PromptEvalDuration,
+					PromptCacheCount:   r.PromptCacheCount,
 					EvalCount:          r.EvalCount,
 					EvalDuration:       r.EvalDuration,
 				},
 			}
 
+			if req.ReportRemaining {
+				remaining := max(opts.NumCtx-stats.tokens-generated, 0)
+				res.Remaining = &remaining
+			}
+
 			if thinkingState != nil {
 				thinkingContent, remainingContent := thinkingState.AddContent(res.Message.Content)
 				if thinkingContent == "" && remainingContent == "" && !r.Done {
@@ -1568,37 +1984,90 @@ func (s *Server) ChatHandler(c *gin.Context) {
 			}
 
 			if r.Done {
+				s.promptRates.record(m.ModelPath, r.PromptEvalCount, r.PromptEvalDuration)
+				promptCacheHit(&res.Metrics)
 				res.DoneReason = r.DoneReason.String()
+				res.ColdStart = sched.coldStart
+				res.Warnings = stats.warnings
+				res.Sizing = sizing
+				res.Think = &stats.think
+				res.Truncation = stats.truncation
+				res.ExtremeTruncation = stats.extreme
+				res.TruncationSummary = stats.summary()
+				res.Capabilities = usedCapabilities(caps, len(images))
+				res.ThinkingTruncated = thinkingState != nil && thinkingState.InThinking()
+				if req.Verbose && sched.coldStart {
+					res.LoadStages = &sched.stages
+				}
+				if req.Verbose {
+					res.EvictedRunners = sched.evicted
+					res.TemplateDigest = m.Template.Digest()
+					res.ImageTokens = stats.imageTokens
+					res.TruncationFastPath = stats.fastPath
+					res.TruncationStrategy = stats.strategy
+					res.IsThinkSet = &stats.thinkSet
+					res.TemplateDuration = stats.templateDuration
+					res.TokenizeDuration = stats.tokenizeDuration
+					res.TokenizeCalls = stats.tokenizeCalls
+					res.AllMessagesIncluded = &stats.allIncluded
+					res.NumCtxDecision = numCtxDecision
+					res.PeakVRAM = r.PeakVRAM
+				}
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				if opts.NumPredict >= 0 {
+					res.NumPredict = opts.NumPredict
+					res.NumPredictClamped = numPredictClamped
+				}
 			}
 
 			if len(req.Tools) > 0 {
-				toolCalls, content := toolParser.Add(res.Message.Content)
+				parsed, content := toolParser.Add(res.Message.Content)
+				parsed = slices.DeleteFunc(parsed, func(tc api.ToolCall) bool {
+					problems := tools.Validate(tc, req.Tools)
+					if len(problems) == 0 {
+						return false
+					}
+					res.ToolErrors = append(res.ToolErrors, api.ToolCallError{ToolCall: tc, Errors: problems})
+					return req.RejectInvalidTools
+				})
 				if len(content) > 0 {
 					res.Message.Content = content
-				} else if len(toolCalls) > 0 {
-					res.Message.ToolCalls = toolCalls
+				} else if len(parsed) > 0 {
+					res.Message.ToolCalls = parsed
 					res.Message.Content = ""
-				} else if res.Message.Thinking != "" {
+				} else if res.Message.Thinking != "" || len(res.ToolErrors) > 0 {
 					// don't return
-				} else {
-					if r.Done {
-						ch <- res
-					}
+				} else if !r.Done {
 					return
 				}
 			}
 
-			ch <- res
-		}); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			if bufferTools {
+				sbThinking.WriteString(res.Message.Thinking)
+				sbContent.WriteString(res.Message.Content)
+				toolCalls = append(toolCalls, res.Message.ToolCalls...)
+				toolErrors = append(toolErrors, res.ToolErrors...)
+				if !r.Done {
+					return
+				}
+
+				res.Message.Thinking = sbThinking.String()
+				res.Message.Content = sbContent.String()
+				res.Message.ToolCalls = toolCalls
+				res.ToolErrors = toolErrors
+			}
+
+			sendChat(ch, res, req.TypedEvents)
+		}); err != nil && !errors.Is(context.Cause(ctx), errMaxChunks) {
+			ch <- gin.H{"error": stallError(ctx, err).Error()}
 		}
 	}()
 
 	if req.Stream != nil && !*req.Stream {
 		var resp api.ChatResponse
 		var toolCalls []api.ToolCall
+		var toolErrors []api.ToolCallError
 		var sbThinking strings.Builder
 		var sbContent strings.Builder
 		for rr := range ch {
@@ -1609,6 +2078,7 @@ func (s *Server) ChatHandler(c *gin.Context) {
 				resp = t
 				if len(req.Tools) > 0 {
 					toolCalls = append(toolCalls, t.Message.ToolCalls...)
+					toolErrors = append(toolErrors, t.ToolErrors...)
 				}
 			case gin.H:
 				msg, ok := t["error"].(string)
@@ -1630,6 +2100,7 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		if len(toolCalls) > 0 {
 			resp.Message.ToolCalls = toolCalls
 		}
+		resp.ToolErrors = toolErrors
 
 		c.JSON(http.StatusOK, resp)
 		return
@@ -1638,18 +2109,75 @@ func (s *Server) ChatHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
+// sendChat sends a chat response to be streamed. With typed events, the
+// response is tagged with the kind of event it carries and thinking is sent
+// apart from the content that follows it.
+func sendChat(ch chan<- any, res api.ChatResponse, typed bool) {
+	if !typed {
+		ch <- res
+		return
+	}
+
+	if !res.Done && res.Message.Thinking != "" && (res.Message.Content != "" || len(res.Message.ToolCalls) > 0 || len(res.ToolErrors) > 0) {
+		thinking := res
+		thinking.Message.Content = ""
+		thinking.Message.ToolCalls = nil
+		thinking.ToolErrors = nil
+		thinking.Type = api.ChatEventThinking
+		ch <- thinking
+
+		res.Message.Thinking = ""
+	}
+
+	switch {
+	case res.Done:
+		res.Type = api.ChatEventDone
+	case len(res.Message.ToolCalls) > 0 || len(res.ToolErrors) > 0:
+		res.Type = api.ChatEventToolCall
+	case res.Message.Thinking != "":
+		res.Type = api.ChatEventThinking
+	default:
+		res.Type = api.ChatEventContent
+	}
+
+	ch <- res
+}
+
+// usedCapabilities returns the optional capabilities a request used: those
+// it required of the model other than completion, and vision if its prompt
+// has images
+func usedCapabilities(caps []model.Capability, images int) []model.Capability {
+	var used []model.Capability
+	for _, c := range caps {
+		if c != model.CapabilityCompletion {
+			used = append(used, c)
+		}
+	}
+
+	if images > 0 {
+		used = append(used, model.CapabilityVision)
+	}
+
+	return used
+}
+
 func handleScheduleError(c *gin.Context, name string, err error) {
+	var lerr *loadError
 	switch {
 	case errors.Is(err, errCapabilities), errors.Is(err, errRequired):
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respond(c, http.StatusBadRequest, gin.H{"error": err.Error()})
 	case errors.Is(err, context.Canceled):
-		c.JSON(499, gin.H{"error": "request canceled"})
+		respond(c, 499, gin.H{"error": "request canceled"})
+	case errors.Is(err, errModelWriting):
+		respond(c, http.StatusConflict, gin.H{"error": err.Error()})
 	case errors.Is(err, ErrMaxQueue):
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		respond(c, http.StatusServiceUnavailable, gin.H{"error": err.Error(), "reason": api.LoadFailureCapacityExceeded})
 	case errors.Is(err, os.ErrNotExist):
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found, try pulling it first", name)})
+		respond(c, http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found, try pulling it first", name)})
+	case errors.As(err, &lerr):
+		respond(c, http.StatusInternalServerError, gin.H{"error": err.Error(), "reason": lerr.reason})
 	default:
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respond(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
 	}
 }
 
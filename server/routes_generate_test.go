@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -16,8 +20,10 @@ import (
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/fs/ggml"
 	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
 )
 
 type mockRunner struct {
@@ -27,6 +33,7 @@ type mockRunner struct {
 	llm.CompletionRequest
 	llm.CompletionResponse
 	CompletionFn func(context.Context, llm.CompletionRequest, func(llm.CompletionResponse)) error
+	DetokenizeFn func(context.Context, []int) (string, error)
 }
 
 func (m *mockRunner) Completion(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
@@ -38,6 +45,14 @@ func (m *mockRunner) Completion(ctx context.Context, r llm.CompletionRequest, fn
 	return nil
 }
 
+func (m *mockRunner) Detokenize(ctx context.Context, tokens []int) (string, error) {
+	return m.DetokenizeFn(ctx, tokens)
+}
+
+func (mockRunner) Ping(context.Context) error {
+	return nil
+}
+
 func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error) {
 	for range strings.Fields(s) {
 		tokens = append(tokens, len(tokens))
@@ -132,6 +147,19 @@ func TestGenerateChat(t *testing.T) {
 		t.Fatalf("expected status 200, got %d", w.Code)
 	}
 
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test-thinking",
+		From:  "test",
+		Template: `
+{{- range .Messages }}{{ .Role }}: {{ if .Thinking }}<think>{{ .Thinking }}</think>{{ end }}{{ .Content }}
+{{ end }}`,
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
 	t.Run("missing body", func(t *testing.T) {
 		w := createRequest(t, s.ChatHandler, nil)
 		if w.Code != http.StatusBadRequest {
@@ -162,6 +190,24 @@ func TestGenerateChat(t *testing.T) {
 		}
 	})
 
+	t.Run("num_keep and num_keep_messages", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Options: map[string]any{"num_keep": 4, "num_keep_messages": 2},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"request cannot set both num_keep and num_keep_messages"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
 	t.Run("missing model", func(t *testing.T) {
 		w := createRequest(t, s.ChatHandler, api.ChatRequest{})
 		if w.Code != http.StatusBadRequest {
@@ -228,6 +274,26 @@ func TestGenerateChat(t *testing.T) {
 		}
 	})
 
+	t.Run("load model with num_ctx", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:   "test",
+			Options: map[string]any{"num_ctx": 2048},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var actual api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.DoneReason != "load" || actual.NumCtx != 2048 {
+			t.Errorf("expected load response with num_ctx 2048, got done reason %q and num_ctx %d", actual.DoneReason, actual.NumCtx)
+		}
+	})
+
 	checkChatResponse := func(t *testing.T, body io.Reader, model, content string) {
 		t.Helper()
 
@@ -376,85 +442,121 @@ func TestGenerateChat(t *testing.T) {
 		checkChatResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
 
-	t.Run("messages with tools (non-streaming)", func(t *testing.T) {
-		if w.Code != http.StatusOK {
-			t.Fatalf("failed to create test-system model: %d", w.Code)
+	t.Run("messages with interleaved system and truncation", func(t *testing.T) {
+		for _, tt := range []struct {
+			name  string
+			order string
+			want  string
+		}{
+			{"hoist", "", "system: You are a helpful assistant.\n\nYou can perform magic tricks.\n\n[skipped]\nuser: Help me write tests.\n"},
+			{"position", "position", "system: You are a helpful assistant.\n\n[skipped]\n\nYou can perform magic tricks.\nuser: Help me write tests.\n"},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model: "test-system",
+					Messages: []api.Message{
+						{Role: "user", Content: "Hello!"},
+						{Role: "assistant", Content: "I can help you with that."},
+						{Role: "system", Content: "You can perform magic tricks."},
+						{Role: "user", Content: "Show me one."},
+						{Role: "assistant", Content: "Abra kadabra!"},
+						{Role: "user", Content: "Help me write tests."},
+					},
+					Options: map[string]any{"num_ctx": 19, "skip_marker": "[skipped]", "system_order": tt.order},
+					Stream:  &stream,
+				})
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+				}
+
+				if diff := cmp.Diff(mock.CompletionRequest.Prompt, tt.want); diff != "" {
+					t.Errorf("mismatch (-got +want):\n%s", diff)
+				}
+			})
 		}
+	})
 
-		tools := []api.Tool{
-			{
-				Type: "function",
-				Function: api.ToolFunction{
-					Name:        "get_weather",
-					Description: "Get the current weather",
-					Parameters: struct {
-						Type       string   `json:"type"`
-						Defs       any      `json:"$defs,omitempty"`
-						Items      any      `json:"items,omitempty"`
-						Required   []string `json:"required"`
-						Properties map[string]struct {
-							Type        api.PropertyType `json:"type"`
-							Items       any              `json:"items,omitempty"`
-							Description string           `json:"description"`
-							Enum        []any            `json:"enum,omitempty"`
-						} `json:"properties"`
-					}{
-						Type:     "object",
-						Required: []string{"location"},
-						Properties: map[string]struct {
-							Type        api.PropertyType `json:"type"`
-							Items       any              `json:"items,omitempty"`
-							Description string           `json:"description"`
-							Enum        []any            `json:"enum,omitempty"`
-						}{
-							"location": {
-								Type:        api.PropertyType{"string"},
-								Description: "The city and state",
-							},
-							"unit": {
-								Type: api.PropertyType{"string"},
-								Enum: []any{"celsius", "fahrenheit"},
-							},
-						},
-					},
-				},
+	t.Run("messages with truncation summarized", func(t *testing.T) {
+		t.Setenv("OLLAMA_SUMMARIZE_DROPPED", "1")
+		t.Setenv("OLLAMA_CONTEXT_STEP", "1024")
+
+		var summaries int
+		mock.CompletionFn = func(_ context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			if strings.HasPrefix(r.Prompt, "user: Summarize") {
+				summaries++
+				fn(llm.CompletionResponse{Content: " They talked at length. ", Done: true})
+				return nil
+			}
+
+			fn(mock.CompletionResponse)
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		// longer than the model's context length, so the sizing pass drops
+		// messages too but shouldn't summarize them
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: strings.Repeat("word ", 9000)},
+				{Role: "assistant", Content: "I can help you with that."},
+				{Role: "user", Content: "Help me write tests."},
 			},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
 		}
 
-		mock.CompletionResponse = llm.CompletionResponse{
-			Content:            `{"name":"get_weather","arguments":{"location":"Seattle, WA","unit":"celsius"}}`,
-			Done:               true,
-			DoneReason:         llm.DoneReasonStop,
-			PromptEvalCount:    1,
-			PromptEvalDuration: 1,
-			EvalCount:          1,
-			EvalDuration:       1,
+		if summaries != 1 {
+			t.Errorf("expected the dropped messages to be summarized once, got %d", summaries)
 		}
 
-		streamRequest := true
+		if !strings.Contains(mock.CompletionRequest.Prompt, "system: They talked at length.\n") {
+			t.Errorf("expected the summary in the prompt, got %q", mock.CompletionRequest.Prompt)
+		}
+	})
 
+	t.Run("messages with no context left for num_predict", func(t *testing.T) {
 		w := createRequest(t, s.ChatHandler, api.ChatRequest{
-			Model: "test-system",
+			Model: "test",
 			Messages: []api.Message{
-				{Role: "user", Content: "What's the weather in Seattle?"},
+				{Role: "user", Content: "Hi there friend"},
 			},
-			Tools:  tools,
-			Stream: &streamRequest,
+			Options: map[string]any{"num_ctx": 4, "num_predict": 10},
+			Stream:  &stream,
 		})
 
-		if w.Code != http.StatusOK {
-			var errResp struct {
-				Error string `json:"error"`
-			}
-			if err := json.NewDecoder(w.Body).Decode(&errResp); err != nil {
-				t.Logf("Failed to decode error response: %v", err)
-			} else {
-				t.Logf("Error response: %s", errResp.Error)
-			}
+		// the prompt "user: Hi there friend" is 4 tokens, filling the context
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
 		}
 
+		if !strings.Contains(w.Body.String(), errPromptFillsContext.Error()) {
+			t.Errorf("expected a prompt filling the context error, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("messages with overlong latest message and default num_predict", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hi there my good friend"},
+			},
+			Options: map[string]any{"num_ctx": 4},
+			Stream:  &stream,
+		})
+
+		// the prompt "user: Hi there my good friend" is 6 tokens, which the
+		// runner truncates to fit since no limit on the response was asked for
 		if w.Code != http.StatusOK {
-			t.Errorf("expected status 200, got %d", w.Code)
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if mock.CompletionRequest.Options.NumPredict != -1 {
+			t.Errorf("expected runner num_predict -1, got %d", mock.CompletionRequest.Options.NumPredict)
 		}
 
 		var resp api.ChatResponse
@@ -462,127 +564,1321 @@ func TestGenerateChat(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if resp.Message.ToolCalls == nil {
-			t.Error("expected tool calls, got nil")
+		if resp.NumPredictClamped {
+			t.Error("expected num_predict not to be reported as clamped")
 		}
+	})
 
-		expectedToolCall := api.ToolCall{
-			Function: api.ToolCallFunction{
-				Name: "get_weather",
-				Arguments: api.ToolCallFunctionArguments{
-					"location": "Seattle, WA",
-					"unit":     "celsius",
-				},
+	t.Run("messages with num_predict exceeding context", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
 			},
-		}
+			Options: map[string]any{"num_ctx": 16, "num_predict": 100},
+			Stream:  &stream,
+		})
 
-		if diff := cmp.Diff(resp.Message.ToolCalls[0], expectedToolCall); diff != "" {
-			t.Errorf("tool call mismatch (-got +want):\n%s", diff)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
 		}
-	})
 
-	t.Run("messages with tools (streaming)", func(t *testing.T) {
-		tools := []api.Tool{
-			{
-				Type: "function",
-				Function: api.ToolFunction{
-					Name:        "get_weather",
-					Description: "Get the current weather",
-					Parameters: struct {
-						Type       string   `json:"type"`
-						Defs       any      `json:"$defs,omitempty"`
-						Items      any      `json:"items,omitempty"`
-						Required   []string `json:"required"`
-						Properties map[string]struct {
-							Type        api.PropertyType `json:"type"`
-							Items       any              `json:"items,omitempty"`
-							Description string           `json:"description"`
-							Enum        []any            `json:"enum,omitempty"`
-						} `json:"properties"`
-					}{
-						Type:     "object",
-						Required: []string{"location"},
-						Properties: map[string]struct {
-							Type        api.PropertyType `json:"type"`
-							Items       any              `json:"items,omitempty"`
-							Description string           `json:"description"`
-							Enum        []any            `json:"enum,omitempty"`
-						}{
-							"location": {
-								Type:        api.PropertyType{"string"},
-								Description: "The city and state",
-							},
-							"unit": {
-								Type: api.PropertyType{"string"},
-								Enum: []any{"celsius", "fahrenheit"},
-							},
-						},
-					},
-				},
-			},
+		// the prompt "user: Hello!" is 2 tokens, leaving 14 for the response
+		if mock.CompletionRequest.Options.NumPredict != 14 {
+			t.Errorf("expected runner num_predict 14, got %d", mock.CompletionRequest.Options.NumPredict)
 		}
 
-		// Simulate streaming response with multiple chunks
-		var wg sync.WaitGroup
-		wg.Add(1)
-
-		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
-			defer wg.Done()
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
 
-			// Send chunks with small delays to simulate streaming
-			responses := []llm.CompletionResponse{
-				{
-					Content:            `{"name":"get_`,
-					Done:               false,
-					PromptEvalCount:    1,
-					PromptEvalDuration: 1,
-				},
-				{
-					Content:            `weather","arguments":{"location":"Seattle`,
-					Done:               false,
-					PromptEvalCount:    2,
-					PromptEvalDuration: 1,
-				},
-				{
-					Content:            `, WA","unit":"celsius"}}`,
-					Done:               true,
-					DoneReason:         llm.DoneReasonStop,
-					PromptEvalCount:    3,
-					PromptEvalDuration: 1,
-				},
-			}
+		if resp.NumPredict != 14 {
+			t.Errorf("expected num_predict 14, got %d", resp.NumPredict)
+		}
 
-			for _, resp := range responses {
-				select {
-				case <-ctx.Done():
-					return ctx.Err()
-				default:
-					fn(resp)
-					time.Sleep(10 * time.Millisecond) // Small delay between chunks
-				}
-			}
-			return nil
+		if !resp.NumPredictClamped {
+			t.Error("expected num_predict to be reported as clamped")
 		}
+	})
 
+	t.Run("messages with context headers", func(t *testing.T) {
 		w := createRequest(t, s.ChatHandler, api.ChatRequest{
-			Model: "test-system",
+			Model: "test",
 			Messages: []api.Message{
-				{Role: "user", Content: "What's the weather in Seattle?"},
+				{Role: "user", Content: "Hello!"},
 			},
-			Tools:  tools,
-			Stream: &stream,
+			Options: map[string]any{"num_ctx": 16},
+			Stream:  &stream,
 		})
 
-		wg.Wait()
-
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		used, err := strconv.Atoi(w.Header().Get("X-Context-Used"))
+		if err != nil {
+			t.Fatalf("invalid X-Context-Used header: %v", err)
+		}
+
+		limit, err := strconv.Atoi(w.Header().Get("X-Context-Limit"))
+		if err != nil {
+			t.Fatalf("invalid X-Context-Limit header: %v", err)
+		}
+
+		if used != 2 || limit != 16 {
+			t.Errorf("expected 2 of 16 context tokens used, got %d of %d", used, limit)
+		}
+
+		if used > limit {
+			t.Errorf("context used %d exceeds limit %d", used, limit)
+		}
+	})
+
+	t.Run("messages with length done reason", func(t *testing.T) {
+		mock.CompletionResponse.DoneReason = llm.DoneReasonLength
+		t.Cleanup(func() { mock.CompletionResponse.DoneReason = llm.DoneReasonStop })
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Options: map[string]any{"num_ctx": 16, "num_predict": 100},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.DoneReason != "length" {
+			t.Errorf("expected done reason length, got %s", resp.DoneReason)
+		}
+	})
+
+	t.Run("messages with tools and no tools template", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model: "test-notools",
+			From:  "test",
+			Template: `
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}`,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		tools := []api.Tool{{Type: "function", Function: api.ToolFunction{Name: "get_weather"}}}
+		req := api.ChatRequest{
+			Model: "test-notools",
+			Messages: []api.Message{
+				{Role: "user", Content: "What's the weather?"},
+			},
+			Tools:  tools,
+			Stream: &stream,
+		}
+
+		t.Run("strict", func(t *testing.T) {
+			w := createRequest(t, s.ChatHandler, req)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d", w.Code)
+			}
+
+			if diff := cmp.Diff(w.Body.String(), `{"error":"registry.ollama.ai/library/test-notools:latest does not support tools"}`); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+
+		t.Run("plan", func(t *testing.T) {
+			// rejected as the chat request is
+			w := createRequest(t, s.PlanHandler, req)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+
+			if diff := cmp.Diff(w.Body.String(), `{"error":"registry.ollama.ai/library/test-notools:latest does not support tools"}`); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			// unless the tools are described in a system message instead
+			t.Setenv("OLLAMA_TOOLS_IN_SYSTEM", "1")
+			w = createRequest(t, s.PlanHandler, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp api.PlanResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			// "user: What's the weather?" is 4 tokens
+			if resp.PromptEvalCount <= 4 {
+				t.Errorf("expected the tools message to be counted, got prompt_eval_count %d", resp.PromptEvalCount)
+			}
+		})
+
+		t.Run("system", func(t *testing.T) {
+			t.Setenv("OLLAMA_TOOLS_IN_SYSTEM", "1")
+
+			w := createRequest(t, s.ChatHandler, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+
+			expect := "system: " + toolsMessage(tools).Content + "\nuser: What's the weather?\n"
+			if diff := cmp.Diff(mock.CompletionRequest.Prompt, expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	})
+
+	t.Run("template digest", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:    "test-template",
+			From:     "test",
+			Template: `{{- range .Messages }}{{ .Content }}{{ end }}`,
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		chat := func(t *testing.T, model string, verbose bool) api.ChatResponse {
+			t.Helper()
+
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model: model,
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello!"},
+				},
+				Stream:  &stream,
+				Verbose: verbose,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+
+			var resp api.ChatResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			return resp
+		}
+
+		digest := func(t *testing.T, model string) string {
+			t.Helper()
+
+			resp := chat(t, model, true)
+			if !strings.HasPrefix(resp.TemplateDigest, "sha256:") {
+				t.Errorf("expected sha256 template digest, got %q", resp.TemplateDigest)
+			}
+
+			return resp.TemplateDigest
+		}
+
+		a, b := digest(t, "test"), digest(t, "test-template")
+		if a == b {
+			t.Errorf("expected different template digests, got %s for both", a)
+		}
+
+		if again := digest(t, "test"); again != a {
+			t.Errorf("expected template digest %s, got %s", a, again)
+		}
+
+		if resp := chat(t, "test", false); resp.TemplateDigest != "" {
+			t.Errorf("expected no template digest without verbose, got %s", resp.TemplateDigest)
+		}
+	})
+
+	t.Run("plan", func(t *testing.T) {
+		req := api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Options: map[string]any{"num_ctx": 16},
+		}
+
+		plan := func(t *testing.T, req api.ChatRequest, numCtx int) api.PlanResponse {
+			t.Helper()
+
+			w := createRequest(t, s.PlanHandler, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp api.PlanResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.NumCtx != numCtx {
+				t.Errorf("expected num_ctx %d, got %d", numCtx, resp.NumCtx)
+			}
+
+			if resp.PromptEvalCount != 2 {
+				t.Errorf("expected prompt_eval_count 2, got %d", resp.PromptEvalCount)
+			}
+
+			// earlier requests recorded the prompt evaluation rate
+			if resp.PromptEvalDuration <= 0 {
+				t.Errorf("expected estimated prompt_eval_duration, got %s", resp.PromptEvalDuration)
+			}
+
+			return resp
+		}
+
+		t.Run("not loaded", func(t *testing.T) {
+			resp := plan(t, req, 16)
+			if !resp.Reload {
+				t.Error("expected reload")
+			}
+
+			if !resp.Loaded {
+				t.Error("expected the plan to load the model")
+			}
+		})
+
+		t.Run("dynamic context length", func(t *testing.T) {
+			t.Setenv("OLLAMA_CONTEXT_STEP", "1024")
+
+			// sized as the chat request would be rather than with the
+			// default context length
+			req := api.ChatRequest{
+				Model:    "test",
+				Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			}
+
+			plan(t, req, 1024)
+		})
+
+		t.Run("loaded", func(t *testing.T) {
+			m, err := GetModel("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			opts, err := modelOptions(m, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.NumCtx = 16
+
+			// the plan references the runner, so keep it loaded once the
+			// plan releases it
+			s.sched.loadedMu.Lock()
+			s.sched.loaded[m.ModelPath] = &runnerRef{llama: &mock, model: m, Options: &opts, numParallel: 1, sessionDuration: time.Hour}
+			s.sched.loadedMu.Unlock()
+			t.Cleanup(func() {
+				s.sched.loadedMu.Lock()
+				delete(s.sched.loaded, m.ModelPath)
+				s.sched.loadedMu.Unlock()
+			})
+
+			resp := plan(t, req, 16)
+			if resp.Reload {
+				t.Error("expected no reload")
+			}
+
+			if resp.Loaded {
+				t.Error("expected the plan to use the loaded model")
+			}
+		})
+	})
+
+	t.Run("messages with tools (non-streaming)", func(t *testing.T) {
+		if w.Code != http.StatusOK {
+			t.Fatalf("failed to create test-system model: %d", w.Code)
+		}
+
+		tools := []api.Tool{
+			{
+				Type: "function",
+				Function: api.ToolFunction{
+					Name:        "get_weather",
+					Description: "Get the current weather",
+					Parameters: struct {
+						Type       string   `json:"type"`
+						Defs       any      `json:"$defs,omitempty"`
+						Items      any      `json:"items,omitempty"`
+						Required   []string `json:"required"`
+						Properties map[string]struct {
+							Type        api.PropertyType `json:"type"`
+							Items       any              `json:"items,omitempty"`
+							Description string           `json:"description"`
+							Enum        []any            `json:"enum,omitempty"`
+						} `json:"properties"`
+					}{
+						Type:     "object",
+						Required: []string{"location"},
+						Properties: map[string]struct {
+							Type        api.PropertyType `json:"type"`
+							Items       any              `json:"items,omitempty"`
+							Description string           `json:"description"`
+							Enum        []any            `json:"enum,omitempty"`
+						}{
+							"location": {
+								Type:        api.PropertyType{"string"},
+								Description: "The city and state",
+							},
+							"unit": {
+								Type: api.PropertyType{"string"},
+								Enum: []any{"celsius", "fahrenheit"},
+							},
+						},
+					},
+				},
+			},
+		}
+
+		mock.CompletionResponse = llm.CompletionResponse{
+			Content:            `{"name":"get_weather","arguments":{"location":"Seattle, WA","unit":"celsius"}}`,
+			Done:               true,
+			DoneReason:         llm.DoneReasonStop,
+			PromptEvalCount:    1,
+			PromptEvalDuration: 1,
+			EvalCount:          1,
+			EvalDuration:       1,
+		}
+
+		streamRequest := true
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-system",
+			Messages: []api.Message{
+				{Role: "user", Content: "What's the weather in Seattle?"},
+			},
+			Tools:  tools,
+			Stream: &streamRequest,
+		})
+
+		if w.Code != http.StatusOK {
+			var errResp struct {
+				Error string `json:"error"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&errResp); err != nil {
+				t.Logf("Failed to decode error response: %v", err)
+			} else {
+				t.Logf("Error response: %s", errResp.Error)
+			}
+		}
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Message.ToolCalls == nil {
+			t.Error("expected tool calls, got nil")
+		}
+
+		expectedToolCall := api.ToolCall{
+			Function: api.ToolCallFunction{
+				Name: "get_weather",
+				Arguments: api.ToolCallFunctionArguments{
+					"location": "Seattle, WA",
+					"unit":     "celsius",
+				},
+			},
+		}
+
+		if diff := cmp.Diff(resp.Message.ToolCalls[0], expectedToolCall); diff != "" {
+			t.Errorf("tool call mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("messages with invalid tool call", func(t *testing.T) {
+		var tools []api.Tool
+		if err := json.Unmarshal([]byte(`[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object","required":["location"],"properties":{"location":{"type":"string"},"unit":{"type":"string"}}}}}]`), &tools); err != nil {
+			t.Fatal(err)
+		}
+
+		mock.CompletionResponse = llm.CompletionResponse{
+			Content:            `{"name":"get_weather","arguments":{"unit":"celsius"}}`,
+			Done:               true,
+			DoneReason:         llm.DoneReasonStop,
+			PromptEvalCount:    1,
+			PromptEvalDuration: 1,
+			EvalCount:          1,
+			EvalDuration:       1,
+		}
+
+		for _, reject := range []bool{false, true} {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model: "test-system",
+				Messages: []api.Message{
+					{Role: "user", Content: "What's the weather?"},
+				},
+				Tools:              tools,
+				Stream:             &stream,
+				RejectInvalidTools: reject,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+
+			var resp api.ChatResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			call := api.ToolCall{
+				Function: api.ToolCallFunction{
+					Name:      "get_weather",
+					Arguments: api.ToolCallFunctionArguments{"unit": "celsius"},
+				},
+			}
+
+			want := []api.ToolCallError{{ToolCall: call, Errors: []string{`missing required argument "location"`}}}
+			if diff := cmp.Diff(want, resp.ToolErrors); diff != "" {
+				t.Errorf("tool errors mismatch (-want +got):\n%s", diff)
+			}
+
+			if reject {
+				if len(resp.Message.ToolCalls) != 0 {
+					t.Errorf("expected invalid tool call to be rejected, got %v", resp.Message.ToolCalls)
+				}
+			} else if diff := cmp.Diff([]api.ToolCall{call}, resp.Message.ToolCalls); diff != "" {
+				t.Errorf("tool calls mismatch (-want +got):\n%s", diff)
+			}
+		}
+	})
+
+	t.Run("messages with tools and images", func(t *testing.T) {
+		var tools []api.Tool
+		if err := json.Unmarshal([]byte(`[{"type":"function","function":{"name":"describe_image","parameters":{"type":"object","properties":{}}}}]`), &tools); err != nil {
+			t.Fatal(err)
+		}
+
+		mock.CompletionResponse = llm.CompletionResponse{
+			Content:    "A cat.",
+			Done:       true,
+			DoneReason: llm.DoneReasonStop,
+		}
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-system",
+			Messages: []api.Message{
+				{Role: "user", Content: "What is this?", Images: []api.ImageData{[]byte("image")}},
+			},
+			Tools:  tools,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]model.Capability{model.CapabilityTools, model.CapabilityVision}, resp.Capabilities); diff != "" {
+			t.Errorf("capabilities mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("messages with tools (streaming)", func(t *testing.T) {
+		tools := []api.Tool{
+			{
+				Type: "function",
+				Function: api.ToolFunction{
+					Name:        "get_weather",
+					Description: "Get the current weather",
+					Parameters: struct {
+						Type       string   `json:"type"`
+						Defs       any      `json:"$defs,omitempty"`
+						Items      any      `json:"items,omitempty"`
+						Required   []string `json:"required"`
+						Properties map[string]struct {
+							Type        api.PropertyType `json:"type"`
+							Items       any              `json:"items,omitempty"`
+							Description string           `json:"description"`
+							Enum        []any            `json:"enum,omitempty"`
+						} `json:"properties"`
+					}{
+						Type:     "object",
+						Required: []string{"location"},
+						Properties: map[string]struct {
+							Type        api.PropertyType `json:"type"`
+							Items       any              `json:"items,omitempty"`
+							Description string           `json:"description"`
+							Enum        []any            `json:"enum,omitempty"`
+						}{
+							"location": {
+								Type:        api.PropertyType{"string"},
+								Description: "The city and state",
+							},
+							"unit": {
+								Type: api.PropertyType{"string"},
+								Enum: []any{"celsius", "fahrenheit"},
+							},
+						},
+					},
+				},
+			},
+		}
+
+		// Simulate streaming response with multiple chunks
+		var wg sync.WaitGroup
+		wg.Add(1)
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			defer wg.Done()
+
+			// Send chunks with small delays to simulate streaming
+			responses := []llm.CompletionResponse{
+				{
+					Content:            `{"name":"get_`,
+					Done:               false,
+					PromptEvalCount:    1,
+					PromptEvalDuration: 1,
+				},
+				{
+					Content:            `weather","arguments":{"location":"Seattle`,
+					Done:               false,
+					PromptEvalCount:    2,
+					PromptEvalDuration: 1,
+				},
+				{
+					Content:            `, WA","unit":"celsius"}}`,
+					Done:               true,
+					DoneReason:         llm.DoneReasonStop,
+					PromptEvalCount:    3,
+					PromptEvalDuration: 1,
+				},
+			}
+
+			for _, resp := range responses {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				default:
+					fn(resp)
+					time.Sleep(10 * time.Millisecond) // Small delay between chunks
+				}
+			}
+			return nil
+		}
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-system",
+			Messages: []api.Message{
+				{Role: "user", Content: "What's the weather in Seattle?"},
+			},
+			Tools:  tools,
+			Stream: &stream,
+		})
+
+		wg.Wait()
+
 		if w.Code != http.StatusOK {
 			t.Errorf("expected status 200, got %d", w.Code)
 		}
 
-		// Read and validate the streamed responses
+		// Read and validate the streamed responses
+		decoder := json.NewDecoder(w.Body)
+		var finalToolCall api.ToolCall
+
+		for {
+			var resp api.ChatResponse
+			if err := decoder.Decode(&resp); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Done {
+				if len(resp.Message.ToolCalls) != 1 {
+					t.Errorf("expected 1 tool call in final response, got %d", len(resp.Message.ToolCalls))
+				}
+				finalToolCall = resp.Message.ToolCalls[0]
+			}
+		}
+
+		expectedToolCall := api.ToolCall{
+			Function: api.ToolCallFunction{
+				Name: "get_weather",
+				Arguments: api.ToolCallFunctionArguments{
+					"location": "Seattle, WA",
+					"unit":     "celsius",
+				},
+			},
+		}
+
+		if diff := cmp.Diff(finalToolCall, expectedToolCall); diff != "" {
+			t.Errorf("final tool call mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("messages with tools (buffered streaming)", func(t *testing.T) {
+		var tools []api.Tool
+		if err := json.Unmarshal([]byte(`[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object","properties":{"location":{"type":"string"}}}}}]`), &tools); err != nil {
+			t.Fatal(err)
+		}
+
+		mock.CompletionFn = func(ctx context.Context, _ llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: `{"name":"get_`})
+			fn(llm.CompletionResponse{Content: `weather","arguments":{"location":"Seattle"}}`})
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		streamRequest := true
+		req := api.ChatRequest{
+			Model: "test-system",
+			Messages: []api.Message{
+				{Role: "user", Content: "What's the weather in Seattle?"},
+			},
+			Tools:  tools,
+			Stream: &streamRequest,
+		}
+
+		t.Run("buffer", func(t *testing.T) {
+			t.Setenv("OLLAMA_TOOL_STREAMING", "buffer")
+
+			w := createRequest(t, s.ChatHandler, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var responses []api.ChatResponse
+			decoder := json.NewDecoder(w.Body)
+			for {
+				var resp api.ChatResponse
+				if err := decoder.Decode(&resp); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				responses = append(responses, resp)
+			}
+
+			if len(responses) != 1 || !responses[0].Done {
+				t.Fatalf("expected a single final response, got %+v", responses)
+			}
+
+			want := []api.ToolCall{{Function: api.ToolCallFunction{
+				Name:      "get_weather",
+				Arguments: api.ToolCallFunctionArguments{"location": "Seattle"},
+			}}}
+			if diff := cmp.Diff(want, responses[0].Message.ToolCalls); diff != "" {
+				t.Errorf("tool calls mismatch (-want +got):\n%s", diff)
+			}
+
+			if !slices.ContainsFunc(responses[0].Warnings, func(w string) bool { return strings.Contains(w, "buffered") }) {
+				t.Errorf("expected a warning about buffered tool calls, got %v", responses[0].Warnings)
+			}
+		})
+
+		t.Run("error", func(t *testing.T) {
+			t.Setenv("OLLAMA_TOOL_STREAMING", "error")
+
+			w := createRequest(t, s.ChatHandler, req)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	})
+
+	t.Run("dynamic context length with reserve", func(t *testing.T) {
+		t.Setenv("OLLAMA_CONTEXT_STEP", "1024")
+		mock.CompletionFn = nil
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:      "test-reserve",
+			From:       "test",
+			Parameters: map[string]any{"num_reserve": 2000},
+			Stream:     &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		numCtx := func(t *testing.T, model string) string {
+			t.Helper()
+
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model: model,
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello!"},
+				},
+				Stream: &stream,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			return w.Header().Get("X-Context-Limit")
+		}
+
+		if got := numCtx(t, "test"); got != "1024" {
+			t.Errorf("expected context limit 1024, got %s", got)
+		}
+
+		if got := numCtx(t, "test-reserve"); got != "2048" {
+			t.Errorf("expected context limit 2048, got %s", got)
+		}
+	})
+
+	t.Run("dynamic context length with prompt error", func(t *testing.T) {
+		t.Setenv("OLLAMA_CONTEXT_STEP", "1024")
+		t.Setenv("OLLAMA_SYSTEM_ONLY", "error")
+		mock.CompletionFn = nil
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "system", Content: "You are a helpful assistant."},
+			},
+			Stream: &stream,
+		})
+
+		// sizing the context length renders the prompt first, which should
+		// fail the same way as without dynamic sizing
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if !strings.Contains(w.Body.String(), errSystemOnly.Error()) {
+			t.Errorf("expected a system only error, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("dynamic context length rounded past model max", func(t *testing.T) {
+		t.Setenv("OLLAMA_CONTEXT_STEP", "3000")
+		mock.CompletionFn = nil
+
+		// the model's maximum context length of 8192 isn't a multiple of the step
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Options: map[string]any{"num_predict": float64(7000)},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if got := w.Header().Get("X-Context-Limit"); got != "8192" {
+			t.Errorf("expected context limit 8192, got %s", got)
+		}
+	})
+
+	t.Run("dynamic context length hysteresis", func(t *testing.T) {
+		t.Setenv("OLLAMA_CONTEXT_STEP", "1024")
+		mock.CompletionFn = nil
+
+		cases := []struct {
+			name       string
+			hysteresis string
+			numCtx     string
+			decision   api.NumCtxDecision
+		}{
+			{
+				name:     "disabled",
+				numCtx:   "5120",
+				decision: api.NumCtxDecision{Resident: 4096, Required: 4102},
+			},
+			{
+				name:       "reused",
+				hysteresis: "64",
+				numCtx:     "4096",
+				decision:   api.NumCtxDecision{Resident: 4096, Required: 4102, Reused: true},
+			},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				t.Setenv("OLLAMA_CTX_HYSTERESIS", tt.hysteresis)
+
+				// the conversation needs slightly more than the context
+				// length the request is first scheduled with
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model: "test",
+					Messages: []api.Message{
+						{Role: "user", Content: "Hello!"},
+					},
+					Options: map[string]any{"num_predict": float64(4100)},
+					Stream:  &stream,
+					Verbose: true,
+				})
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+				}
+
+				if got := w.Header().Get("X-Context-Limit"); got != tt.numCtx {
+					t.Errorf("expected context limit %s, got %s", tt.numCtx, got)
+				}
+
+				var resp api.ChatResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(resp.NumCtxDecision, &tt.decision); diff != "" {
+					t.Errorf("mismatch (-got +want):\n%s", diff)
+				}
+			})
+		}
+	})
+
+	t.Run("dynamic context length capped by vram", func(t *testing.T) {
+		t.Setenv("OLLAMA_CONTEXT_STEP", "1024")
+		mock.CompletionFn = nil
+
+		// each token of context uses 1 block * 8 kv heads * (128 + 128)
+		// elements * 2 bytes, so 8 MiB of free VRAM fits 2048 tokens beyond
+		// the resident 4096
+		getGpuFn := s.sched.getGpuFn
+		s.sched.getGpuFn = func() discover.GpuInfoList {
+			g := discover.GpuInfo{Library: "metal"}
+			g.TotalMemory = 24 * format.GigaByte
+			g.FreeMemory = 8 * format.MebiByte
+			return []discover.GpuInfo{g}
+		}
+		t.Cleanup(func() { s.sched.getGpuFn = getGpuFn })
+
+		cases := []struct {
+			name     string
+			cap      string
+			numCtx   string
+			cappedBy string
+		}{
+			{name: "disabled", numCtx: "7168"},
+			{name: "enabled", cap: "1", numCtx: "6144", cappedBy: "vram"},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				t.Setenv("OLLAMA_CTX_VRAM_CAP", tt.cap)
+
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model: "test",
+					Messages: []api.Message{
+						{Role: "user", Content: "Hello!"},
+					},
+					Options: map[string]any{"num_predict": float64(7000)},
+					Stream:  &stream,
+					Verbose: true,
+				})
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+				}
+
+				if got := w.Header().Get("X-Context-Limit"); got != tt.numCtx {
+					t.Errorf("expected context limit %s, got %s", tt.numCtx, got)
+				}
+
+				var resp api.ChatResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.NumCtxDecision == nil || resp.NumCtxDecision.CappedBy != tt.cappedBy {
+					t.Errorf("expected context length capped by %q, got %+v", tt.cappedBy, resp.NumCtxDecision)
+				}
+			})
+		}
+	})
+
+	t.Run("dynamic context length with tool rounds", func(t *testing.T) {
+		t.Setenv("OLLAMA_CONTEXT_STEP", "1024")
+		mock.CompletionFn = nil
+
+		tools := []api.Tool{{Type: "function", Function: api.ToolFunction{Name: "get_weather"}}}
+		for rounds, expect := range map[int]string{0: "1024", 3: "2048", 6: "3072"} {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model: "test",
+				Messages: []api.Message{
+					{Role: "user", Content: "What's the weather?"},
+				},
+				Tools:   tools,
+				Options: map[string]any{"tool_rounds": float64(rounds), "tool_round_tokens": float64(500)},
+				Stream:  &stream,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			if got := w.Header().Get("X-Context-Limit"); got != expect {
+				t.Errorf("%d rounds: expected context limit %s, got %s", rounds, expect, got)
+			}
+		}
+	})
+
+	t.Run("dynamic context length with num_predict above model max", func(t *testing.T) {
+		t.Setenv("OLLAMA_CONTEXT_STEP", "1024")
+		mock.CompletionFn = nil
+
+		chat := func(t *testing.T) *httptest.ResponseRecorder {
+			t.Helper()
+			return createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model: "test",
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello!"},
+				},
+				// the model's maximum context length is 8192
+				Options: map[string]any{"num_predict": float64(20000)},
+				Stream:  &stream,
+			})
+		}
+
+		w := chat(t)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if got := w.Header().Get("X-Context-Limit"); got != "8192" {
+			t.Errorf("expected context limit 8192, got %s", got)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		used, err := strconv.Atoi(w.Header().Get("X-Context-Used"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !resp.NumPredictClamped || resp.NumPredict != 8192-used {
+			t.Errorf("expected num_predict clamped to %d, got %d (clamped %t)", 8192-used, resp.NumPredict, resp.NumPredictClamped)
+		}
+
+		t.Setenv("OLLAMA_PREDICT_OVERFLOW", "error")
+		if w := chat(t); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("dynamic context length above model max", func(t *testing.T) {
+		t.Setenv("OLLAMA_CONTEXT_STEP", "1024")
+		mock.CompletionFn = nil
+
+		numCtx := func(t *testing.T, limit string, options map[string]any) string {
+			t.Helper()
+			t.Setenv("OLLAMA_MAX_CONTEXT", limit)
+
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model: "test",
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello!"},
+				},
+				Options: options,
+				Stream:  &stream,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			return w.Header().Get("X-Context-Limit")
+		}
+
+		// the model's maximum context length is 8192
+		if got := numCtx(t, "16384", map[string]any{"num_predict": 12000}); got != "8192" {
+			t.Errorf("expected context limit 8192, got %s", got)
+		}
+
+		if got := numCtx(t, "16384", map[string]any{"num_predict": 12000, "num_ctx_max": 32768}); got != "12288" {
+			t.Errorf("expected context limit 12288, got %s", got)
+		}
+
+		if got := numCtx(t, "10240", map[string]any{"num_predict": 12000, "num_ctx_max": 32768}); got != "10240" {
+			t.Errorf("expected context limit 10240, got %s", got)
+		}
+
+		if got := numCtx(t, "", map[string]any{"num_predict": 12000, "num_ctx_max": 32768}); got != "8192" {
+			t.Errorf("expected context limit 8192, got %s", got)
+		}
+	})
+
+	t.Run("context length above model max", func(t *testing.T) {
+		mock.CompletionFn = nil
+
+		numCtx := func(t *testing.T, limit string, options map[string]any) string {
+			t.Helper()
+			t.Setenv("OLLAMA_MAX_CONTEXT", limit)
+
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model: "test",
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello!"},
+				},
+				Options: options,
+				Stream:  &stream,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			return w.Header().Get("X-Context-Limit")
+		}
+
+		// without dynamic sizing, num_ctx is capped at the model's maximum
+		// context length of 8192 unless num_ctx_max raises it
+		if got := numCtx(t, "16384", map[string]any{"num_ctx": 12288}); got != "8192" {
+			t.Errorf("expected context limit 8192, got %s", got)
+		}
+
+		if got := numCtx(t, "16384", map[string]any{"num_ctx": 12288, "num_ctx_max": 32768}); got != "12288" {
+			t.Errorf("expected context limit 12288, got %s", got)
+		}
+
+		if got := numCtx(t, "10240", map[string]any{"num_ctx": 12288, "num_ctx_max": 32768}); got != "10240" {
+			t.Errorf("expected context limit 10240, got %s", got)
+		}
+
+		if got := numCtx(t, "", map[string]any{"num_ctx": 12288, "num_ctx_max": 32768}); got != "8192" {
+			t.Errorf("expected context limit 8192, got %s", got)
+		}
+	})
+
+	t.Run("verbose sizing", func(t *testing.T) {
+		mock.CompletionFn = nil
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Stream:  &stream,
+			Verbose: true,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := &api.ModelSizing{
+			ContextLength: 8192,
+			BlockCount:    1,
+			HeadCount:     32,
+			HeadCountKV:   8,
+			KeyLength:     128,
+			ValueLength:   128,
+		}
+
+		if diff := cmp.Diff(resp.Sizing, expect); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("verbose think set", func(t *testing.T) {
+		mock.CompletionFn = nil
+
+		think := false
+		for _, tt := range []struct {
+			name  string
+			think *bool
+		}{
+			{name: "unset"},
+			{name: "false", think: &think},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model:    "test",
+					Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+					Think:    tt.think,
+					Stream:   &stream,
+					Verbose:  true,
+				})
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+				}
+
+				var resp api.ChatResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.Think == nil || *resp.Think {
+					t.Errorf("expected think false, got %v", resp.Think)
+				}
+
+				if expect := tt.think != nil; resp.IsThinkSet == nil || *resp.IsThinkSet != expect {
+					t.Errorf("expected is_think_set %t, got %v", expect, resp.IsThinkSet)
+				}
+			})
+		}
+	})
+
+	t.Run("stall timeout", func(t *testing.T) {
+		t.Setenv("OLLAMA_STALL_TIMEOUT", "50ms")
+
+		chat := func(t *testing.T, first, interval time.Duration) *httptest.ResponseRecorder {
+			t.Helper()
+
+			mock.CompletionFn = func(ctx context.Context, _ llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+				for i := range 4 {
+					wait := interval
+					if i == 0 {
+						wait = first
+					}
+
+					select {
+					case <-time.After(wait):
+						fn(llm.CompletionResponse{Content: "Hi"})
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+
+				fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop})
+				return nil
+			}
+			t.Cleanup(func() { mock.CompletionFn = nil })
+
+			return createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model: "test",
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello!"},
+				},
+				Stream: &stream,
+			})
+		}
+
+		// chunks arrive more often than the timeout even though the whole
+		// generation takes longer
+		if w := chat(t, 20*time.Millisecond, 20*time.Millisecond); w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		// evaluating a long prompt before the first chunk doesn't stall
+		if w := chat(t, 200*time.Millisecond, 20*time.Millisecond); w.Code != http.StatusOK {
+			t.Errorf("expected status 200 with a slow first chunk, got %d: %s", w.Code, w.Body.String())
+		}
+
+		w := chat(t, 20*time.Millisecond, 200*time.Millisecond)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("expected status 500, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"generation stalled"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("remaining budget", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, _ llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			for _, content := range []string{"Hello", " there", ", how", " are", " you"} {
+				fn(llm.CompletionResponse{Content: content})
+			}
+
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop, PromptEvalCount: 2, EvalCount: 5})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		streamRequest := true
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Options:         map[string]any{"num_ctx": float64(64)},
+			Stream:          &streamRequest,
+			ReportRemaining: true,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		prompt, err := mockRunner{}.Tokenize(t.Context(), mock.CompletionRequest.Prompt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var remaining []int
 		decoder := json.NewDecoder(w.Body)
-		var finalToolCall api.ToolCall
+		for {
+			var resp api.ChatResponse
+			if err := decoder.Decode(&resp); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Remaining == nil {
+				t.Fatalf("expected remaining budget on every response, got %+v", resp)
+			}
+			remaining = append(remaining, *resp.Remaining)
+		}
+
+		// the final response reports the runner's count of generated tokens
+		budget := 64 - len(prompt)
+		want := []int{budget - 1, budget - 2, budget - 3, budget - 4, budget - 5, budget - 5}
+		if diff := cmp.Diff(want, remaining); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("max chunks", func(t *testing.T) {
+		var emitted int
+		mock.CompletionFn = func(ctx context.Context, _ llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			// a runaway generation which keeps emitting tiny chunks until it
+			// is stopped
+			for emitted = 0; emitted < 1000 && ctx.Err() == nil; emitted++ {
+				fn(llm.CompletionResponse{Content: "."})
+			}
+
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop, EvalCount: emitted})
+			return ctx.Err()
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		streamRequest := true
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Stream:    &streamRequest,
+			MaxChunks: 5,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
 
+		var responses []api.ChatResponse
+		decoder := json.NewDecoder(w.Body)
 		for {
 			var resp api.ChatResponse
 			if err := decoder.Decode(&resp); err == io.EOF {
@@ -590,27 +1886,595 @@ func TestGenerateChat(t *testing.T) {
 			} else if err != nil {
 				t.Fatal(err)
 			}
+			responses = append(responses, resp)
+		}
 
-			if resp.Done {
-				if len(resp.Message.ToolCalls) != 1 {
-					t.Errorf("expected 1 tool call in final response, got %d", len(resp.Message.ToolCalls))
+		if len(responses) != 5 {
+			t.Fatalf("expected 5 responses, got %d: %+v", len(responses), responses)
+		}
+
+		final := responses[len(responses)-1]
+		if !final.Done || final.DoneReason != "length" || final.EvalCount != 5 {
+			t.Errorf("expected generation to stop with done reason length after 5 chunks, got %+v", final)
+		}
+
+		if emitted != 5 {
+			t.Errorf("expected the runner to stop after 5 chunks, emitted %d", emitted)
+		}
+	})
+
+	t.Run("thinking truncated", func(t *testing.T) {
+		for _, tt := range []struct {
+			name    string
+			content []string
+			expect  bool
+		}{
+			{name: "closed", content: []string{"<think>Let me", " consider</think>", "Hello"}, expect: false},
+			{name: "open", content: []string{"<think>Let me", " consider"}, expect: true},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				mock.CompletionFn = func(ctx context.Context, _ llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+					for _, content := range tt.content {
+						fn(llm.CompletionResponse{Content: content})
+					}
+					fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonLength})
+					return nil
+				}
+				t.Cleanup(func() { mock.CompletionFn = nil })
+
+				think := true
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model: "test-thinking",
+					Messages: []api.Message{
+						{Role: "user", Content: "Hello!"},
+					},
+					Think:  &think,
+					Stream: &stream,
+				})
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", w.Code)
+				}
+
+				var resp api.ChatResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.Message.Thinking != "Let me consider" {
+					t.Errorf("expected thinking %q, got %q", "Let me consider", resp.Message.Thinking)
+				}
+
+				if resp.ThinkingTruncated != tt.expect {
+					t.Errorf("expected thinking_truncated %t, got %t", tt.expect, resp.ThinkingTruncated)
+				}
+			})
+		}
+	})
+
+	t.Run("typed events", func(t *testing.T) {
+		events := func(t *testing.T, req api.ChatRequest, content ...string) []api.ChatEventType {
+			t.Helper()
+
+			mock.CompletionFn = func(ctx context.Context, _ llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+				for _, c := range content {
+					fn(llm.CompletionResponse{Content: c})
+				}
+				fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop})
+				return nil
+			}
+			t.Cleanup(func() { mock.CompletionFn = nil })
+
+			streamRequest := true
+			req.Messages = []api.Message{{Role: "user", Content: "Hello!"}}
+			req.Stream = &streamRequest
+			req.TypedEvents = true
+			w := createRequest(t, s.ChatHandler, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+
+			var types []api.ChatEventType
+			decoder := json.NewDecoder(w.Body)
+			for {
+				var resp api.ChatResponse
+				if err := decoder.Decode(&resp); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				types = append(types, resp.Type)
+			}
+			return types
+		}
+
+		t.Run("thinking", func(t *testing.T) {
+			think := true
+			got := events(t, api.ChatRequest{Model: "test-thinking", Think: &think}, "<think>Plan", " ahead</think>Hi", " there")
+
+			// thinking and content generated together are sent separately
+			want := []api.ChatEventType{api.ChatEventThinking, api.ChatEventThinking, api.ChatEventContent, api.ChatEventContent, api.ChatEventDone}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+
+		t.Run("tool call", func(t *testing.T) {
+			tools := []api.Tool{{Type: "function", Function: api.ToolFunction{Name: "get_weather"}}}
+			got := events(t, api.ChatRequest{Model: "test", Tools: tools}, `{"name": "get_weather", "arguments": {}}`)
+
+			want := []api.ChatEventType{api.ChatEventToolCall, api.ChatEventDone}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	})
+
+	t.Run("messages and prompt", func(t *testing.T) {
+		body := map[string]any{
+			"model":    "test",
+			"messages": []api.Message{{Role: "user", Content: "Hello!"}},
+			"prompt":   "Goodbye!",
+			"stream":   false,
+		}
+
+		t.Run("lenient", func(t *testing.T) {
+			w := createRequest(t, s.ChatHandler, body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+
+			if diff := cmp.Diff("user: Hello!\n", mock.CompletionRequest.Prompt); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+
+		t.Run("strict", func(t *testing.T) {
+			t.Setenv("OLLAMA_MIXED_INPUT", "error")
+
+			w := createRequest(t, s.ChatHandler, body)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d", w.Code)
+			}
+
+			if diff := cmp.Diff(`{"error":"request cannot set both messages and prompt"}`, w.Body.String()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	})
+
+	t.Run("server default num_predict", func(t *testing.T) {
+		t.Setenv("OLLAMA_NUM_PREDICT", "5")
+
+		for _, tt := range []struct {
+			name    string
+			options map[string]any
+			expect  int
+		}{
+			{name: "omitted", expect: 5},
+			{name: "requested", options: map[string]any{"num_predict": float64(7)}, expect: 7},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				streamRequest := false
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model: "test",
+					Messages: []api.Message{
+						{Role: "user", Content: "Hello!"},
+					},
+					Options: tt.options,
+					Stream:  &streamRequest,
+				})
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", w.Code)
+				}
+
+				if got := mock.CompletionRequest.Options.NumPredict; got != tt.expect {
+					t.Errorf("expected num_predict %d, got %d", tt.expect, got)
+				}
+			})
+		}
+	})
+
+	t.Run("prompt cache count", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, _ llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi!"})
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop, PromptEvalCount: 3, PromptCacheCount: 12, EvalCount: 1})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		streamRequest := false
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Stream: &streamRequest,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// tokens reused from the cache are reported apart from those evaluated
+		if resp.PromptCacheCount != 12 || resp.PromptEvalCount != 3 {
+			t.Errorf("expected 12 cached and 3 evaluated prompt tokens, got %d and %d", resp.PromptCacheCount, resp.PromptEvalCount)
+		}
+	})
+
+	t.Run("prompt cache hit", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, _ llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi!"})
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop, PromptCacheCount: 12, EvalCount: 1, EvalDuration: 1})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		cases := []struct {
+			mode   string
+			expect int
+		}{
+			{mode: "", expect: 0},
+			{mode: "cached", expect: 12},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.mode, func(t *testing.T) {
+				t.Setenv("OLLAMA_CACHE_HIT_EVAL", tt.mode)
+
+				streamRequest := false
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model: "test",
+					Messages: []api.Message{
+						{Role: "user", Content: "Hello!"},
+					},
+					Stream: &streamRequest,
+				})
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", w.Code)
+				}
+
+				var resp api.ChatResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.Message.Content != "Hi!" || resp.DoneReason != "stop" || resp.EvalCount != 1 {
+					t.Errorf("expected a complete response, got %+v", resp)
+				}
+
+				if !resp.PromptCacheHit {
+					t.Error("expected prompt cache hit")
+				}
+
+				if resp.PromptCacheCount != 12 || resp.PromptEvalCount != tt.expect {
+					t.Errorf("expected 12 cached and %d evaluated prompt tokens, got %d and %d", tt.expect, resp.PromptCacheCount, resp.PromptEvalCount)
+				}
+			})
+		}
+	})
+
+	t.Run("peak vram", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, _ llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi!"})
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop, PeakVRAM: 3 << 30})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		for _, verbose := range []bool{false, true} {
+			streamRequest := false
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model: "test",
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello!"},
+				},
+				Stream:  &streamRequest,
+				Verbose: verbose,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+
+			var resp api.ChatResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			var expect uint64
+			if verbose {
+				expect = 3 << 30
+			}
+
+			if resp.PeakVRAM != expect {
+				t.Errorf("verbose %t: expected peak vram %d, got %d", verbose, expect, resp.PeakVRAM)
+			}
+		}
+	})
+
+	t.Run("all messages included", func(t *testing.T) {
+		long := []api.Message{
+			{Role: "user", Content: strings.Repeat("word ", 20)},
+			{Role: "assistant", Content: strings.Repeat("word ", 20)},
+			{Role: "user", Content: "Hello!"},
+		}
+
+		cases := []struct {
+			name     string
+			messages []api.Message
+			expect   bool
+		}{
+			{name: "short", messages: []api.Message{{Role: "user", Content: "Hello!"}}, expect: true},
+			{name: "long", messages: long, expect: false},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				streamRequest := false
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model:    "test",
+					Messages: tt.messages,
+					Options:  map[string]any{"num_ctx": float64(16)},
+					Stream:   &streamRequest,
+					Verbose:  true,
+				})
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", w.Code)
+				}
+
+				var resp api.ChatResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.AllMessagesIncluded == nil || *resp.AllMessagesIncluded != tt.expect {
+					t.Errorf("expected all messages included %t, got %v", tt.expect, resp.AllMessagesIncluded)
+				}
+			})
+		}
+	})
+
+	t.Run("truncation metrics", func(t *testing.T) {
+		s.truncation = truncationMetrics{}
+
+		long := []api.Message{
+			{Role: "user", Content: strings.Repeat("word ", 20)},
+			{Role: "assistant", Content: strings.Repeat("word ", 20)},
+			{Role: "user", Content: "Hello!"},
+		}
+
+		for _, messages := range [][]api.Message{
+			{{Role: "user", Content: "Hello!"}},
+			long,
+			{{Role: "user", Content: "Hello!"}},
+			append(long[:2:2], api.Message{Role: "user", Content: strings.Repeat("word ", 5)}),
+		} {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:    "test",
+				Messages: messages,
+				Options:  map[string]any{"num_ctx": float64(16)},
+				Stream:   &stream,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+		}
+
+		w := createRequest(t, s.MetricsHandler, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.MetricsResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// both truncated conversations drop the same two 21 token messages
+		// and the longest is those messages followed by a 6 token message
+		expect := []api.ModelMetrics{{
+			Model:                 "test:latest",
+			Requests:              4,
+			TruncatedRequests:     2,
+			AvgTokensRemoved:      42,
+			MaxConversationTokens: 48,
+		}}
+		if diff := cmp.Diff(expect, resp.Models); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("skip marker option", func(t *testing.T) {
+		t.Setenv("OLLAMA_SKIP_MARKER", "[history omitted]")
+
+		marker := api.Message{Role: "system", Content: "[historial omitido]"}
+		long := []api.Message{
+			{Role: "user", Content: strings.Repeat("word ", 20)},
+			{Role: "assistant", Content: strings.Repeat("word ", 20)},
+		}
+
+		// the second turn repeats the marker of the first, which is replaced
+		// rather than repeated when the conversation is truncated again
+		for _, messages := range [][]api.Message{
+			append(slices.Clone(long), api.Message{Role: "user", Content: "Hello!"}),
+			append(append([]api.Message{marker}, long...), api.Message{Role: "user", Content: "Again!"}),
+		} {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:    "test",
+				Messages: messages,
+				Options:  map[string]any{"num_ctx": float64(16), "skip_marker": marker.Content},
+				Stream:   &stream,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			expect := "system: [historial omitido]\nuser: " + messages[len(messages)-1].Content + "\n"
+			if diff := cmp.Diff(mock.CompletionRequest.Prompt, expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		}
+	})
+
+	t.Run("truncation summary", func(t *testing.T) {
+		long := []api.Message{
+			{Role: "user", Content: strings.Repeat("word ", 20)},
+			{Role: "assistant", Content: strings.Repeat("word ", 20)},
+			{Role: "user", Content: "Hello!"},
+		}
+
+		for _, tt := range []struct {
+			name     string
+			messages []api.Message
+			expect   *api.TruncationSummary
+		}{
+			{name: "fit", messages: long[2:]},
+			{
+				name:     "trimmed",
+				messages: long,
+				expect: &api.TruncationSummary{
+					OriginalMessageCount: 3,
+					FinalMessageCount:    1,
+					MessagesRemoved:      2,
+					FinalTokenCount:      2,
+				},
+			},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model:    "test",
+					Messages: tt.messages,
+					Options:  map[string]any{"num_ctx": float64(16)},
+					Stream:   &stream,
+				})
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+				}
+
+				var resp api.ChatResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(tt.expect, resp.TruncationSummary); diff != "" {
+					t.Errorf("mismatch (-want +got):\n%s", diff)
+				}
+			})
+		}
+	})
+
+	t.Run("extreme truncation", func(t *testing.T) {
+		// both earlier messages are dropped, leaving only the latest
+		messages := []api.Message{
+			{Role: "user", Content: strings.Repeat("word ", 20)},
+			{Role: "assistant", Content: strings.Repeat("word ", 20)},
+			{Role: "user", Content: "Hello!"},
+		}
+
+		for _, tt := range []struct {
+			name      string
+			threshold string
+			expect    bool
+		}{
+			{name: "default", expect: true},
+			{name: "at threshold", threshold: "2", expect: true},
+			{name: "below threshold", threshold: "3", expect: false},
+			{name: "disabled", threshold: "0", expect: false},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				t.Setenv("OLLAMA_EXTREME_TRUNC", tt.threshold)
+
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model:    "test",
+					Messages: messages,
+					Options:  map[string]any{"num_ctx": float64(16)},
+					Stream:   &stream,
+				})
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+				}
+
+				var resp api.ChatResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.Truncation != api.TruncationAllIntermediateDropped {
+					t.Errorf("expected truncation %q, got %q", api.TruncationAllIntermediateDropped, resp.Truncation)
+				}
+
+				if resp.ExtremeTruncation != tt.expect {
+					t.Errorf("expected extreme truncation %t, got %t", tt.expect, resp.ExtremeTruncation)
+				}
+
+				if warned := slices.ContainsFunc(resp.Warnings, func(w string) bool { return strings.HasPrefix(w, "extreme truncation") }); warned != tt.expect {
+					t.Errorf("expected warning %t, got %v", tt.expect, resp.Warnings)
 				}
-				finalToolCall = resp.Message.ToolCalls[0]
-			}
+			})
 		}
+	})
 
-		expectedToolCall := api.ToolCall{
-			Function: api.ToolCallFunction{
-				Name: "get_weather",
-				Arguments: api.ToolCallFunctionArguments{
-					"location": "Seattle, WA",
-					"unit":     "celsius",
-				},
-			},
+	t.Run("create in progress", func(t *testing.T) {
+		// the model is being created when the chat request arrives
+		written := s.writes.begin("test-creating")
+
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			done <- createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:    "test-creating",
+				Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+				Stream:   &stream,
+			})
+		}()
+
+		select {
+		case w := <-done:
+			t.Fatalf("expected chat to wait for the model, got status %d: %s", w.Code, w.Body.String())
+		case <-time.After(50 * time.Millisecond):
 		}
 
-		if diff := cmp.Diff(finalToolCall, expectedToolCall); diff != "" {
-			t.Errorf("final tool call mismatch (-got +want):\n%s", diff)
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:  "test-creating",
+			From:   "test",
+			Stream: &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+		written()
+
+		select {
+		case w := <-done:
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("chat did not finish after the model was created")
+		}
+	})
+
+	t.Run("create in progress error", func(t *testing.T) {
+		t.Setenv("OLLAMA_CREATE_CONFLICT", "error")
+
+		written := s.writes.begin("test-creating-error")
+		defer written()
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test-creating-error",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   &stream,
+		})
+		if w.Code != http.StatusConflict {
+			t.Errorf("expected status 409, got %d: %s", w.Code, w.Body.String())
 		}
 	})
 }
@@ -785,6 +2649,26 @@ func TestGenerate(t *testing.T) {
 		}
 	})
 
+	t.Run("load model with num_ctx", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Options: map[string]any{"num_ctx": 2048},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var actual api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.DoneReason != "load" || actual.NumCtx != 2048 {
+			t.Errorf("expected load response with num_ctx 2048, got done reason %q and num_ctx %d", actual.DoneReason, actual.NumCtx)
+		}
+	})
+
 	checkGenerateResponse := func(t *testing.T, body io.Reader, model, content string) {
 		t.Helper()
 
@@ -867,6 +2751,86 @@ func TestGenerate(t *testing.T) {
 		t.Fatalf("expected status 200, got %d", w.Code)
 	}
 
+	t.Run("resume", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Once upon", Done: true, DoneReason: llm.DoneReasonLength})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Tell a story",
+			Options: map[string]any{"num_predict": 2},
+			Stream:  &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var partial api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&partial); err != nil {
+			t.Fatal(err)
+		}
+
+		if partial.DoneReason != "length" || len(partial.Context) == 0 {
+			t.Fatalf("expected a partial response with context, got %+v", partial)
+		}
+
+		// the context encodes the prompt and the partial response, which is
+		// continued rather than followed by a new turn
+		mock.DetokenizeFn = func(_ context.Context, tokens []int) (string, error) {
+			if len(tokens) != len(partial.Context) {
+				t.Errorf("expected %d context tokens, got %d", len(partial.Context), len(tokens))
+			}
+			return "User: Tell a story Once upon", nil
+		}
+		t.Cleanup(func() { mock.DetokenizeFn = nil })
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: " a time", Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Context: partial.Context,
+			Resume:  true,
+			Stream:  &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff("User: Tell a story Once upon", mock.CompletionRequest.Prompt); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		var resumed api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resumed); err != nil {
+			t.Fatal(err)
+		}
+
+		if resumed.Response != " a time" || resumed.DoneReason != "stop" {
+			t.Errorf("expected the response to be continued, got %+v", resumed)
+		}
+
+		if len(resumed.Context) <= len(partial.Context) {
+			t.Errorf("expected the context to grow from %d tokens, got %d", len(partial.Context), len(resumed.Context))
+		}
+	})
+
+	t.Run("resume without context", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Resume: true,
+			Stream: &stream,
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
 	t.Run("prompt with model system", func(t *testing.T) {
 		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
 			Model:  "test-system",
@@ -939,6 +2903,31 @@ func TestGenerate(t *testing.T) {
 		t.Fatalf("expected status 200, got %d", w.Code)
 	}
 
+	t.Run("prompt and messages", func(t *testing.T) {
+		body := map[string]any{
+			"model":    "test",
+			"prompt":   "Hello!",
+			"messages": []api.Message{{Role: "user", Content: "Goodbye!"}},
+			"stream":   false,
+		}
+
+		w := createRequest(t, s.GenerateHandler, body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if strings.Contains(mock.CompletionRequest.Prompt, "Goodbye!") {
+			t.Errorf("expected messages to be ignored, got prompt %q", mock.CompletionRequest.Prompt)
+		}
+
+		t.Setenv("OLLAMA_MIXED_INPUT", "error")
+
+		w = createRequest(t, s.GenerateHandler, body)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d", w.Code)
+		}
+	})
+
 	t.Run("prompt with suffix", func(t *testing.T) {
 		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
 			Model:  "test-suffix",
@@ -985,5 +2974,343 @@ func TestGenerate(t *testing.T) {
 		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "Help me write tests."); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
+
+		if mock.CompletionRequest.Options.AddBOS != nil {
+			t.Errorf("expected add_bos unset, got %v", *mock.CompletionRequest.Options.AddBOS)
+		}
+	})
+
+	t.Run("raw verbose", func(t *testing.T) {
+		for _, tt := range []struct {
+			name   string
+			prompt string
+			expect api.ContextFit
+		}{
+			{name: "fits", prompt: "Help me write tests.", expect: api.ContextFit{Tokens: 4, NumCtx: 8, Fits: true}},
+			{name: "too long", prompt: "Help me write tests for the handlers in this package.", expect: api.ContextFit{Tokens: 10, NumCtx: 8}},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+					Model:   "test-system",
+					Prompt:  tt.prompt,
+					Raw:     true,
+					Verbose: true,
+					Options: map[string]any{"num_ctx": float64(8)},
+					Stream:  &stream,
+				})
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", w.Code)
+				}
+
+				// the prompt is passed through as it is
+				if diff := cmp.Diff(tt.prompt, mock.CompletionRequest.Prompt); diff != "" {
+					t.Errorf("mismatch (-want +got):\n%s", diff)
+				}
+
+				var resp api.GenerateResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(&tt.expect, resp.ContextFit); diff != "" {
+					t.Errorf("mismatch (-want +got):\n%s", diff)
+				}
+			})
+		}
+	})
+
+	t.Run("raw without bos", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test-system",
+			Prompt:  "Help me write tests.",
+			Raw:     true,
+			Options: map[string]any{"add_bos": false},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if addBOS := mock.CompletionRequest.Options.AddBOS; addBOS == nil || *addBOS {
+			t.Errorf("expected add_bos false, got %v", addBOS)
+		}
+	})
+}
+
+func TestChatQueueStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	interval := queueStatusInterval
+	queueStatusInterval = 10 * time.Millisecond
+	t.Cleanup(func() { queueStatusInterval = interval })
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Done:               true,
+			DoneReason:         llm.DoneReasonStop,
+			PromptEvalCount:    1,
+			PromptEvalDuration: 1,
+			EvalCount:          1,
+			EvalDuration:       1,
+		},
+	}
+
+	// queuedChat sends req to a new server while the scheduler is saturated
+	// with a request that's waiting ahead of it, and only starts scheduling
+	// once req has waited
+	queuedChat := func(t *testing.T, req api.ChatRequest) *httptest.ResponseRecorder {
+		t.Helper()
+
+		s := Server{
+			sched: &Scheduler{
+				pendingReqCh:  make(chan *LlmRequest, 4),
+				finishedReqCh: make(chan *LlmRequest, 4),
+				expiredCh:     make(chan *runnerRef, 1),
+				unloadedCh:    make(chan any, 1),
+				loaded:        make(map[string]*runnerRef),
+				newServerFn:   newMockServer(&mock),
+				getGpuFn:      discover.GetGPUInfo,
+				getCpuFn:      discover.GetCPUInfo,
+				reschedDelay:  250 * time.Millisecond,
+				loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+					req.successCh <- &runnerRef{
+						llama: &mock,
+					}
+				},
+			},
+		}
+
+		_, digest := createBinFile(t, ggml.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []*ggml.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:    "test",
+			Files:    map[string]string{"file.gguf": digest},
+			Template: `{{- range .Messages }}{{ .Role }}: {{ .Content }}{{ end }}`,
+			Stream:   &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		m, err := GetModel("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ahead := s.sched.request(t.Context(), m, api.DefaultOptions(), nil, 0)
+		go func() {
+			for {
+				s.sched.waitingMu.Lock()
+				n := len(s.sched.waiting)
+				s.sched.waitingMu.Unlock()
+				if n == 2 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			time.Sleep(5 * queueStatusInterval)
+			s.sched.Run(t.Context())
+			<-ahead.successCh
+		}()
+
+		return createRequest(t, s.ChatHandler, req)
+	}
+
+	t.Run("scheduled", func(t *testing.T) {
+		w := queuedChat(t, api.ChatRequest{
+			Model:       "test",
+			Messages:    []api.Message{{Role: "user", Content: "Hello!"}},
+			ReportQueue: true,
+			TypedEvents: true,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var responses []api.ChatResponse
+		decoder := json.NewDecoder(w.Body)
+		for {
+			var resp api.ChatResponse
+			if err := decoder.Decode(&resp); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			responses = append(responses, resp)
+		}
+
+		if len(responses) < 2 {
+			t.Fatalf("expected a status response before the final response, got %d responses", len(responses))
+		}
+
+		status := responses[0]
+		if status.Type != api.ChatEventStatus {
+			t.Errorf("expected type %q, got %q", api.ChatEventStatus, status.Type)
+		}
+		if diff := cmp.Diff(status.Queue, &api.QueueStatus{Position: 1}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+		if status.Done {
+			t.Error("expected status response not to be done")
+		}
+
+		final := responses[len(responses)-1]
+		if !final.Done || final.Queue != nil {
+			t.Errorf("expected final response without queue status, got %+v", final)
+		}
+	})
+
+	t.Run("error after status", func(t *testing.T) {
+		t.Setenv("OLLAMA_SYSTEM_ONLY", "error")
+
+		w := queuedChat(t, api.ChatRequest{
+			Model:       "test",
+			Messages:    []api.Message{{Role: "system", Content: "Be brief."}},
+			ReportQueue: true,
+		})
+
+		// the status line already committed the response, so the error is
+		// streamed after it
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+		if len(lines) < 2 {
+			t.Fatalf("expected a status line before the error, got %q", w.Body.String())
+		}
+
+		var status api.ChatResponse
+		if err := json.Unmarshal([]byte(lines[0]), &status); err != nil {
+			t.Fatal(err)
+		}
+
+		if status.Queue == nil {
+			t.Errorf("expected a queue status, got %s", lines[0])
+		}
+
+		var last struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(last.Error, errSystemOnly.Error()) {
+			t.Errorf("expected a system only error, got %q", last.Error)
+		}
+
+		if !strings.HasSuffix(w.Body.String(), "\n") {
+			t.Error("expected the error to end with a newline")
+		}
+	})
+}
+
+// schedulableRunner is a mockRunner which the scheduler can load, for tests
+// of handlers running the real scheduler
+type schedulableRunner struct {
+	mockLlm
+	mock *mockRunner
+}
+
+func (r *schedulableRunner) Completion(ctx context.Context, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	return r.mock.Completion(ctx, req, fn)
+}
+
+func (r *schedulableRunner) Tokenize(ctx context.Context, s string) ([]int, error) {
+	return r.mock.Tokenize(ctx, s)
+}
+
+func TestChatDynamicContextReschedule(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_CONTEXT_STEP", "1024")
+	t.Setenv("OLLAMA_NUM_PARALLEL", "1")
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "Hi!",
+			Done:       true,
+			DoneReason: llm.DoneReasonStop,
+		},
+	}
+
+	// the real scheduler, rather than a stub, so the runner sized for the
+	// default context length must be released before it can be reloaded
+	s := Server{sched: InitScheduler(t.Context())}
+	s.sched.getGpuFn = getGpuFn
+	s.sched.getCpuFn = getCpuFn
+	var loads []int
+	s.sched.newServerFn = func(_ discover.GpuInfoList, _ string, _ *ggml.GGML, _, _ []string, opts api.Options, _ int) (llm.LlamaServer, error) {
+		loads = append(loads, opts.NumCtx)
+		return &schedulableRunner{mockLlm: mockLlm{estimatedVRAMByGPU: map[string]uint64{}}, mock: &mock}, nil
+	}
+	go s.sched.Run(t.Context())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(1),
+		"llama.context_length":          uint32(8192),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{""},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, []*ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
 	})
+
+	stream := false
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:    "test",
+		Files:    map[string]string{"file.gguf": digest},
+		Template: `{{- range .Messages }}{{ .Role }}: {{ .Content }}{{ end }}`,
+		Stream:   &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		done <- createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   &stream,
+		})
+	}()
+
+	select {
+	case w := <-done:
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if got := w.Header().Get("X-Context-Limit"); got != "1024" {
+			t.Errorf("expected context limit 1024, got %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the request to be scheduled with its dynamic context length")
+	}
+
+	if len(loads) != 2 || loads[1] != 1024 {
+		t.Errorf("expected the model to be reloaded with num_ctx 1024, got loads %v", loads)
+	}
 }
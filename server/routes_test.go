@@ -19,6 +19,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 	"unicode"
 
 	"github.com/gin-gonic/gin"
@@ -725,6 +726,54 @@ func TestShow(t *testing.T) {
 	}
 }
 
+func TestShowOptions(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_CONTEXT_LENGTH", "8192")
+
+	var s Server
+
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "test"}, nil)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:       "show-model",
+		Files:      map[string]string{"model.gguf": digest},
+		Parameters: map[string]any{"temperature": 0.2},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	w = createRequest(t, s.ShowHandler, api.ShowRequest{
+		Name: "show-model",
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var resp api.ShowResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Options == nil {
+		t.Fatal("expected options")
+	}
+
+	// the model's parameters override the defaults
+	if resp.Options.Temperature != 0.2 {
+		t.Errorf("expected temperature 0.2, got %v", resp.Options.Temperature)
+	}
+
+	if resp.Options.TopP != api.DefaultOptions().TopP {
+		t.Errorf("expected default top_p %v, got %v", api.DefaultOptions().TopP, resp.Options.TopP)
+	}
+
+	if resp.Options.NumCtx != 8192 {
+		t.Errorf("expected num_ctx 8192, got %d", resp.Options.NumCtx)
+	}
+}
+
 func TestNormalize(t *testing.T) {
 	type testCase struct {
 		input []float32
@@ -968,3 +1017,49 @@ func TestWaitForStream(t *testing.T) {
 		})
 	}
 }
+
+func TestPsHandlerExpiresAt(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	now := time.Now()
+	idleExpiry := now.Add(time.Minute)
+	s := Server{
+		sched: &Scheduler{
+			loaded: map[string]*runnerRef{
+				"idle": {model: &Model{ShortName: "idle"}, sessionDuration: time.Minute, expiresAt: idleExpiry},
+				// the keep alive timer of a busy runner hasn't started, so its
+				// expiry is whatever it was when it last went idle
+				"busy": {model: &Model{ShortName: "busy"}, sessionDuration: time.Hour, expiresAt: now.Add(-time.Minute), refCount: 1},
+			},
+		},
+	}
+
+	w := createRequest(t, s.PsHandler, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var resp api.ProcessResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Models) != 2 {
+		t.Fatalf("expected 2 models, got %d", len(resp.Models))
+	}
+
+	// a busy runner reports the expiry it would have if it went idle now,
+	// so it is listed first
+	busy, idle := resp.Models[0], resp.Models[1]
+	if busy.Name != "busy" || idle.Name != "idle" {
+		t.Fatalf("expected busy then idle, got %s then %s", busy.Name, idle.Name)
+	}
+
+	if busy.ExpiresAt.Before(now.Add(time.Hour)) {
+		t.Errorf("expected busy runner to expire an hour from now, got %s", busy.ExpiresAt)
+	}
+
+	if !idle.ExpiresAt.Equal(idleExpiry) {
+		t.Errorf("expected idle runner to expire at %s, got %s", idleExpiry, idle.ExpiresAt)
+	}
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"cmp"
+	"container/heap"
 	"context"
 	"errors"
 	"fmt"
@@ -33,6 +35,87 @@ type LlmRequest struct {
 	successCh       chan *runnerRef
 	errCh           chan error
 	schedAttempts   uint
+	priority        int    // Higher priority requests are scheduled first
+	seq             uint64 // Preserves arrival order for requests of equal priority
+	waitSeq         uint64 // Arrival order of the request in Scheduler.waiting
+	evicted         int    // Number of other runners unloaded to make room for this request
+	coldStart       bool   // The model was loaded to serve this request
+	queued          time.Time
+	stages          api.LoadStages // Time spent in each stage of scheduling this request
+	key             string         // Key of the runner in loaded when it isn't the model path
+}
+
+// runnerKey returns the key of the runner serving req in Scheduler.loaded
+func (req *LlmRequest) runnerKey() string {
+	if req.key != "" {
+		return req.key
+	}
+
+	return req.model.ModelPath
+}
+
+// scheduled describes how the scheduler served a request
+type scheduled struct {
+	// evicted is the number of other runners unloaded to make room
+	evicted int
+	// coldStart is true if the model was loaded to serve the request
+	coldStart bool
+	// stages is the time spent in each stage of loading the model
+	stages api.LoadStages
+}
+
+// add combines the scheduling of a request which was scheduled again
+func (s scheduled) add(o scheduled) scheduled {
+	return scheduled{
+		evicted:   s.evicted + o.evicted,
+		coldStart: s.coldStart || o.coldStart,
+		stages: api.LoadStages{
+			Queue:   s.stages.Queue + o.stages.Queue,
+			Parse:   s.stages.Parse + o.stages.Parse,
+			Start:   s.stages.Start + o.stages.Start,
+			Weights: s.stages.Weights + o.stages.Weights,
+			Cache:   s.stages.Cache + o.stages.Cache,
+			Ready:   s.stages.Ready + o.stages.Ready,
+		},
+	}
+}
+
+// pendingQueue orders pending requests by priority, then by arrival
+type pendingQueue struct {
+	reqs []*LlmRequest
+	seq  uint64
+}
+
+func (q *pendingQueue) Len() int { return len(q.reqs) }
+func (q *pendingQueue) Less(i, j int) bool {
+	if q.reqs[i].priority != q.reqs[j].priority {
+		return q.reqs[i].priority > q.reqs[j].priority
+	}
+	return q.reqs[i].seq < q.reqs[j].seq
+}
+func (q *pendingQueue) Swap(i, j int) { q.reqs[i], q.reqs[j] = q.reqs[j], q.reqs[i] }
+func (q *pendingQueue) Push(x any)    { q.reqs = append(q.reqs, x.(*LlmRequest)) }
+func (q *pendingQueue) Pop() any {
+	req := q.reqs[len(q.reqs)-1]
+	q.reqs = q.reqs[:len(q.reqs)-1]
+	return req
+}
+
+// push adds req to the queue. A request put back in the queue keeps its
+// place among requests of equal priority unless its seq is reset
+func (q *pendingQueue) push(req *LlmRequest) {
+	if req.seq == 0 {
+		q.seq++
+		req.seq = q.seq
+	}
+	if req.queued.IsZero() {
+		req.queued = time.Now()
+	}
+	heap.Push(q, req)
+}
+
+func (q *pendingQueue) pop() *LlmRequest {
+	return heap.Pop(q).(*LlmRequest)
 }
 
 type Scheduler struct {
@@ -49,6 +132,17 @@ type Scheduler struct {
 	getGpuFn     func() discover.GpuInfoList
 	getCpuFn     func() discover.GpuInfoList
 	reschedDelay time.Duration
+
+	// waiting tracks requests sent to processPending that haven't been
+	// taken from the queue yet, in the order they were sent
+	waiting      map[*LlmRequest]uint64
+	waitingSeq   uint64
+	waitingMu    sync.Mutex
+	lastDequeued time.Time
+	backlog      bool
+	// dequeueInterval is the average time between taking requests from the
+	// queue while others are waiting
+	dequeueInterval time.Duration
 }
 
 // Default automatic value for number of models we allow per GPU
@@ -63,6 +157,41 @@ var defaultParallel = 2
 
 var ErrMaxQueue = errors.New("server busy, please try again.  maximum pending requests exceeded")
 
+// loadError is a failure to load a model, classified so clients can react to
+// the reason
+type loadError struct {
+	reason api.LoadFailure
+	err    error
+}
+
+func (e *loadError) Error() string { return e.err.Error() }
+
+func (e *loadError) Unwrap() error { return e.err }
+
+// classifyLoadError wraps err in a loadError if the reason a model failed to
+// load on gpus can be determined
+func classifyLoadError(err error, gpus discover.GpuInfoList) error {
+	msg := strings.ToLower(err.Error())
+
+	var reason api.LoadFailure
+	switch {
+	case errors.Is(err, ErrMaxQueue):
+		reason = api.LoadFailureCapacityExceeded
+	case strings.Contains(msg, "no cuda-capable device"), strings.Contains(msg, "no rocm-capable device"):
+		reason = api.LoadFailureNoCompatibleGPU
+	case strings.Contains(msg, "out of memory"), strings.Contains(msg, "requires more system memory"), strings.Contains(msg, "unable to allocate"):
+		reason = api.LoadFailureInsufficientVRAM
+		// without a GPU the model had to fit in system memory
+		if !slices.ContainsFunc(gpus, func(g discover.GpuInfo) bool { return g.Library != "cpu" }) {
+			reason = api.LoadFailureNoCompatibleGPU
+		}
+	default:
+		return err
+	}
+
+	return &loadError{reason: reason, err: err}
+}
+
 func InitScheduler(ctx context.Context) *Scheduler {
 	maxQueue := envconfig.MaxQueue()
 	sched := &Scheduler{
@@ -81,7 +210,14 @@ func InitScheduler(ctx context.Context) *Scheduler {
 }
 
 // context must be canceled to decrement ref count and release the runner
-func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options, sessionDuration *api.Duration) (chan *runnerRef, chan error) {
+func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options, sessionDuration *api.Duration, priority int) (chan *runnerRef, chan error) {
+	req := s.request(c, model, opts, sessionDuration, priority)
+	return req.successCh, req.errCh
+}
+
+// request queues a request for a runner. The runner or an error is sent to
+// the request's successCh or errCh
+func (s *Scheduler) request(c context.Context, model *Model, opts api.Options, sessionDuration *api.Duration, priority int) *LlmRequest {
 	if opts.NumCtx < 4 {
 		opts.NumCtx = 4
 	}
@@ -93,14 +229,76 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 		sessionDuration: sessionDuration,
 		successCh:       make(chan *runnerRef),
 		errCh:           make(chan error, 1),
+		priority:        priority,
 	}
 
+	s.enqueued(req)
 	select {
 	case s.pendingReqCh <- req:
 	default:
-		req.errCh <- ErrMaxQueue
+		s.dequeued(req)
+		req.errCh <- classifyLoadError(ErrMaxQueue, nil)
 	}
-	return req.successCh, req.errCh
+	return req
+}
+
+// enqueued records that req is waiting to be taken from the queue. A request
+// put back in the queue keeps its position unless its waitSeq is reset
+func (s *Scheduler) enqueued(req *LlmRequest) {
+	s.waitingMu.Lock()
+	defer s.waitingMu.Unlock()
+	if s.waiting == nil {
+		s.waiting = make(map[*LlmRequest]uint64)
+	}
+	if req.waitSeq == 0 {
+		s.waitingSeq++
+		req.waitSeq = s.waitingSeq
+	}
+	s.waiting[req] = req.waitSeq
+}
+
+// dequeued records that req has been taken from the queue. The time between
+// taking requests while others are waiting estimates how long each position
+// in the queue waits
+func (s *Scheduler) dequeued(req *LlmRequest) {
+	s.waitingMu.Lock()
+	defer s.waitingMu.Unlock()
+	if _, ok := s.waiting[req]; !ok {
+		return
+	}
+	delete(s.waiting, req)
+
+	now := time.Now()
+	if s.backlog && !s.lastDequeued.IsZero() {
+		interval := now.Sub(s.lastDequeued)
+		if s.dequeueInterval == 0 {
+			s.dequeueInterval = interval
+		} else {
+			s.dequeueInterval = (3*s.dequeueInterval + interval) / 4
+		}
+	}
+	s.lastDequeued = now
+	s.backlog = len(s.waiting) > 0
+}
+
+// queueStatus returns the number of waiting requests that will be scheduled
+// before req and an estimate of how long req will wait. The estimate is zero
+// until the scheduler has worked through a backlog. ok is false once req is no
+// longer waiting
+func (s *Scheduler) queueStatus(req *LlmRequest) (position int, wait time.Duration, ok bool) {
+	s.waitingMu.Lock()
+	defer s.waitingMu.Unlock()
+	seq, ok := s.waiting[req]
+	if !ok {
+		return 0, 0, false
+	}
+
+	for r, rseq := range s.waiting {
+		if r.priority > req.priority || (r.priority == req.priority && rseq < seq) {
+			position++
+		}
+	}
+	return position, time.Duration(position+1) * s.dequeueInterval, true
 }
 
 // Returns immediately, spawns go routines for the scheduler which will shutdown when ctx is done
@@ -116,200 +314,257 @@ func (s *Scheduler) Run(ctx context.Context) {
 }
 
 func (s *Scheduler) processPending(ctx context.Context) {
+	var queue pendingQueue
 	for {
-		select {
-		case <-ctx.Done():
-			slog.Debug("shutting down scheduler pending loop")
-			return
-		case pending := <-s.pendingReqCh:
-			// Block other requests until we get this pending request running
-			pending.schedAttempts++
-			if pending.origNumCtx == 0 {
-				pending.origNumCtx = pending.opts.NumCtx
+		if queue.Len() == 0 {
+			select {
+			case <-ctx.Done():
+				slog.Debug("shutting down scheduler pending loop")
+				return
+			case pending := <-s.pendingReqCh:
+				queue.push(pending)
+			case <-s.unloadedCh:
+				// An unload request when there are no pending request can be ignored
+				slog.Debug("ignoring unload event with no pending requests")
+				continue
 			}
+		}
 
-			if pending.ctx.Err() != nil {
-				slog.Debug("pending request cancelled or timed out, skipping scheduling")
-				continue
+		// Collect any other requests that have arrived so the highest priority
+		// one is scheduled first
+	drain:
+		for queue.Len() < cap(s.pendingReqCh) {
+			select {
+			case pending := <-s.pendingReqCh:
+				queue.push(pending)
+			default:
+				break drain
 			}
-			numParallel := int(envconfig.NumParallel())
-			// `mllama` is a snowflake and uses an encoder cache which cannot be used with num_parallel > 1
-			// ref: https://github.com/ollama/ollama/issues/4165
-			if slices.Contains(pending.model.Config.ModelFamilies, "mllama") && numParallel != 1 {
-				numParallel = 1
-				slog.Warn("mllama does not currently support parallel requests")
+		}
+
+		pending := queue.pop()
+		s.dequeued(pending)
+		// Block other requests until we get this pending request running
+		pending.schedAttempts++
+		if pending.origNumCtx == 0 {
+			pending.origNumCtx = pending.opts.NumCtx
+		}
+
+		if pending.ctx.Err() != nil {
+			slog.Debug("pending request cancelled or timed out, skipping scheduling")
+			continue
+		}
+		numParallel := int(envconfig.NumParallel())
+		// `mllama` is a snowflake and uses an encoder cache which cannot be used with num_parallel > 1
+		// ref: https://github.com/ollama/ollama/issues/4165
+		if slices.Contains(pending.model.Config.ModelFamilies, "mllama") && numParallel != 1 {
+			numParallel = 1
+			slog.Warn("mllama does not currently support parallel requests")
+		}
+
+		for {
+			var runnerToExpire *runnerRef
+			s.loadedMu.Lock()
+			runners := s.modelRunners(pending.model.ModelPath)
+			loadedCount := len(s.loaded)
+			loadingCount := 0
+			for _, r := range s.loaded {
+				if r.loading {
+					loadingCount++
+				}
 			}
+			s.loadedMu.Unlock()
 
-			for {
-				var runnerToExpire *runnerRef
-				s.loadedMu.Lock()
-				runner := s.loaded[pending.model.ModelPath]
-				loadedCount := len(s.loaded)
-				s.loadedMu.Unlock()
-				if runner != nil {
-					if runner.needsReload(ctx, pending) {
-						slog.Debug("reloading", "runner", runner)
-						runnerToExpire = runner
-					} else {
-						// Runner is usable, return it
-						pending.useLoadedRunner(runner, s.finishedReqCh)
-						break
-					}
-				} else if envconfig.MaxRunners() > 0 && loadedCount >= int(envconfig.MaxRunners()) {
-					slog.Debug("max runners achieved, unloading one to make room", "runner_count", loadedCount)
-					runnerToExpire = s.findRunnerToUnload()
+			var runner *runnerRef
+			for _, r := range runners {
+				if !r.needsReload(ctx, pending) {
+					runner = r
+					break
+				}
+			}
+
+			pending.key = ""
+			if runner != nil {
+				// Runner is usable, return it
+				pending.stages.Queue = time.Since(pending.queued)
+				pending.useLoadedRunner(runner, s.finishedReqCh)
+				break
+			} else if len(runners) > 0 && !s.loadAlongside(pending, runners) {
+				runnerToExpire = idleRunner(runners)
+				slog.Debug("reloading", "runner", runnerToExpire)
+			} else if envconfig.MaxLoads() > 0 && loadingCount >= int(envconfig.MaxLoads()) {
+				// Too many models are already loading, so hold this request
+				// until one of them finishes. It keeps its place in the queue
+				go func() {
+					slog.Debug("delaying scheduling while other models finish loading", "loading", loadingCount, "attempts", pending.schedAttempts, "model", pending.model.ModelPath)
+					time.Sleep(s.reschedDelay)
+					s.enqueued(pending)
+					s.pendingReqCh <- pending
+				}()
+				break
+			} else if envconfig.MaxRunners() > 0 && loadedCount >= int(envconfig.MaxRunners()) {
+				slog.Debug("max runners achieved, unloading one to make room", "runner_count", loadedCount)
+				runnerToExpire = s.findRunnerToUnload()
+			} else {
+				// Either no models are loaded or below envconfig.MaxRunners
+				// Get a refreshed GPU list
+				var gpus discover.GpuInfoList
+				if pending.opts.NumGPU == 0 {
+					gpus = s.getCpuFn()
 				} else {
-					// Either no models are loaded or below envconfig.MaxRunners
-					// Get a refreshed GPU list
-					var gpus discover.GpuInfoList
-					if pending.opts.NumGPU == 0 {
-						gpus = s.getCpuFn()
-					} else {
-						gpus = s.getGpuFn()
-					}
+					gpus = s.getGpuFn()
+				}
 
-					if envconfig.MaxRunners() <= 0 {
-						// No user specified MaxRunners, so figure out what automatic setting to use
-						// If all GPUs have reliable free memory reporting, defaultModelsPerGPU * the number of GPUs
-						// if any GPU has unreliable free memory reporting, 1x the number of GPUs
-						allReliable := true
-						for _, gpu := range gpus {
-							if gpu.UnreliableFreeMemory {
-								allReliable = false
-								break
-							}
-						}
-						if allReliable {
-							// HACK
-							os.Setenv("OLLAMA_MAX_LOADED_MODELS", strconv.Itoa(defaultModelsPerGPU*len(gpus)))
-							slog.Debug("updating default concurrency", "OLLAMA_MAX_LOADED_MODELS", envconfig.MaxRunners(), "gpu_count", len(gpus))
-						} else {
-							// HACK
-							os.Setenv("OLLAMA_MAX_LOADED_MODELS", strconv.Itoa(len(gpus)))
-							slog.Info("one or more GPUs detected that are unable to accurately report free memory - disabling default concurrency")
+				if envconfig.MaxRunners() <= 0 {
+					// No user specified MaxRunners, so figure out what automatic setting to use
+					// If all GPUs have reliable free memory reporting, defaultModelsPerGPU * the number of GPUs
+					// if any GPU has unreliable free memory reporting, 1x the number of GPUs
+					allReliable := true
+					for _, gpu := range gpus {
+						if gpu.UnreliableFreeMemory {
+							allReliable = false
+							break
 						}
 					}
-
-					// Load model for fitting
-					ggml, err := llm.LoadModel(pending.model.ModelPath, 0)
-					if err != nil {
-						pending.errCh <- err
-						break
+					if allReliable {
+						// HACK
+						os.Setenv("OLLAMA_MAX_LOADED_MODELS", strconv.Itoa(defaultModelsPerGPU*len(gpus)))
+						slog.Debug("updating default concurrency", "OLLAMA_MAX_LOADED_MODELS", envconfig.MaxRunners(), "gpu_count", len(gpus))
+					} else {
+						// HACK
+						os.Setenv("OLLAMA_MAX_LOADED_MODELS", strconv.Itoa(len(gpus)))
+						slog.Info("one or more GPUs detected that are unable to accurately report free memory - disabling default concurrency")
 					}
+				}
 
-					// Embedding models should always be loaded with parallel=1
-					if pending.model.CheckCapabilities(model.CapabilityCompletion) != nil {
-						numParallel = 1
-					}
+				// the model isn't resident so it's loaded for this request
+				pending.coldStart = true
+				pending.stages.Queue = time.Since(pending.queued)
 
-					// Evaluate if the model will fit in the available system memory, or if we should unload a model first
-					if len(gpus) == 1 && gpus[0].Library == "cpu" {
-						// simplifying assumption of defaultParallel when in CPU mode
-						if numParallel <= 0 {
-							numParallel = defaultParallel
-						}
+				// Load model for fitting
+				parseStart := time.Now()
+				ggml, err := llm.LoadModel(pending.model.ModelPath, 0)
+				if err != nil {
+					pending.errCh <- err
+					break
+				}
+				pending.stages.Parse = time.Since(parseStart)
 
-						pending.opts.NumCtx = pending.origNumCtx * numParallel
+				// Embedding models should always be loaded with parallel=1
+				if pending.model.CheckCapabilities(model.CapabilityCompletion) != nil {
+					numParallel = 1
+				}
 
-						if loadedCount == 0 {
-							slog.Debug("cpu mode with first model, loading")
-							s.loadFn(pending, ggml, gpus, numParallel)
-							break
-						}
-						runnerToExpire = s.maybeFindCPURunnerToUnload(pending, ggml, gpus)
-						if runnerToExpire == nil {
-							slog.Debug("cpu mode with available system memory or first model, loading")
-							s.loadFn(pending, ggml, gpus, numParallel)
-							break
-						}
-						// else we need to expire a runner
-					} else if loadedCount == 0 {
-						// No models loaded. Load the model but prefer the best fit.
-						slog.Debug("loading first model", "model", pending.model.ModelPath)
-						g := pickBestFullFitByLibrary(pending, ggml, gpus, &numParallel)
-						if g != nil {
-							gpus = g
-						} else {
-							// Only allow partial loads when this is the first model
-							gpus = pickBestPartialFitByLibrary(pending, ggml, gpus, &numParallel)
-						}
+				// Evaluate if the model will fit in the available system memory, or if we should unload a model first
+				if len(gpus) == 1 && gpus[0].Library == "cpu" {
+					// simplifying assumption of defaultParallel when in CPU mode
+					if numParallel <= 0 {
+						numParallel = defaultParallel
+					}
+
+					pending.opts.NumCtx = pending.origNumCtx * numParallel
+
+					if loadedCount == 0 {
+						slog.Debug("cpu mode with first model, loading")
 						s.loadFn(pending, ggml, gpus, numParallel)
 						break
 					}
-
+					runnerToExpire = s.maybeFindCPURunnerToUnload(pending, ggml, gpus)
 					if runnerToExpire == nil {
-						// More than one loaded model, so we have to see if the
-						// new one fits
-						//
-						// We want to avoid loading on any GPUs that have other
-						// models still loading on them to avoid potential races
-						// with VRAM consumption ramping up during load
-						availGpus := s.filterGPUsWithoutLoadingModels(gpus)
-
-						// Update free memory from currently loaded models
-						s.updateFreeSpace(availGpus)
-						fitGpus := pickBestFullFitByLibrary(pending, ggml, availGpus, &numParallel)
-						if fitGpus != nil {
-							slog.Debug("new model fits with existing models, loading")
-							s.loadFn(pending, ggml, fitGpus, numParallel)
-							break
-						}
-
-						// We couldn't find a set of GPUs to fully load the new
-						// model. If no other models are loading (both GPU lists
-						// are the same) then we need to unload another model to
-						// make room
-						if len(availGpus) < len(gpus) {
-							// There are other requests pending, and this one
-							// needs more time, so put it on the back of the
-							// queue so that we might satisfy other pending
-							// requests that aren't blocked
-							go func() {
-								// Process in a go routine to avoid deadlocking
-								// the scheduler if our queue is full
-								slog.Debug("delaying scheduling while other models finish loading", "attempts", pending.schedAttempts, "model", pending.model.ModelPath)
-								time.Sleep(s.reschedDelay)
-								s.pendingReqCh <- pending
-							}()
-							break
-						}
-						runnerToExpire = s.findRunnerToUnload()
+						slog.Debug("cpu mode with available system memory or first model, loading")
+						s.loadFn(pending, ggml, gpus, numParallel)
+						break
+					}
+					// else we need to expire a runner
+				} else if loadedCount == 0 {
+					// No models loaded. Load the model but prefer the best fit.
+					slog.Debug("loading first model", "model", pending.model.ModelPath)
+					g := pickBestFullFitByLibrary(pending, ggml, gpus, &numParallel)
+					if g != nil {
+						gpus = g
+					} else {
+						// Only allow partial loads when this is the first model
+						gpus = pickBestPartialFitByLibrary(pending, ggml, gpus, &numParallel)
 					}
+					s.loadFn(pending, ggml, gpus, numParallel)
+					break
 				}
 
 				if runnerToExpire == nil {
-					// Shouildn't happen
-					slog.Error("runner to expire was nil!")
-					continue
-				}
-				// Trigger an expiration to unload once it's done
-				runnerToExpire.refMu.Lock()
-				slog.Debug("resetting model to expire immediately to make room", "runner", runnerToExpire, "refCount", runnerToExpire.refCount)
-				if runnerToExpire.expireTimer != nil {
-					runnerToExpire.expireTimer.Stop()
-					runnerToExpire.expireTimer = nil
-				}
-				runnerToExpire.sessionDuration = 0
-				if runnerToExpire.refCount <= 0 {
-					s.expiredCh <- runnerToExpire
-				}
-				runnerToExpire.refMu.Unlock()
-				// Wait for the unload to happen
-				// Note: at this point we're queueing up all incoming requests, even if they were for
-				// a different model that's loaded and not scheduled to be removed.
-				slog.Debug("waiting for pending requests to complete and unload to occur", "runner", runnerToExpire)
-				select {
-				case <-ctx.Done():
-					slog.Debug("shutting down scheduler pending loop")
-					return
-				case <-s.unloadedCh:
-					slog.Debug("unload completed", "runner", runnerToExpire)
-					continue
+					// More than one loaded model, so we have to see if the
+					// new one fits
+					//
+					// We want to avoid loading on any GPUs that have other
+					// models still loading on them to avoid potential races
+					// with VRAM consumption ramping up during load
+					availGpus := s.filterGPUsWithoutLoadingModels(gpus)
+
+					// Update free memory from currently loaded models
+					s.updateFreeSpace(availGpus)
+					fitGpus := pickBestFullFitByLibrary(pending, ggml, availGpus, &numParallel)
+					if fitGpus != nil {
+						slog.Debug("new model fits with existing models, loading")
+						s.loadFn(pending, ggml, fitGpus, numParallel)
+						break
+					}
+
+					// We couldn't find a set of GPUs to fully load the new
+					// model. If no other models are loading (both GPU lists
+					// are the same) then we need to unload another model to
+					// make room
+					if len(availGpus) < len(gpus) {
+						// There are other requests pending, and this one
+						// needs more time, so put it on the back of the
+						// queue so that we might satisfy other pending
+						// requests that aren't blocked
+						go func() {
+							// Process in a go routine to avoid deadlocking
+							// the scheduler if our queue is full
+							slog.Debug("delaying scheduling while other models finish loading", "attempts", pending.schedAttempts, "model", pending.model.ModelPath)
+							time.Sleep(s.reschedDelay)
+							pending.seq, pending.waitSeq = 0, 0
+							s.enqueued(pending)
+							s.pendingReqCh <- pending
+						}()
+						break
+					}
+					runnerToExpire = s.findRunnerToUnload()
 				}
 			}
-		case <-s.unloadedCh:
-			// An unload request when there are no pending request can be ignored
-			slog.Debug("ignoring unload event with no pending requests")
+
+			if runnerToExpire == nil {
+				// Shouildn't happen
+				slog.Error("runner to expire was nil!")
+				continue
+			}
+			if runnerToExpire.modelPath != pending.model.ModelPath {
+				pending.evicted++
+			}
+
+			// Trigger an expiration to unload once it's done
+			runnerToExpire.refMu.Lock()
+			slog.Debug("resetting model to expire immediately to make room", "runner", runnerToExpire, "refCount", runnerToExpire.refCount)
+			if runnerToExpire.expireTimer != nil {
+				runnerToExpire.expireTimer.Stop()
+				runnerToExpire.expireTimer = nil
+			}
+			runnerToExpire.sessionDuration = 0
+			if runnerToExpire.refCount <= 0 {
+				s.expiredCh <- runnerToExpire
+			}
+			runnerToExpire.refMu.Unlock()
+			// Wait for the unload to happen
+			// Note: at this point we're queueing up all incoming requests, even if they were for
+			// a different model that's loaded and not scheduled to be removed.
+			slog.Debug("waiting for pending requests to complete and unload to occur", "runner", runnerToExpire)
+			select {
+			case <-ctx.Done():
+				slog.Debug("shutting down scheduler pending loop")
+				return
+			case <-s.unloadedCh:
+				slog.Debug("unload completed", "runner", runnerToExpire)
+				continue
+			}
 		}
 	}
 }
@@ -323,7 +578,7 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 			return
 		case finished := <-s.finishedReqCh:
 			s.loadedMu.Lock()
-			runner := s.loaded[finished.model.ModelPath]
+			runner := s.loaded[finished.runnerKey()]
 			s.loadedMu.Unlock()
 			if runner == nil {
 				slog.Error("finished request signal received after model unloaded", "modelPath", finished.model.ModelPath)
@@ -377,7 +632,7 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 
 			s.loadedMu.Lock()
 			slog.Debug("got lock to unload expired event", "runner", runner)
-			runnerToUnload := s.loaded[runner.modelPath]
+			runnerToUnload := s.loaded[runner.loadedKey()]
 			if runnerToUnload == nil {
 				// If runnerToUnload is nil, we already processed an event and
 				// unloaded it. This double unload can happen if the initial
@@ -402,7 +657,7 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 				slog.Debug("starting background wait for VRAM recovery", "runner", runner)
 				finished := runner.waitForVRAMRecovery()
 				runner.unload()
-				delete(s.loaded, runner.modelPath)
+				delete(s.loaded, runner.loadedKey())
 				s.loadedMu.Unlock()
 				slog.Debug("runner terminated and removed from list, blocking for VRAM recovery", "runner", runner)
 				<-finished
@@ -421,12 +676,20 @@ func (pending *LlmRequest) useLoadedRunner(runner *runnerRef, finished chan *Llm
 	runner.refMu.Lock()
 	defer runner.refMu.Unlock()
 	runner.refCount++
+	pending.key = runner.key
 	if runner.expireTimer != nil {
 		runner.expireTimer.Stop()
 		runner.expireTimer = nil
 	}
+	// keep the runner for the longest keep alive of the requests since it
+	// was last idle, so a request finishing last, such as one which was
+	// cancelled, doesn't cut short the keep alive of the others
 	if pending.sessionDuration != nil {
-		runner.sessionDuration = pending.sessionDuration.Duration
+		if runner.refCount > 1 {
+			runner.sessionDuration = max(runner.sessionDuration, pending.sessionDuration.Duration)
+		} else {
+			runner.sessionDuration = pending.sessionDuration.Duration
+		}
 	}
 	pending.successCh <- runner
 	go func() {
@@ -444,7 +707,9 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 	if req.sessionDuration != nil {
 		sessionDuration = req.sessionDuration.Duration
 	}
+	start := time.Now()
 	llama, err := s.newServerFn(gpus, req.model.ModelPath, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, numParallel)
+	req.stages.Start = time.Since(start)
 	if err != nil {
 		// some older models are not compatible with newer versions of llama.cpp
 		// show a generalized compatibility error until there is a better way to
@@ -453,12 +718,13 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 			err = fmt.Errorf("%v: this model may be incompatible with your version of Ollama. If you previously pulled this model, try updating it by running `ollama pull %s`", err, req.model.ShortName)
 		}
 		slog.Info("NewLlamaServer failed", "model", req.model.ModelPath, "error", err)
-		req.errCh <- err
+		req.errCh <- classifyLoadError(err, gpus)
 		return
 	}
 	runner := &runnerRef{
 		model:           req.model,
 		modelPath:       req.model.ModelPath,
+		key:             req.key,
 		llama:           llama,
 		Options:         &req.opts,
 		sessionDuration: sessionDuration,
@@ -472,22 +738,26 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 	runner.refMu.Lock() // hold lock until running or aborted
 
 	s.loadedMu.Lock()
-	if oldRunner, ok := s.loaded[req.model.ModelPath]; ok {
+	if oldRunner, ok := s.loaded[req.runnerKey()]; ok {
 		// Shouldn't happen, but safeguard against leaking a runner
 		slog.Warn("model was still loaded", "old_runner", oldRunner, "new_runner", runner)
 		oldRunner.refMu.Lock()
 		oldRunner.unload()
 		oldRunner.refMu.Unlock()
 	}
-	s.loaded[req.model.ModelPath] = runner
+	s.loaded[req.runnerKey()] = runner
 	slog.Info("loaded runners", "count", len(s.loaded))
 	s.loadedMu.Unlock()
 
 	go func() {
 		defer runner.refMu.Unlock()
-		if err = llama.WaitUntilRunning(req.ctx); err != nil {
+		ready := time.Now()
+		err := llama.WaitUntilRunning(req.ctx)
+		req.stages.Weights, req.stages.Cache = llama.LoadStages()
+		req.stages.Ready = max(time.Since(ready)-req.stages.Weights-req.stages.Cache, 0)
+		if err != nil {
 			slog.Error("error loading llama server", "error", err)
-			req.errCh <- err
+			req.errCh <- classifyLoadError(err, gpus)
 			slog.Debug("triggering expiration for failed load", "runner", runner)
 			s.expiredCh <- runner
 			return
@@ -497,7 +767,9 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 			runner.pid = llama.Pid()
 		}
 		runner.refCount++
+		s.loadedMu.Lock()
 		runner.loading = false
+		s.loadedMu.Unlock()
 		go func() {
 			<-req.ctx.Done()
 			slog.Debug("context for request finished")
@@ -574,6 +846,25 @@ func (s *Scheduler) filterGPUsWithoutLoadingModels(allGpus discover.GpuInfoList)
 	return ret
 }
 
+// loadingRunners returns the runners which are still loading their model,
+// ordered by model path
+func (s *Scheduler) loadingRunners() []*runnerRef {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	var runners []*runnerRef
+	for _, runner := range s.loaded {
+		if runner.loading {
+			runners = append(runners, runner)
+		}
+	}
+
+	slices.SortFunc(runners, func(a, b *runnerRef) int {
+		return cmp.Compare(a.loadedKey(), b.loadedKey())
+	})
+
+	return runners
+}
+
 // TODO consolidate sched_types.go
 type runnerRef struct {
 	refMu    sync.Mutex
@@ -592,10 +883,20 @@ type runnerRef struct {
 
 	model       *Model
 	modelPath   string
+	key         string // Key in Scheduler.loaded when it isn't the model path
 	numParallel int
 	*api.Options
 }
 
+// loadedKey returns the key of the runner in Scheduler.loaded
+func (runner *runnerRef) loadedKey() string {
+	if runner.key != "" {
+		return runner.key
+	}
+
+	return runner.modelPath
+}
+
 // The refMu must already be held when calling unload
 func (runner *runnerRef) unload() {
 	if runner.expireTimer != nil {
@@ -611,6 +912,39 @@ func (runner *runnerRef) unload() {
 	runner.gpus = nil
 }
 
+// loadedRunner returns the runner loaded for model, if any, and whether a
+// request with opts would need to load or reload it. The runner is referenced
+// like a scheduled request so it isn't unloaded until ctx is done
+func (s *Scheduler) loadedRunner(ctx context.Context, model *Model, opts api.Options) (*runnerRef, bool) {
+	s.loadedMu.Lock()
+	runner := s.loaded[model.ModelPath]
+	s.loadedMu.Unlock()
+	if runner == nil {
+		return nil, true
+	}
+
+	runner.refMu.Lock()
+	if runner.llama == nil {
+		// unloaded since it was looked up
+		runner.refMu.Unlock()
+		return nil, true
+	}
+	runner.refCount++
+	if runner.expireTimer != nil {
+		runner.expireTimer.Stop()
+		runner.expireTimer = nil
+	}
+	runner.refMu.Unlock()
+
+	finished := &LlmRequest{ctx: ctx, model: model, key: runner.key}
+	go func() {
+		<-ctx.Done()
+		s.finishedReqCh <- finished
+	}()
+
+	return runner, runner.needsReload(ctx, &LlmRequest{ctx: ctx, model: model, opts: opts})
+}
+
 func (runner *runnerRef) needsReload(ctx context.Context, req *LlmRequest) bool {
 	slog.Debug("evaluating already loaded", "model", req.model.ModelPath)
 	runner.refMu.Lock()
@@ -832,6 +1166,61 @@ func pickBestPartialFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.Gp
 	return byLibrary[bestFit]
 }
 
+// modelRunners returns the runners loaded for modelPath, starting with the
+// runner loaded under the model path itself. loadedMu must be held
+func (s *Scheduler) modelRunners(modelPath string) []*runnerRef {
+	var runners []*runnerRef
+	for _, r := range s.loaded {
+		if r.modelPath == modelPath {
+			runners = append(runners, r)
+		}
+	}
+
+	slices.SortFunc(runners, func(a, b *runnerRef) int {
+		return cmp.Compare(a.loadedKey(), b.loadedKey())
+	})
+
+	return runners
+}
+
+// loadAlongside reports whether pending, which none of the model's loaded
+// runners can serve, should be loaded in a second runner rather than waiting
+// to reload one. This is the case when OLLAMA_RELOAD_POLICY is
+// "second_runner" and every runner of the model is busy. The request is then
+// assigned an unused key to load under
+func (s *Scheduler) loadAlongside(pending *LlmRequest, runners []*runnerRef) bool {
+	if envconfig.ReloadPolicy() != "second_runner" || slices.ContainsFunc(runners, (*runnerRef).idle) {
+		return false
+	}
+
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	for n := 1; ; n++ {
+		key := fmt.Sprintf("%s#%d", pending.model.ModelPath, n)
+		if _, ok := s.loaded[key]; !ok {
+			slog.Debug("loading a second runner for incompatible request", "model", pending.model.ModelPath, "key", key)
+			pending.key = key
+			return true
+		}
+	}
+}
+
+// idleRunner returns the first of runners which isn't serving requests, or the
+// first runner if they are all busy
+func idleRunner(runners []*runnerRef) *runnerRef {
+	if i := slices.IndexFunc(runners, (*runnerRef).idle); i >= 0 {
+		return runners[i]
+	}
+
+	return runners[0]
+}
+
+func (runner *runnerRef) idle() bool {
+	runner.refMu.Lock()
+	defer runner.refMu.Unlock()
+	return runner.refCount == 0
+}
+
 // findRunnerToUnload finds a runner to unload to make room for a new model
 func (s *Scheduler) findRunnerToUnload() *runnerRef {
 	s.loadedMu.Lock()
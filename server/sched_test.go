@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -209,6 +211,138 @@ func TestRequestsSameModelSameRequest(t *testing.T) {
 	}
 }
 
+func TestRequestCanceledZeroKeepAlive(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 0})
+
+	s.newServerFn = a.newServer
+	s.Run(ctx)
+	s.pendingReqCh <- a.req
+	select {
+	case resp := <-a.req.successCh:
+		require.Equal(t, resp.llama, a.srv)
+	case err := <-a.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	// the keep_alive 0 request is cancelled mid-stream
+	a.ctxDone()
+
+	require.Eventually(t, func() bool {
+		s.loadedMu.Lock()
+		defer s.loadedMu.Unlock()
+		return len(s.loaded) == 0
+	}, 200*time.Millisecond, 5*time.Millisecond)
+	require.True(t, a.srv.closeCalled)
+}
+
+func TestRequestKeepAliveLongestSinceIdle(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 0})
+	b := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Minute})
+	b.req.model = a.req.model
+	b.f = a.f
+	c := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 0})
+	c.req.model = a.req.model
+	c.f = a.f
+
+	s.newServerFn = a.newServer
+	s.Run(ctx)
+	for _, r := range []*reqBundle{a, b} {
+		s.pendingReqCh <- r.req
+		select {
+		case resp := <-r.req.successCh:
+			require.Equal(t, resp.llama, a.srv)
+		case err := <-r.req.errCh:
+			t.Fatal(err.Error())
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+	}
+
+	// b finishes first, then the keep_alive 0 request is cancelled mid-stream.
+	// The runner is kept for b's longer keep alive
+	b.ctxDone()
+	time.Sleep(10 * time.Millisecond)
+	a.ctxDone()
+	time.Sleep(20 * time.Millisecond)
+
+	s.loadedMu.Lock()
+	require.Len(t, s.loaded, 1)
+	runner := s.loaded[a.req.model.ModelPath]
+	s.loadedMu.Unlock()
+	require.False(t, a.srv.closeCalled)
+
+	runner.refMu.Lock()
+	require.Equal(t, 5*time.Minute, runner.sessionDuration)
+	runner.refMu.Unlock()
+
+	// once the runner is idle, earlier keep alives no longer count
+	s.pendingReqCh <- c.req
+	select {
+	case resp := <-c.req.successCh:
+		require.Equal(t, resp.llama, a.srv)
+	case err := <-c.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	c.ctxDone()
+	require.Eventually(t, func() bool {
+		s.loadedMu.Lock()
+		defer s.loadedMu.Unlock()
+		return len(s.loaded) == 0
+	}, 200*time.Millisecond, 5*time.Millisecond)
+	require.True(t, a.srv.closeCalled)
+}
+
+func TestRequestKeepAliveWhileStreaming(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
+
+	s.newServerFn = a.newServer
+	s.Run(ctx)
+	s.pendingReqCh <- a.req
+	select {
+	case resp := <-a.req.successCh:
+		require.Equal(t, resp.llama, a.srv)
+	case err := <-a.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	// a slow stream outlasts the keep alive many times over
+	time.Sleep(50 * time.Millisecond)
+	s.loadedMu.Lock()
+	require.Len(t, s.loaded, 1)
+	s.loadedMu.Unlock()
+	require.False(t, a.srv.closeCalled)
+
+	// the keep alive starts once the stream finishes
+	a.ctxDone()
+	require.Eventually(t, func() bool {
+		s.loadedMu.Lock()
+		defer s.loadedMu.Unlock()
+		return len(s.loaded) == 0
+	}, 200*time.Millisecond, 5*time.Millisecond)
+}
+
 func TestRequestsSimpleReloadSameModel(t *testing.T) {
 	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
 	defer done()
@@ -257,6 +391,85 @@ func TestRequestsSimpleReloadSameModel(t *testing.T) {
 	}
 }
 
+func TestRequestsIncompatibleSameModel(t *testing.T) {
+	cases := []struct {
+		policy string
+		// alongside is true when the second request is loaded while the first
+		// is still running
+		alongside bool
+	}{
+		{policy: "serialize", alongside: false},
+		{policy: "second_runner", alongside: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.policy, func(t *testing.T) {
+			t.Setenv("OLLAMA_RELOAD_POLICY", tt.policy)
+
+			ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+			defer done()
+			s := InitScheduler(ctx)
+			s.getGpuFn = getGpuFn
+			s.getCpuFn = getCpuFn
+			a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
+			b := newScenarioRequest(t, ctx, "ollama-model-1", 20, &api.Duration{Duration: 5 * time.Millisecond})
+			tmpModel := *a.req.model
+			b.req.model = &tmpModel
+			b.f = a.f
+			b.req.opts.KVCacheType = "q8_0"
+
+			s.newServerFn = a.newServer
+			s.pendingReqCh <- a.req
+			s.Run(ctx)
+			select {
+			case resp := <-a.req.successCh:
+				require.Equal(t, resp.llama, a.srv)
+			case err := <-a.req.errCh:
+				t.Fatal(err.Error())
+			case <-ctx.Done():
+				t.Fatal("timeout")
+			}
+
+			// a is still running when b arrives with a different cache type
+			s.newServerFn = b.newServer
+			s.pendingReqCh <- b.req
+			select {
+			case resp := <-b.req.successCh:
+				if !tt.alongside {
+					t.Fatal("expected b to wait for a to finish")
+				}
+				require.Equal(t, resp.llama, b.srv)
+				require.Equal(t, "q8_0", resp.Options.KVCacheType)
+				s.loadedMu.Lock()
+				require.Len(t, s.loaded, 2)
+				s.loadedMu.Unlock()
+				a.ctxDone()
+				return
+			case err := <-b.req.errCh:
+				t.Fatal(err.Error())
+			case <-time.After(50 * time.Millisecond):
+				if tt.alongside {
+					t.Fatal("expected b to load alongside a")
+				}
+			}
+
+			a.ctxDone()
+			select {
+			case resp := <-b.req.successCh:
+				require.Equal(t, resp.llama, b.srv)
+				require.Equal(t, "q8_0", resp.Options.KVCacheType)
+				s.loadedMu.Lock()
+				require.Len(t, s.loaded, 1)
+				s.loadedMu.Unlock()
+			case err := <-b.req.errCh:
+				t.Fatal(err.Error())
+			case <-ctx.Done():
+				t.Fatal("timeout")
+			}
+		})
+	}
+}
+
 func TestRequestsMultipleLoadedModels(t *testing.T) {
 	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
 	defer done()
@@ -354,6 +567,261 @@ func TestRequestsMultipleLoadedModels(t *testing.T) {
 	s.loadedMu.Unlock()
 }
 
+func TestRequestEvictedRunners(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+
+	a := newScenarioRequest(t, ctx, "ollama-model-1a", 10, nil)
+	b := newScenarioRequest(t, ctx, "ollama-model-1b", 10, nil)
+
+	t.Setenv("OLLAMA_MAX_LOADED_MODELS", "1")
+	s.newServerFn = a.newServer
+	s.pendingReqCh <- a.req
+	s.Run(ctx)
+	select {
+	case resp := <-a.req.successCh:
+		require.Equal(t, resp.llama, a.srv)
+	case err := <-a.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	require.Equal(t, 0, a.req.evicted)
+
+	// b doesn't fit alongside a, so a is evicted once it finishes
+	a.ctxDone()
+	s.newServerFn = b.newServer
+	s.pendingReqCh <- b.req
+	select {
+	case resp := <-b.req.successCh:
+		require.Equal(t, resp.llama, b.srv)
+	case err := <-b.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	require.Equal(t, 1, b.req.evicted)
+	require.True(t, a.srv.closeCalled)
+}
+
+func TestRequestColdStart(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Minute})
+	b := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Minute})
+	b.req.model = a.req.model
+	b.f = a.f
+
+	s.newServerFn = a.newServer
+	s.Run(ctx)
+	for _, r := range []*reqBundle{a, b} {
+		s.pendingReqCh <- r.req
+		select {
+		case resp := <-r.req.successCh:
+			require.Equal(t, resp.llama, a.srv)
+		case err := <-r.req.errCh:
+			t.Fatal(err.Error())
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+	}
+
+	require.True(t, a.req.coldStart)
+	require.False(t, b.req.coldStart)
+}
+
+func TestRequestLoadStages(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 2*time.Second)
+	defer done()
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Minute})
+	a.srv.waitDelay = 100 * time.Millisecond
+	a.srv.loadWeights = 60 * time.Millisecond
+	a.srv.loadCache = 20 * time.Millisecond
+
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+		time.Sleep(50 * time.Millisecond)
+		return a.newServer(gpus, model, f, adapters, projectors, opts, numParallel)
+	}
+
+	start := time.Now()
+	s.pendingReqCh <- a.req
+	s.Run(ctx)
+	select {
+	case resp := <-a.req.successCh:
+		require.Equal(t, resp.llama, a.srv)
+	case err := <-a.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	total := time.Since(start)
+
+	stages := a.req.stages
+	require.GreaterOrEqual(t, stages.Start, 50*time.Millisecond)
+	require.Equal(t, 60*time.Millisecond, stages.Weights)
+	require.Equal(t, 20*time.Millisecond, stages.Cache)
+	require.GreaterOrEqual(t, stages.Ready, 20*time.Millisecond)
+
+	// the stages account for the whole load, apart from handing the request
+	// between goroutines
+	sum := stages.Queue + stages.Parse + stages.Start + stages.Weights + stages.Cache + stages.Ready
+	require.InEpsilon(t, float64(total), float64(sum), 0.2)
+}
+
+func TestRequestMaxLoads(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 2*time.Second)
+	defer done()
+	t.Setenv("OLLAMA_MAX_LOADS", "2")
+	t.Setenv("OLLAMA_MAX_LOADED_MODELS", "5")
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	s.reschedDelay = 5 * time.Millisecond
+
+	scenarios := map[string]*reqBundle{}
+	for i := range 5 {
+		r := newScenarioRequest(t, ctx, fmt.Sprintf("ollama-model-%d", i), 10, &api.Duration{Duration: 5 * time.Minute})
+		r.req.opts.NumGPU = 0
+		r.srv.waitDelay = 30 * time.Millisecond
+		scenarios[r.req.model.ModelPath] = r
+	}
+
+	var mu sync.Mutex
+	var loads, maxLoading int
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+		s.loadedMu.Lock()
+		loading := 1
+		for _, r := range s.loaded {
+			if r.loading {
+				loading++
+			}
+		}
+		s.loadedMu.Unlock()
+
+		mu.Lock()
+		loads++
+		maxLoading = max(maxLoading, loading)
+		mu.Unlock()
+		return scenarios[model].newServer(gpus, model, f, adapters, projectors, opts, numParallel)
+	}
+
+	s.Run(ctx)
+	for _, r := range scenarios {
+		s.pendingReqCh <- r.req
+	}
+
+	for _, r := range scenarios {
+		select {
+		case resp := <-r.req.successCh:
+			require.Equal(t, resp.llama, r.srv)
+		case err := <-r.req.errCh:
+			t.Fatal(err.Error())
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+	}
+
+	require.Equal(t, 5, loads)
+	require.Equal(t, 2, maxLoading)
+}
+
+func TestLoadFailureReason(t *testing.T) {
+	cases := []struct {
+		name    string
+		gpus    func() discover.GpuInfoList
+		srvErr  error
+		waitErr error
+		reason  api.LoadFailure
+	}{
+		{
+			name:    "insufficient vram",
+			gpus:    getGpuFn,
+			waitErr: errors.New("llama runner process has terminated: cudaMalloc failed: out of memory"),
+			reason:  api.LoadFailureInsufficientVRAM,
+		},
+		{
+			name:   "no compatible gpu",
+			gpus:   getCpuFn,
+			srvErr: errors.New("model requires more system memory (12.0 GiB) than is available (8.0 GiB)"),
+			reason: api.LoadFailureNoCompatibleGPU,
+		},
+		{
+			name:    "no device",
+			gpus:    getGpuFn,
+			waitErr: errors.New("llama runner process has terminated: CUDA error: no CUDA-capable device is detected"),
+			reason:  api.LoadFailureNoCompatibleGPU,
+		},
+		{
+			name:    "unclassified",
+			gpus:    getGpuFn,
+			waitErr: errors.New("llama runner process has terminated: error loading model vocabulary"),
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+			defer done()
+			s := InitScheduler(ctx)
+			s.getGpuFn = tt.gpus
+			s.getCpuFn = getCpuFn
+			a := newScenarioRequest(t, ctx, "ollama-model-1", 10, nil)
+			a.srv.waitResp = tt.waitErr
+			s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+				if tt.srvErr != nil {
+					return nil, tt.srvErr
+				}
+				return a.newServer(gpus, model, f, adapters, projectors, opts, numParallel)
+			}
+
+			s.pendingReqCh <- a.req
+			s.Run(ctx)
+			select {
+			case <-a.req.successCh:
+				t.Fatal("expected load to fail")
+			case err := <-a.req.errCh:
+				var lerr *loadError
+				if tt.reason == "" {
+					require.False(t, errors.As(err, &lerr), "unexpected reason for %v", err)
+					return
+				}
+				require.ErrorAs(t, err, &lerr)
+				require.Equal(t, tt.reason, lerr.reason)
+			case <-ctx.Done():
+				t.Fatal("timeout")
+			}
+		})
+	}
+
+	t.Run("capacity exceeded", func(t *testing.T) {
+		ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+		defer done()
+		t.Setenv("OLLAMA_MAX_QUEUE", "1")
+		s := InitScheduler(ctx)
+		a := newScenarioRequest(t, ctx, "ollama-model-1a", 10, nil)
+		b := newScenarioRequest(t, ctx, "ollama-model-1b", 10, nil)
+
+		s.GetRunner(a.ctx, a.req.model, a.req.opts, a.req.sessionDuration, 0)
+		_, errCh := s.GetRunner(b.ctx, b.req.model, b.req.opts, b.req.sessionDuration, 0)
+
+		err := <-errCh
+		require.ErrorIs(t, err, ErrMaxQueue)
+
+		var lerr *loadError
+		require.ErrorAs(t, err, &lerr)
+		require.Equal(t, api.LoadFailureCapacityExceeded, lerr.reason)
+	})
+}
+
 func TestGetRunner(t *testing.T) {
 	ctx, done := context.WithTimeout(t.Context(), 3*time.Second)
 	defer done()
@@ -367,10 +835,10 @@ func TestGetRunner(t *testing.T) {
 	s.getCpuFn = getCpuFn
 	s.newServerFn = a.newServer
 	slog.Info("a")
-	successCh1a, errCh1a := s.GetRunner(a.ctx, a.req.model, a.req.opts, a.req.sessionDuration)
+	successCh1a, errCh1a := s.GetRunner(a.ctx, a.req.model, a.req.opts, a.req.sessionDuration, 0)
 	require.Len(t, s.pendingReqCh, 1)
 	slog.Info("b")
-	successCh1b, errCh1b := s.GetRunner(b.ctx, b.req.model, b.req.opts, b.req.sessionDuration)
+	successCh1b, errCh1b := s.GetRunner(b.ctx, b.req.model, b.req.opts, b.req.sessionDuration, 0)
 	require.Len(t, s.pendingReqCh, 1)
 	require.Empty(t, successCh1b)
 	require.Len(t, errCh1b, 1)
@@ -394,7 +862,7 @@ func TestGetRunner(t *testing.T) {
 
 	c.req.model.ModelPath = "bad path"
 	slog.Info("c")
-	successCh1c, errCh1c := s.GetRunner(c.ctx, c.req.model, c.req.opts, c.req.sessionDuration)
+	successCh1c, errCh1c := s.GetRunner(c.ctx, c.req.model, c.req.opts, c.req.sessionDuration, 0)
 	// Starts in pending channel, then should be quickly processed to return an error
 	time.Sleep(50 * time.Millisecond) // Long enough for the "a" model to expire and unload
 	require.Empty(t, successCh1c)
@@ -407,6 +875,63 @@ func TestGetRunner(t *testing.T) {
 	b.ctxDone()
 }
 
+func TestRequestPriority(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer done()
+
+	low := newScenarioRequest(t, ctx, "ollama-model-low", 10, nil)
+	high := newScenarioRequest(t, ctx, "ollama-model-high", 10, nil)
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	loaded := make(chan string, 2)
+	s.loadFn = func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+		loaded <- req.model.Name
+	}
+
+	s.GetRunner(low.ctx, low.req.model, low.req.opts, low.req.sessionDuration, 0)
+	s.GetRunner(high.ctx, high.req.model, high.req.opts, high.req.sessionDuration, 10)
+	require.Len(t, s.pendingReqCh, 2)
+	s.Run(ctx)
+
+	for _, expect := range []string{"ollama-model-high", "ollama-model-low"} {
+		select {
+		case name := <-loaded:
+			require.Equal(t, expect, name)
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestPendingQueueRequeue(t *testing.T) {
+	var q pendingQueue
+	first, second := &LlmRequest{}, &LlmRequest{}
+	q.push(first)
+	q.push(second)
+	require.Same(t, first, q.pop())
+
+	// a throttled request put back in the queue keeps its place
+	q.push(first)
+	require.Same(t, first, q.pop())
+	require.Same(t, second, q.pop())
+
+	// and its reported position
+	var s Scheduler
+	s.enqueued(first)
+	s.enqueued(second)
+	s.dequeued(first)
+	s.enqueued(first)
+
+	position, _, ok := s.queueStatus(first)
+	require.True(t, ok)
+	require.Equal(t, 0, position)
+
+	position, _, ok = s.queueStatus(second)
+	require.True(t, ok)
+	require.Equal(t, 1, position)
+}
+
 func TestExpireRunner(t *testing.T) {
 	ctx, done := context.WithTimeout(t.Context(), 20*time.Millisecond)
 	defer done()
@@ -468,7 +993,7 @@ func TestPrematureExpired(t *testing.T) {
 		return []discover.GpuInfo{g}
 	}
 	s.newServerFn = scenario1a.newServer
-	successCh1a, errCh1a := s.GetRunner(scenario1a.ctx, scenario1a.req.model, scenario1a.req.opts, scenario1a.req.sessionDuration)
+	successCh1a, errCh1a := s.GetRunner(scenario1a.ctx, scenario1a.req.model, scenario1a.req.opts, scenario1a.req.sessionDuration, 0)
 	require.Len(t, s.pendingReqCh, 1)
 	s.Run(ctx)
 	select {
@@ -660,6 +1185,73 @@ func TestNeedsReload(t *testing.T) {
 	req.opts.NumGPU = -1
 	resp = runner.needsReload(ctx, req)
 	require.False(t, resp)
+	req.opts.KVCacheType = "q8_0"
+	resp = runner.needsReload(ctx, req)
+	require.True(t, resp)
+}
+
+func TestLoadKVCacheType(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	req := &LlmRequest{
+		ctx:             ctx,
+		model:           &Model{ModelPath: "foo"},
+		opts:            api.DefaultOptions(),
+		successCh:       make(chan *runnerRef, 1),
+		errCh:           make(chan error, 1),
+		sessionDuration: &api.Duration{Duration: 2 * time.Second},
+	}
+	req.opts.KVCacheType = "q8_0"
+
+	var kvCacheType string
+	server := &mockLlm{estimatedVRAMByGPU: map[string]uint64{}}
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+		kvCacheType = opts.KVCacheType
+		return server, nil
+	}
+	s.load(req, nil, discover.GpuInfoList{}, 0)
+
+	select {
+	case err := <-req.errCh:
+		require.NoError(t, err)
+	case resp := <-req.successCh:
+		require.Equal(t, "q8_0", kvCacheType)
+		require.Equal(t, "q8_0", resp.Options.KVCacheType)
+	}
+}
+
+func TestLoadingRunners(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	req := &LlmRequest{
+		ctx:             ctx,
+		model:           &Model{ModelPath: "foo"},
+		opts:            api.DefaultOptions(),
+		successCh:       make(chan *runnerRef, 1),
+		errCh:           make(chan error, 1),
+		sessionDuration: &api.Duration{Duration: 2 * time.Second},
+	}
+
+	server := &mockLlm{waitDelay: 50 * time.Millisecond, estimatedVRAMByGPU: map[string]uint64{}}
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+		return server, nil
+	}
+	s.load(req, nil, discover.GpuInfoList{}, 0)
+
+	loading := s.loadingRunners()
+	require.Len(t, loading, 1)
+	require.Equal(t, "foo", loading[0].modelPath)
+
+	select {
+	case err := <-req.errCh:
+		require.NoError(t, err)
+	case <-req.successCh:
+		require.Empty(t, s.loadingRunners())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
 }
 
 func TestUnloadAllRunners(t *testing.T) {
@@ -762,13 +1354,19 @@ type mockLlm struct {
 	detonekizeRespErr  error
 	closeResp          error
 	closeCalled        bool
+	waitDelay          time.Duration
 	estimatedVRAM      uint64
 	estimatedTotal     uint64
 	estimatedVRAMByGPU map[string]uint64
+	loadWeights        time.Duration
+	loadCache          time.Duration
 }
 
-func (s *mockLlm) Ping(ctx context.Context) error             { return s.pingResp }
-func (s *mockLlm) WaitUntilRunning(ctx context.Context) error { return s.waitResp }
+func (s *mockLlm) Ping(ctx context.Context) error { return s.pingResp }
+func (s *mockLlm) WaitUntilRunning(ctx context.Context) error {
+	time.Sleep(s.waitDelay)
+	return s.waitResp
+}
 func (s *mockLlm) Completion(ctx context.Context, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
 	return s.completionResp
 }
@@ -789,7 +1387,8 @@ func (s *mockLlm) Close() error {
 	s.closeCalled = true
 	return s.closeResp
 }
-func (s *mockLlm) EstimatedVRAM() uint64                  { return s.estimatedVRAM }
-func (s *mockLlm) EstimatedTotal() uint64                 { return s.estimatedTotal }
-func (s *mockLlm) EstimatedVRAMByGPU(gpuid string) uint64 { return s.estimatedVRAMByGPU[gpuid] }
-func (s *mockLlm) Pid() int                               { return -1 }
+func (s *mockLlm) EstimatedVRAM() uint64                      { return s.estimatedVRAM }
+func (s *mockLlm) EstimatedTotal() uint64                     { return s.estimatedTotal }
+func (s *mockLlm) EstimatedVRAMByGPU(gpuid string) uint64     { return s.estimatedVRAMByGPU[gpuid] }
+func (s *mockLlm) LoadStages() (time.Duration, time.Duration) { return s.loadWeights, s.loadCache }
+func (s *mockLlm) Pid() int                                   { return -1 }
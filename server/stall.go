@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errStalled   = errors.New("generation stalled")
+	errMaxChunks = errors.New("generation reached the maximum number of chunks")
+)
+
+// withStallTimeout returns a context which is canceled with errStalled unless
+// reset is called at least every timeout. The timeout starts with the first
+// call to reset, so evaluating the prompt before the first chunk never stalls.
+// A zero timeout never stalls. stop releases the context's resources.
+func withStallTimeout(ctx context.Context, timeout time.Duration) (_ context.Context, reset func(), stop func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if timeout <= 0 {
+		return ctx, func() {}, func() { cancel(nil) }
+	}
+
+	var mu sync.Mutex
+	var timer *time.Timer
+	reset = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if timer == nil {
+			timer = time.AfterFunc(timeout, func() { cancel(errStalled) })
+			return
+		}
+		timer.Reset(timeout)
+	}
+
+	stop = func() {
+		mu.Lock()
+		if timer != nil {
+			timer.Stop()
+		}
+		mu.Unlock()
+		cancel(nil)
+	}
+
+	return ctx, reset, stop
+}
+
+// stallError returns errStalled in place of err when ctx was canceled because
+// the generation stalled
+func stallError(ctx context.Context, err error) error {
+	if errors.Is(context.Cause(ctx), errStalled) {
+		return errStalled
+	}
+
+	return err
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// messageTokenCache holds token counts of individual chat messages so repeated
+// turns of a conversation don't need to be tokenized again
+var messageTokenCache = &tokenCache{}
+
+type tokenCacheKey struct {
+	// model is the path of the model weights. Keying on the model ensures
+	// counts are invalidated when the model changes and never shared between
+	// tokenizers
+	model string
+	// hash is the digest of the tokenized text
+	hash [sha256.Size]byte
+}
+
+type tokenCacheEntry struct {
+	key   tokenCacheKey
+	count int
+}
+
+// tokenCache is a least recently used cache of token counts. Its capacity is
+// set by OLLAMA_TOKEN_CACHE_SIZE.
+type tokenCache struct {
+	mu      sync.Mutex
+	entries map[tokenCacheKey]*list.Element
+	lru     list.List
+}
+
+func (c *tokenCache) get(model, s string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[tokenCacheKey{model, sha256.Sum256([]byte(s))}]
+	if !ok {
+		return 0, false
+	}
+
+	c.lru.MoveToFront(e)
+	return e.Value.(*tokenCacheEntry).count, true
+}
+
+func (c *tokenCache) put(model, s string, count int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[tokenCacheKey]*list.Element)
+	}
+
+	key := tokenCacheKey{model, sha256.Sum256([]byte(s))}
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*tokenCacheEntry).count = count
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&tokenCacheEntry{key: key, count: count})
+	for c.lru.Len() > int(envconfig.TokenCacheSize()) {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*tokenCacheEntry).key)
+	}
+}
@@ -2,7 +2,9 @@ package template
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
@@ -144,6 +146,12 @@ func (t *Template) String() string {
 	return t.raw
 }
 
+// Digest returns the sha256 digest of the template source
+func (t *Template) Digest() string {
+	sum := sha256.Sum256([]byte(t.raw))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
 func (t *Template) Vars() []string {
 	var vars []string
 	for _, tt := range t.Templates() {
@@ -323,6 +331,10 @@ func collate(msgs []api.Message) (string, []*api.Message) {
 
 		if len(collated) > 0 && collated[len(collated)-1].Role == msg.Role {
 			collated[len(collated)-1].Content += "\n\n" + msg.Content
+			// tool calls of merged messages are kept with the merged content
+			if len(msg.ToolCalls) > 0 {
+				collated[len(collated)-1].ToolCalls = slices.Concat(collated[len(collated)-1].ToolCalls, msg.ToolCalls)
+			}
 		} else {
 			collated = append(collated, &msg)
 		}
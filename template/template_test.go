@@ -317,6 +317,23 @@ What is your name?<|im_end|>
 <|im_start|>assistant
 `,
 		},
+		{
+			"merged tool calls",
+			[]template{
+				{"messages", `
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{- range .ToolCalls }} [{{ .Function.Name }}]{{ end }}
+{{ end }}`},
+			},
+			Values{
+				Messages: []api.Message{
+					{Role: "user", Content: "What's the weather?"},
+					{Role: "assistant", Content: "Let me check."},
+					{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather"}}}},
+				},
+			},
+			"user: What's the weather?\nassistant: Let me check.\n\n [get_weather]\n",
+		},
 	}
 
 	for _, tt := range cases {
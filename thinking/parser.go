@@ -73,6 +73,12 @@ func (s *Parser) AddContent(content string) (string, string) {
 	return thinkingSb.String(), remainingSb.String()
 }
 
+// InThinking reports whether the content added so far opened a thinking
+// section without closing it
+func (s *Parser) InThinking() bool {
+	return s.state == thinkingState_ThinkingStartedEatingWhitespace || s.state == thinkingState_Thinking
+}
+
 // the additional bool return is true iff we should continue eating
 func eat(s *Parser) (string, string, bool) {
 	switch s.state {
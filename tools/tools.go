@@ -93,13 +93,13 @@ func parseJSONToolCalls(s string, name, arguments string, prefix string) ([]api.
 	// Attempt full unmarshal of the JSON
 	var toolCalls []api.ToolCall
 	for _, rawToolCall := range rawToolCalls {
-		var resp map[string]any
-		if err := json.Unmarshal([]byte(rawToolCall), &resp); err != nil {
+		if !json.Valid([]byte(rawToolCall)) {
 			continue
 		}
 
-		// Collect nested objects that could contain tool calls
-		objs := collect(resp)
+		// Collect nested objects that could contain tool calls, in the order
+		// the model emitted them
+		objs := collect([]byte(rawToolCall))
 		if len(objs) == 0 {
 			continue
 		}
@@ -220,6 +220,13 @@ func (p *Parser) Add(s string) (tools []api.ToolCall, content string) {
 	return toolCalls, ""
 }
 
+// Incremental reports whether the template marks where tool calls start, so
+// they can be told apart from content as the response streams. Without a
+// prefix, tool calls are parsed greedily from whatever content is generated.
+func (p *Parser) Incremental() bool {
+	return p.prefix != ""
+}
+
 // NewParser creates a new tool call parser from a template. It extracts the tool call format,
 // prefix, and field names from the template to use for parsing tool calls from model output.
 //
@@ -246,6 +246,27 @@ func TestParseJSONToolCalls(t *testing.T) {
 	}
 }
 
+func TestParseJSONToolCallsOrder(t *testing.T) {
+	input := `{"first": {"name": "b_tool", "arguments": {}}, "second": {"name": "a_tool", "arguments": {}}, "third": {"name": "c_tool", "arguments": {}}}`
+
+	// map iteration is randomized, so repeat to catch ordering by chance
+	for range 50 {
+		calls, err := parseJSONToolCalls(input, "name", "arguments", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, call := range calls {
+			names = append(names, call.Function.Name)
+		}
+
+		if diff := cmp.Diff([]string{"b_tool", "a_tool", "c_tool"}, names); diff != "" {
+			t.Fatalf("tool call order mismatch (-want +got):\n%s", diff)
+		}
+	}
+}
+
 func TestParseToolCalls(t *testing.T) {
 	p := filepath.Join("testdata")
 	t1 := api.ToolCall{
@@ -671,3 +692,28 @@ func TestParseToolCalls(t *testing.T) {
 		})
 	}
 }
+
+func TestParserIncremental(t *testing.T) {
+	p := filepath.Join("testdata")
+	for model, want := range map[string]bool{
+		"mistral":  true,
+		"qwen2.5":  true,
+		"llama3.2": false,
+	} {
+		t.Run(model, func(t *testing.T) {
+			tmpl, err := template.Parse(readFile(t, p, fmt.Sprintf("%s.gotmpl", model)).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parser, err := NewParser(tmpl.Template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := parser.Incremental(); got != want {
+				t.Errorf("expected incremental %v, got %v", want, got)
+			}
+		})
+	}
+}
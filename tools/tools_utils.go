@@ -198,24 +198,45 @@ func extractToolArgs(tmpl *gotmpl.Template) (name, arguments string, err error)
 	return name, arguments, nil
 }
 
-// collect recursively traverses an object to collect all nested maps
+// collect traverses a JSON value to collect all nested objects in the order
+// they appear in the source, each before the objects nested in it. Decoding
+// into maps alone would lose this order.
 //
 // Returns:
-//   - []map[string]any: A slice of all nested maps found in the object
-func collect(obj any) []map[string]any {
-	var all []map[string]any
-	switch o := obj.(type) {
-	case map[string]any:
-		all = append(all, o)
-		for _, v := range o {
-			all = append(all, collect(v)...)
+//   - []map[string]any: A slice of all nested maps found in the value
+func collect(data []byte) []map[string]any {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	// record where each object starts and ends
+	var open []int
+	var spans [][2]int
+	for {
+		offset := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+
+		switch tok {
+		case json.Delim('{'):
+			// only whitespace and separators precede the delimiter
+			open = append(open, offset+bytes.IndexByte(data[offset:], '{'))
+		case json.Delim('}'):
+			start := open[len(open)-1]
+			open = open[:len(open)-1]
+			spans = append(spans, [2]int{start, int(dec.InputOffset())})
 		}
-	case []any:
-		for _, v := range o {
-			all = append(all, collect(v)...)
+	}
+
+	slices.SortFunc(spans, func(a, b [2]int) int { return a[0] - b[0] })
+
+	var all []map[string]any
+	for _, span := range spans {
+		var obj map[string]any
+		if err := json.Unmarshal(data[span[0]:span[1]], &obj); err != nil {
+			return nil
 		}
-	default:
-		return nil
+		all = append(all, obj)
 	}
 
 	return all
@@ -396,25 +396,19 @@ func TestExtractToolArgs(t *testing.T) {
 func TestCollect(t *testing.T) {
 	cases := []struct {
 		name string
-		obj  any
+		obj  string
 		want []map[string]any
 	}{
 		{
 			name: "simple map",
-			obj: map[string]any{
-				"key": "value",
-			},
+			obj:  `{"key": "value"}`,
 			want: []map[string]any{
 				{"key": "value"},
 			},
 		},
 		{
 			name: "nested map",
-			obj: map[string]any{
-				"outer": map[string]any{
-					"inner": "value",
-				},
-			},
+			obj:  `{"outer": {"inner": "value"}}`,
 			want: []map[string]any{
 				{"outer": map[string]any{"inner": "value"}},
 				{"inner": "value"},
@@ -422,10 +416,7 @@ func TestCollect(t *testing.T) {
 		},
 		{
 			name: "array of maps",
-			obj: []any{
-				map[string]any{"key1": "val1"},
-				map[string]any{"key2": "val2"},
-			},
+			obj:  `[{"key1": "val1"}, {"key2": "val2"}]`,
 			want: []map[string]any{
 				{"key1": "val1"},
 				{"key2": "val2"},
@@ -433,29 +424,34 @@ func TestCollect(t *testing.T) {
 		},
 		{
 			name: "deeply nested",
-			obj: map[string]any{
-				"l1": map[string]any{
-					"l2": map[string]any{
-						"l3": "value",
-					},
-				},
-			},
+			obj:  `{"l1": {"l2": {"l3": "value"}}}`,
 			want: []map[string]any{
 				{"l1": map[string]any{"l2": map[string]any{"l3": "value"}}},
 				{"l2": map[string]any{"l3": "value"}},
 				{"l3": "value"},
 			},
 		},
+		{
+			name: "source order",
+			obj:  `{"z": {"a": 1}, "b": {"c": {"d": 2}}, "a": {"e": 3}}`,
+			want: []map[string]any{
+				{"z": map[string]any{"a": 1.0}, "b": map[string]any{"c": map[string]any{"d": 2.0}}, "a": map[string]any{"e": 3.0}},
+				{"a": 1.0},
+				{"c": map[string]any{"d": 2.0}},
+				{"d": 2.0},
+				{"e": 3.0},
+			},
+		},
 		{
 			name: "non-map value",
-			obj:  "string",
+			obj:  `"string"`,
 			want: nil,
 		},
 	}
 
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
-			got := collect(tt.obj)
+			got := collect([]byte(tt.obj))
 			if len(got) != len(tt.want) {
 				t.Errorf("collect() got %d maps, want %d", len(got), len(tt.want))
 				return
@@ -0,0 +1,90 @@
+package tools
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/ollama/ollama/api"
+)
+
+// Validate checks the arguments of a tool call against the parameters
+// declared by the tool with the same name. It returns a description of each
+// problem found, or nil if the call is valid.
+func Validate(call api.ToolCall, tools []api.Tool) []string {
+	i := slices.IndexFunc(tools, func(t api.Tool) bool {
+		return t.Function.Name == call.Function.Name
+	})
+	if i < 0 {
+		return []string{fmt.Sprintf("unknown tool %q", call.Function.Name)}
+	}
+
+	params := tools[i].Function.Parameters
+
+	var problems []string
+	for _, name := range params.Required {
+		if _, ok := call.Function.Arguments[name]; !ok {
+			problems = append(problems, fmt.Sprintf("missing required argument %q", name))
+		}
+	}
+
+	// iterate in a stable order so problems are reported consistently
+	names := make([]string, 0, len(call.Function.Arguments))
+	for name := range call.Function.Arguments {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		prop, ok := params.Properties[name]
+		if !ok || len(prop.Type) == 0 {
+			continue
+		}
+
+		value := call.Function.Arguments[name]
+		if !slices.ContainsFunc(prop.Type, func(t string) bool { return isType(value, t) }) {
+			problems = append(problems, fmt.Sprintf("argument %q must be of type %s", name, prop.Type))
+		}
+	}
+
+	return problems
+}
+
+// isType reports whether a decoded JSON value matches a JSON schema type.
+// Unrecognized types match any value.
+func isType(v any, t string) bool {
+	switch t {
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		switch v.(type) {
+		case float64, float32, int, int64:
+			return true
+		}
+		return false
+	case "integer":
+		switch v := v.(type) {
+		case int, int64:
+			return true
+		case float64:
+			return v == math.Trunc(v)
+		case float32:
+			return float64(v) == math.Trunc(float64(v))
+		}
+		return false
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "null":
+		return v == nil
+	default:
+		return true
+	}
+}
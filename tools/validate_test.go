@@ -0,0 +1,84 @@
+package tools
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestValidate(t *testing.T) {
+	var tools []api.Tool
+	if err := json.Unmarshal([]byte(`[{
+		"type": "function",
+		"function": {
+			"name": "get_weather",
+			"parameters": {
+				"type": "object",
+				"required": ["location"],
+				"properties": {
+					"location": {"type": "string"},
+					"days": {"type": "integer"},
+					"unit": {"type": ["string", "null"]}
+				}
+			}
+		}
+	}]`), &tools); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		call api.ToolCall
+		want []string
+	}{
+		{
+			name: "valid",
+			call: api.ToolCall{Function: api.ToolCallFunction{
+				Name:      "get_weather",
+				Arguments: api.ToolCallFunctionArguments{"location": "Paris", "days": float64(3), "unit": nil},
+			}},
+		},
+		{
+			name: "missing required",
+			call: api.ToolCall{Function: api.ToolCallFunction{
+				Name:      "get_weather",
+				Arguments: api.ToolCallFunctionArguments{"days": float64(3)},
+			}},
+			want: []string{`missing required argument "location"`},
+		},
+		{
+			name: "wrong types",
+			call: api.ToolCall{Function: api.ToolCallFunction{
+				Name:      "get_weather",
+				Arguments: api.ToolCallFunctionArguments{"location": "Paris", "days": 1.5, "unit": true},
+			}},
+			want: []string{
+				`argument "days" must be of type integer`,
+				`argument "unit" must be of type [string null]`,
+			},
+		},
+		{
+			name: "undeclared argument",
+			call: api.ToolCall{Function: api.ToolCallFunction{
+				Name:      "get_weather",
+				Arguments: api.ToolCallFunctionArguments{"location": "Paris", "extra": 1},
+			}},
+		},
+		{
+			name: "unknown tool",
+			call: api.ToolCall{Function: api.ToolCallFunction{Name: "get_time"}},
+			want: []string{`unknown tool "get_time"`},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, Validate(tt.call, tools)); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}